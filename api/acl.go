@@ -0,0 +1,466 @@
+package api
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"lrue/src"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// ErrNoAuth is returned for commands sent before AUTH when users are configured
+	ErrNoAuth = errors.New("NOAUTH authentication required")
+	// ErrWrongPass is returned by AUTH for an unknown user or a wrong password
+	ErrWrongPass = errors.New("WRONGPASS invalid username-password pair")
+	// ErrNoPerm is returned for commands the user is not allowed to run
+	ErrNoPerm = errors.New("NOPERM")
+)
+
+// Password hashes are stored as pbkdf2-sha256$<iterations>$<salt>$<key>, with
+// the salt and key in unpadded base64
+const (
+	hashScheme     = "pbkdf2-sha256"
+	hashIterations = 600000
+	hashSaltSize   = 16
+	hashKeySize    = 32
+)
+
+// Successful password checks are remembered for verifiedTTL so that clients
+// sending credentials with every request, as HTTP does, only pay for PBKDF2
+// once. At most verifiedMax of them are kept.
+const (
+	verifiedTTL = time.Minute
+	verifiedMax = 4096
+)
+
+// Category groups commands for permissions
+type Category uint8
+
+const (
+	CategoryRead Category = 1 << iota
+	CategoryWrite
+	CategoryAdmin
+)
+
+var categoryNames = []struct {
+	name     string
+	category Category
+}{
+	{"read", CategoryRead},
+	{"write", CategoryWrite},
+	{"admin", CategoryAdmin},
+}
+
+func (c Category) String() string {
+	var names []string
+	for _, n := range categoryNames {
+		if c&n.category != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// parseCategories parses a comma separated list of categories, or "all"
+func parseCategories(s string) (Category, error) {
+	var c Category
+	for name := range strings.SplitSeq(s, ",") {
+		found := false
+		for _, n := range categoryNames {
+			if n.name == name || name == "all" {
+				c |= n.category
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown category: %s", name)
+		}
+	}
+	return c, nil
+}
+
+// User is one user of an ACL. It may run the commands of its categories on
+// the caches whose names match one of its patterns.
+type User struct {
+	Name       string
+	hash       string
+	categories Category
+	patterns   []string
+}
+
+// consoleUser is the local CLI, which may run every command
+var consoleUser = &User{Name: "console", categories: CategoryRead | CategoryWrite | CategoryAdmin, patterns: []string{"*"}}
+
+// allCaches stands for every cache in permission checks. Only the pattern
+// "*" matches it.
+const allCaches = "*"
+
+func (u *User) allows(category Category, title string) bool {
+	if u.categories&category == 0 {
+		return false
+	}
+	for _, pattern := range u.patterns {
+		if matchPattern(pattern, title) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern reports whether title matches pattern, a glob with the syntax
+// of path.Match. Cache names are not paths, so * and ? match / as well.
+func matchPattern(pattern, title string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := range title {
+				if matchPattern(pattern, title[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?', '[':
+			if title == "" {
+				return false
+			}
+			r, n := utf8.DecodeRuneInString(title)
+			end := 1
+			if pattern[0] == '[' {
+				end = classEnd(pattern)
+				if end < 0 {
+					return false
+				}
+				// A class alone has no / to split on, so path.Match applies it
+				if ok, _ := path.Match(pattern[:end], string(r)); !ok {
+					return false
+				}
+			}
+			pattern, title = pattern[end:], title[n:]
+		default:
+			skip := 1
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				skip = 2
+			}
+			if title == "" || title[0] != pattern[skip-1] {
+				return false
+			}
+			pattern, title = pattern[skip:], title[1:]
+		}
+	}
+	return title == ""
+}
+
+// classEnd returns the length of the character class pattern starts with, or
+// -1 when it is not closed
+func classEnd(pattern string) int {
+	i := 1
+	if i < len(pattern) && pattern[i] == '^' {
+		i++
+	}
+	for first := true; i < len(pattern); i, first = i+1, false {
+		switch {
+		case pattern[i] == '\\':
+			i++
+		case pattern[i] == ']' && !first:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// ACL is the set of users allowed to connect. Users are read from a file with
+// one user per line:
+//
+//	<name> <password_hash|-> <categories> <cache_patterns>
+//
+// Categories are a comma separated subset of read, write and admin, or all.
+// Patterns are comma separated globs such as users or sessions:*, matched by
+// matchPattern. A user without a password can only be reached through a TLS
+// client certificate with its name. Empty lines and lines starting with # are
+// ignored.
+type ACL struct {
+	users    map[string]*User
+	names    []string
+	verified verifiedCache
+}
+
+// verifiedCache holds the recently verified credentials of an ACL, keyed by
+// an HMAC of the user name and password under a random secret so that the
+// passwords are never kept
+type verifiedCache struct {
+	mutex  sync.Mutex
+	secret []byte
+	until  map[[sha256.Size]byte]time.Time
+}
+
+func (c *verifiedCache) key(name, password string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, c.secret)
+	fmt.Fprintf(mac, "%d:%s%s", len(name), name, password)
+	return [sha256.Size]byte(mac.Sum(nil))
+}
+
+// check reports whether key was verified less than verifiedTTL ago
+func (c *verifiedCache) check(key [sha256.Size]byte, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return now.Before(c.until[key])
+}
+
+// add remembers key as verified, dropping expired keys when the cache is full
+func (c *verifiedCache) add(key [sha256.Size]byte, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.until) >= verifiedMax {
+		maps.DeleteFunc(c.until, func(_ [sha256.Size]byte, until time.Time) bool { return !now.Before(until) })
+		if len(c.until) >= verifiedMax {
+			return
+		}
+	}
+	c.until[key] = now.Add(verifiedTTL)
+}
+
+// LoadACL reads the users file at name
+func LoadACL(name string) (*ACL, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	acl, err := ParseACL(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", name, err)
+	}
+	return acl, nil
+}
+
+// ParseACL reads users in the format of an ACL file
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{users: make(map[string]*User)}
+	acl.verified.secret = make([]byte, sha256.Size)
+	rand.Read(acl.verified.secret)
+	acl.verified.until = make(map[[sha256.Size]byte]time.Time)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%d: expected <name> <password_hash|-> <categories> <cache_patterns>", n)
+		}
+		user := &User{Name: fields[0], hash: fields[1], patterns: strings.Split(fields[3], ",")}
+		if _, taken := acl.users[user.Name]; taken {
+			return nil, fmt.Errorf("%d: user %s is defined twice", n, user.Name)
+		}
+		if user.hash != "-" {
+			if _, _, _, err := parseHash(user.hash); err != nil {
+				return nil, fmt.Errorf("%d: %w", n, err)
+			}
+		}
+		categories, err := parseCategories(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%d: %w", n, err)
+		}
+		user.categories = categories
+		for _, pattern := range user.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%d: invalid pattern %q", n, pattern)
+			}
+		}
+		acl.users[user.Name] = user
+		acl.names = append(acl.names, user.Name)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(acl.names)
+	return acl, nil
+}
+
+// authenticate returns the user name and password belong to
+func (a *ACL) authenticate(name, password string) (*User, error) {
+	user, ok := a.users[name]
+	if !ok || user.hash == "-" {
+		// Spend the same time as for a known user
+		verifyPassword(dummyHash(), password)
+		return nil, ErrWrongPass
+	}
+	if !verifyPassword(user.hash, password) {
+		return nil, ErrWrongPass
+	}
+	return user, nil
+}
+
+// authenticateCached runs authenticate, skipping the password check for
+// credentials verified in the last verifiedTTL
+func (a *ACL) authenticateCached(name, password string, now time.Time) (*User, error) {
+	key := a.verified.key(name, password)
+	if user, ok := a.users[name]; ok && a.verified.check(key, now) {
+		return user, nil
+	}
+	user, err := a.authenticate(name, password)
+	if err == nil {
+		a.verified.add(key, now)
+	}
+	return user, err
+}
+
+// lookup returns the user named by a TLS client certificate, if there is one
+func (a *ACL) lookup(identity string) *User {
+	return a.users[identity]
+}
+
+// list renders ACL LIST
+func (a *ACL) list() string {
+	lines := make([]string, len(a.names))
+	for i, name := range a.names {
+		user := a.users[name]
+		lines[i] = fmt.Sprintf("user %s %s %s", name, user.categories, strings.Join(user.patterns, ","))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// HashPassword returns the hash of password to put in an ACL file
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, hashSaltSize)
+	rand.Read(salt)
+	key, err := pbkdf2.Key(sha256.New, password, salt, hashIterations, hashKeySize)
+	if err != nil {
+		return "", err
+	}
+	encode := base64.RawStdEncoding.EncodeToString
+	return fmt.Sprintf("%s$%d$%s$%s", hashScheme, hashIterations, encode(salt), encode(key)), nil
+}
+
+// dummyHash is checked for unknown users so they are not told apart by timing
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := HashPassword("")
+	return hash
+})
+
+func parseHash(hash string) (iterations int, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return 0, nil, nil, fmt.Errorf("password hash must look like %s$<iterations>$<salt>$<key>", hashScheme)
+	}
+	iterations, err = strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, fmt.Errorf("invalid iteration count: %s", parts[1])
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil || len(key) == 0 {
+		return 0, nil, nil, fmt.Errorf("invalid key")
+	}
+	return iterations, salt, key, nil
+}
+
+func verifyPassword(hash, password string) bool {
+	iterations, salt, key, err := parseHash(hash)
+	if err != nil {
+		return false
+	}
+	derived, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(key))
+	return err == nil && subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// commandAccess returns the category a command needs and the caches it acts
+// on. Commands that need no permission return 0.
+func commandAccess[K src.Uints, V any](cmd *Command[K, V]) (Category, []string) {
+	switch cmd.operation {
+	case Cmd_GET, Cmd_WAITGET, Cmd_PRINT, Cmd_DUMP, Cmd_SUBSCRIBE, Cmd_WATCH:
+		return CategoryRead, []string{cmd.mapTitle}
+	case Cmd_SET, Cmd_DEL, Cmd_CLEAR, Cmd_INVALIDATE, Cmd_RESTORE, Cmd_DELRAW:
+		return CategoryWrite, []string{cmd.mapTitle}
+	case Cmd_MOVE:
+		return CategoryWrite, []string{cmd.mapTitle, cmd.target}
+	case Cmd_CONFIG:
+		title := cmd.mapTitle
+		if title == "" {
+			title = allCaches
+		}
+		if cmd.sub == Cmd_GET {
+			return CategoryRead, []string{title}
+		}
+		return CategoryAdmin, []string{title}
+	case Cmd_CREATE, Cmd_DESTROY:
+		return CategoryAdmin, []string{cmd.mapTitle}
+	case Cmd_RENAME, Cmd_COPY:
+		return CategoryAdmin, []string{cmd.mapTitle, cmd.target}
+	case Cmd_LIST, Cmd_INFO:
+		return CategoryRead, []string{allCaches}
+	case Cmd_CLUSTER:
+		if cmd.sub == Cmd_NODES || cmd.sub == Cmd_INFO {
+			return CategoryRead, []string{allCaches}
+		}
+		return CategoryAdmin, []string{allCaches}
+	case Cmd_CLEAR_ALL, Cmd_REPLICAOF, Cmd_REPLSYNC, Cmd_CLIENT:
+		return CategoryAdmin, []string{allCaches}
+	case Cmd_ACL:
+		if cmd.sub == Cmd_LIST {
+			return CategoryAdmin, []string{allCaches}
+		}
+	}
+	return 0, nil
+}
+
+// authorize checks that user may run cmd under acl. Without an ACL every
+// command is allowed.
+func authorize[K src.Uints, V any](acl *ACL, user *User, cmd *Command[K, V]) error {
+	switch {
+	case acl == nil, cmd.operation == Cmd_AUTH, cmd.operation == Cmd_HELP, cmd.operation == Cmd_BINARY:
+		return nil
+	}
+	if user == nil {
+		return ErrNoAuth
+	}
+	category, titles := commandAccess(cmd)
+	for _, title := range titles {
+		if user.allows(category, title) {
+			continue
+		}
+		if title == allCaches {
+			return fmt.Errorf("%w user %s has no %s access to every cache", ErrNoPerm, user.Name, category)
+		}
+		return fmt.Errorf("%w user %s has no %s access to cache %s", ErrNoPerm, user.Name, category, title)
+	}
+	return nil
+}
+
+// SetACL requires clients to authenticate as one of the users of acl, and
+// limits them to their permissions. It must be called before serving.
+func (s *Server[U, K, V]) SetACL(acl *ACL) {
+	s.acl.Store(acl)
+}
+
+// SetPeerAuth makes replication and gossip log in to other nodes as user,
+// for clusters whose nodes load an ACL. An empty user logs in as nobody.
+func (s *Server[U, K, V]) SetPeerAuth(user, password string) {
+	if user == "" {
+		s.peers.auth.Store(nil)
+		return
+	}
+	s.peers.auth.Store(&peerAuth{user: user, password: password})
+}
@@ -0,0 +1,304 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"lrue/src"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHash hashes password with few iterations to keep tests fast
+func testHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key, _ := pbkdf2.Key(sha256.New, password, salt, 1000, hashKeySize)
+	encode := base64.RawStdEncoding.EncodeToString
+	return fmt.Sprintf("%s$1000$%s$%s", hashScheme, encode(salt), encode(key))
+}
+
+func testACL(t *testing.T) *ACL {
+	t.Helper()
+	acl, err := ParseACL(strings.NewReader(fmt.Sprintf(`
+# name hash categories patterns
+alice %s read,write users*,sessions
+admin %s all *
+node - admin *
+`, testHash("wonderland"), testHash("root"))))
+	if err != nil {
+		t.Fatalf("ParseACL() error = %v", err)
+	}
+	return acl
+}
+
+func TestParseACL(t *testing.T) {
+	for _, file := range []string{
+		"alice",
+		"alice - read",
+		"alice - fly *",
+		"alice md5$abc read *",
+		"alice - read [",
+		"alice - read *\nalice - write *",
+	} {
+		if _, err := ParseACL(strings.NewReader(file)); err == nil {
+			t.Errorf("ParseACL(%q) expected an error", file)
+		}
+	}
+	hash, err := HashPassword("secret")
+	if err != nil || !verifyPassword(hash, "secret") || verifyPassword(hash, "Secret") {
+		t.Errorf("HashPassword() = %q, %v does not verify", hash, err)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	for _, test := range []struct {
+		pattern, title string
+		want           bool
+	}{
+		{"*", "a/b", true},
+		{"tenant/*", "tenant/a/b", true},
+		{"tenant/*", "tenant", false},
+		{"users*", "users/eu", true},
+		{"a?c", "a/c", true},
+		{"a?c", "aé", false},
+		{"a?", "aé", true},
+		{"[a-c]/x", "b/x", true},
+		{"[^a-c]x", "/x", true},
+		{"[^a-c]x", "bx", false},
+		{"a\\*", "a*", true},
+		{"a\\*", "ab", false},
+		{"a*b*c", "a/x/b/y/c", true},
+		{"a*b*c", "a/x/b/y/d", false},
+		{"sessions", "sessions/x", false},
+	} {
+		if got := matchPattern(test.pattern, test.title); got != test.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", test.pattern, test.title, got, test.want)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	defer srv.Close()
+	srv.SetACL(testACL(t))
+	defaultDummy := dummyHash
+	dummyHash = func() string { return testHash("") }
+	defer func() { dummyHash = defaultDummy }()
+	run(t, srv, "CREATE users 8")
+	run(t, srv, "CREATE other 8")
+	sess := srv.newSession()
+	defer sess.close()
+
+	steps := []struct {
+		line string
+		want string
+		err  error
+	}{
+		{"GET users a", "", ErrNoAuth},
+		{"AUTH alice wrong", "", ErrWrongPass},
+		{"AUTH node anything", "", ErrWrongPass},
+		{"AUTH nobody wonderland", "", ErrWrongPass},
+		{"AUTH alice wonderland", "OK", nil},
+		{"ACL WHOAMI", "alice", nil},
+		{"SET users a 1", "OK", nil},
+		{"GET users a", "1", nil},
+		{"GET other a", "", ErrNoPerm},
+		{"CREATE users2 8", "", ErrNoPerm},
+		{"LIST", "", ErrNoPerm},
+		{"ACL LIST", "", ErrNoPerm},
+		{"MULTI", "OK", nil},
+		{"SET other a 1", "", ErrNoPerm},
+		{"EXEC", "", ErrExecAbort},
+		{"AUTH admin root", "OK", nil},
+		{"CREATE users2 8", "OK", nil},
+		{"ACL LIST", "user admin read,write,admin *\nuser alice read,write users*,sessions\nuser node admin *", nil},
+	}
+	for _, step := range steps {
+		got, err := exec(t, sess, step.line)
+		if step.err != nil {
+			if !errors.Is(err, step.err) {
+				t.Errorf("%s: expected %v, got %q, %v", step.line, step.err, got, err)
+			}
+			continue
+		}
+		if err != nil || got != step.want {
+			t.Errorf("%s = %q, %v; want %q", step.line, got, err, step.want)
+		}
+	}
+
+	// A verified certificate subject authenticates as the user of that name
+	peer := srv.newSession()
+	defer peer.close()
+	peer.setIdentity("node")
+	if got, err := exec(t, peer, "CLEAR_ALL"); err != nil || got != "OK" {
+		t.Errorf("Expected the node identity to run CLEAR_ALL, got %q, %v", got, err)
+	}
+}
+
+func TestAuthenticateCached(t *testing.T) {
+	acl := testACL(t)
+	now := time.Now()
+	if _, err := acl.authenticateCached("alice", "nope", now); err != ErrWrongPass {
+		t.Fatalf("Expected a wrong password to fail, got %v", err)
+	}
+	if user, err := acl.authenticateCached("alice", "wonderland", now); err != nil || user.Name != "alice" {
+		t.Fatalf("authenticateCached() = %v, %v", user, err)
+	}
+	// Only the verified credentials are remembered, and only for verifiedTTL
+	for _, test := range []struct {
+		name, password string
+		at             time.Time
+		want           bool
+	}{
+		{"alice", "wonderland", now.Add(verifiedTTL - time.Second), true},
+		{"alice", "wonderland", now.Add(verifiedTTL), false},
+		{"alice", "nope", now, false},
+		{"alicew", "onderland", now, false},
+	} {
+		if got := acl.verified.check(acl.verified.key(test.name, test.password), test.at); got != test.want {
+			t.Errorf("check(%s, %s) at +%v = %v, want %v", test.name, test.password, test.at.Sub(now), got, test.want)
+		}
+	}
+	// A reloaded ACL forgets them
+	if testACL(t).verified.check(acl.verified.key("alice", "wonderland"), now) {
+		t.Error("Expected a new ACL to start without verified credentials")
+	}
+}
+
+func TestHTTPACL(t *testing.T) {
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	defer srv.Close()
+	srv.SetACL(testACL(t))
+	run(t, srv, "CREATE users 8")
+	server := httptest.NewServer(NewHTTPHandler(srv))
+	defer server.Close()
+
+	for _, step := range []struct {
+		method, path, user, password string
+		status                       int
+	}{
+		{"GET", "/caches", "", "", http.StatusUnauthorized},
+		{"GET", "/caches", "alice", "nope", http.StatusUnauthorized},
+		{"GET", "/caches", "alice", "wonderland", http.StatusForbidden},
+		{"PUT", "/caches/users/keys/a", "alice", "wonderland", http.StatusNoContent},
+		{"DELETE", "/caches/users", "alice", "wonderland", http.StatusForbidden},
+		{"GET", "/caches", "admin", "root", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(step.method, server.URL+step.path, strings.NewReader("v"))
+		if step.user != "" {
+			req.SetBasicAuth(step.user, step.password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", step.method, step.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != step.status {
+			t.Errorf("%s %s as %q: status %d, want %d", step.method, step.path, step.user, resp.StatusCode, step.status)
+		}
+	}
+}
+
+func TestReadLimitBeforeAuth(t *testing.T) {
+	srv, addr := serveWith(t, func(srv *testServer) {
+		srv.SetACL(testACL(t))
+		srv.SetMaxCommandSize(64)
+	})
+	run(t, srv, "CREATE users 8")
+	value := strings.Repeat("x", 100)
+
+	// Binary frames hold values to the command limit until AUTH
+	conn, reader, _ := dialLine(t, addr)
+	conn.Write([]byte("BINARY\r\n"))
+	reader.ReadString('\n')
+	var out bytes.Buffer
+	for i, req := range []Frame{
+		{Op: OpSet, Cache: []byte("users"), Key: []byte("a"), Value: []byte(value)},
+		{Op: OpText, Value: []byte("AUTH alice wonderland")},
+		{Op: OpSet, Cache: []byte("users"), Key: []byte("a"), Value: []byte(value)},
+	} {
+		req.RequestID = uint32(i)
+		WriteFrame(&out, req)
+	}
+	conn.Write(out.Bytes())
+	for i, want := range []BinaryStatus{StatusError, StatusOK, StatusOK} {
+		if resp, err := ReadFrame(reader); err != nil || resp.Status != want {
+			t.Errorf("Frame %d = %+v, %v, want status %d", i, resp, err, want)
+		}
+	}
+
+	// RESP refuses arguments past the limit before AUTH
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go ServeRESP(listener, srv)
+	dialRESP := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	conn, reader = dialRESP()
+	conn.Write([]byte("*3\r\n$3\r\nSET\r\n$7\r\nusers:a\r\n$100\r\n"))
+	if line, _ := reader.ReadString('\n'); line != "-ERR Protocol error: invalid bulk length\r\n" {
+		t.Errorf("Expected an unauthenticated large argument to be refused, got %q", line)
+	}
+	conn, reader = dialRESP()
+	conn.Write([]byte(respArray("AUTH", "alice", "wonderland") + respArray("SET", "users:a", value)))
+	for _, want := range []string{"+OK\r\n", "+OK\r\n"} {
+		if line, _ := reader.ReadString('\n'); line != want {
+			t.Errorf("Expected %q after AUTH, got %q", want, line)
+		}
+	}
+}
+
+func TestPeerAuth(t *testing.T) {
+	primary, addr := startServer(t)
+	replica, replicaAddr := startServer(t)
+	other, _ := startServer(t)
+	for _, srv := range []*testServer{primary, replica, other} {
+		srv.SetACL(testACL(t))
+		srv.gossip.interval = 20 * time.Millisecond
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	run(t, primary, "CREATE users 8")
+	run(t, primary, "SET users alice 1")
+
+	// Without credentials the primary refuses to sync
+	run(t, replica, "REPLICAOF "+host+" "+port)
+	waitFor(t, "the replica to be refused", func() bool {
+		info, _ := run(t, replica, "INFO replication")
+		return strings.Contains(info, "last_error:") && strings.Contains(info, "NOAUTH")
+	})
+
+	for _, srv := range []*testServer{primary, replica, other} {
+		srv.SetPeerAuth("admin", "root")
+	}
+	waitFor(t, "replica to sync", inSync(primary, replica))
+	run(t, replica, "CLUSTER MEET "+host+" "+port)
+	run(t, other, "CLUSTER MEET "+host+" "+port)
+	waitFor(t, "every node to know the others", func() bool {
+		for _, srv := range []*testServer{primary, replica, other} {
+			if info, _ := run(t, srv, "CLUSTER INFO"); !strings.Contains(info, "cluster_known_nodes:3") {
+				return false
+			}
+		}
+		return true
+	})
+	if flags := nodeFlags(t, other, replicaAddr); flags != "replica" {
+		t.Errorf("Expected the replica to be gossiped as a replica, got %q", flags)
+	}
+}
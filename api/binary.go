@@ -0,0 +1,227 @@
+package api
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"lrue/src"
+	"net"
+)
+
+// Binary frames carry keys and values as raw bytes, so values may hold spaces,
+// newlines or any other byte. A text connection switches to frames with the
+// BINARY command; every frame starts with a fixed header:
+//
+//	magic      uint8   0xB1 for requests, 0xB2 for responses
+//	opcode     uint8
+//	status     uint8   0 in requests
+//	reserved   uint8
+//	cache len  uint16
+//	key len    uint16
+//	value len  uint32
+//	request id uint32
+//
+// followed by the cache name, the key and the value. Integers are big endian.
+// Responses echo the opcode and request ID and carry the result as the value.
+const (
+	binaryHeaderSize = 16
+	binaryMaxValue   = 512 << 20
+	binaryVersion    = 1
+
+	magicRequest  = 0xB1
+	magicResponse = 0xB2
+)
+
+// BinaryOp is the operation of a binary frame
+type BinaryOp uint8
+
+const (
+	// OpNoop does nothing and answers StatusOK, to check the connection
+	OpNoop BinaryOp = iota
+	// OpGet returns the value of key in cache
+	OpGet
+	// OpSet stores value under key in cache
+	OpSet
+	// OpDel removes key from cache
+	OpDel
+	// OpText runs the text command held in value and returns its reply
+	OpText
+)
+
+// BinaryStatus is the outcome reported by a response frame
+type BinaryStatus uint8
+
+const (
+	StatusOK BinaryStatus = iota
+	StatusNotFound
+	// StatusError responses carry the error message as their value
+	StatusError
+)
+
+var errBinaryFrame = errors.New("invalid binary frame")
+
+// Frame is one binary request or response
+type Frame struct {
+	Response  bool
+	Op        BinaryOp
+	Status    BinaryStatus
+	RequestID uint32
+	Cache     []byte
+	Key       []byte
+	Value     []byte
+}
+
+// WriteFrame encodes f to w
+func WriteFrame(w io.Writer, f Frame) error {
+	if len(f.Cache) > 0xFFFF || len(f.Key) > 0xFFFF || len(f.Value) > binaryMaxValue {
+		return fmt.Errorf("%w: field too long", errBinaryFrame)
+	}
+	header := make([]byte, binaryHeaderSize, binaryHeaderSize+len(f.Cache)+len(f.Key)+len(f.Value))
+	header[0] = magicRequest
+	if f.Response {
+		header[0] = magicResponse
+	}
+	header[1] = byte(f.Op)
+	header[2] = byte(f.Status)
+	binary.BigEndian.PutUint16(header[4:], uint16(len(f.Cache)))
+	binary.BigEndian.PutUint16(header[6:], uint16(len(f.Key)))
+	binary.BigEndian.PutUint32(header[8:], uint32(len(f.Value)))
+	binary.BigEndian.PutUint32(header[12:], f.RequestID)
+	frame := append(append(append(header, f.Cache...), f.Key...), f.Value...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame decodes the next frame from r. A frame whose value is too large
+// is skipped and reported with its header filled in, so the caller can answer
+// it and carry on with the next one.
+func ReadFrame(r io.Reader) (Frame, error) {
+	return readFrame(r, binaryMaxValue)
+}
+
+// readFrame runs ReadFrame with values limited to maxValue bytes
+func readFrame(r io.Reader, maxValue int64) (Frame, error) {
+	var header [binaryHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, err
+	}
+	if header[0] != magicRequest && header[0] != magicResponse {
+		return Frame{}, fmt.Errorf("%w: bad magic 0x%02X", errBinaryFrame, header[0])
+	}
+	f := Frame{
+		Response:  header[0] == magicResponse,
+		Op:        BinaryOp(header[1]),
+		Status:    BinaryStatus(header[2]),
+		RequestID: binary.BigEndian.Uint32(header[12:]),
+	}
+	cacheLen := int(binary.BigEndian.Uint16(header[4:]))
+	keyLen := int(binary.BigEndian.Uint16(header[6:]))
+	valueLen := int64(binary.BigEndian.Uint32(header[8:]))
+	if valueLen > maxValue {
+		if _, err := io.CopyN(io.Discard, r, int64(cacheLen+keyLen)+valueLen); err != nil {
+			return Frame{}, err
+		}
+		return f, fmt.Errorf("%w: value of %d bytes is too large", src.ErrValueTooLarge, valueLen)
+	}
+	body, err := readFull(r, cacheLen+keyLen+int(valueLen))
+	if err != nil {
+		return Frame{}, err
+	}
+	f.Cache = body[:cacheLen:cacheLen]
+	f.Key = body[cacheLen : cacheLen+keyLen : cacheLen+keyLen]
+	f.Value = body[cacheLen+keyLen:]
+	return f, nil
+}
+
+// serveBinary answers binary frames on conn after a client sent BINARY
+func serveBinary[U, K src.Uints, V ~[]byte](conn net.Conn, srv *Server[U, K, V], sess *session[U, K, V]) {
+	if _, err := fmt.Fprintf(conn, "OK BINARY %d\r\n", binaryVersion); err != nil {
+		return
+	}
+	reader := bufio.NewReaderSize(conn, 64<<10)
+	writer := bufio.NewWriterSize(conn, 64<<10)
+	for {
+		// Before AUTH values are held to the command line limit
+		maxValue := int64(binaryMaxValue)
+		if limit := sess.readLimit(); limit > 0 {
+			maxValue = int64(limit)
+		}
+		req, err := readFrame(reader, maxValue)
+		if err != nil && !errors.Is(err, src.ErrValueTooLarge) {
+			if errors.Is(err, errBinaryFrame) {
+				WriteFrame(writer, Frame{Response: true, Status: StatusError, Value: []byte(err.Error())})
+				writer.Flush()
+			}
+			return
+		}
+		resp := Frame{Response: true, Op: req.Op, RequestID: req.RequestID}
+		var result string
+		if err == nil {
+			result, err = executeFrame(sess, req)
+		}
+		switch {
+		case errors.Is(err, src.ErrKeyNotFound):
+			resp.Status = StatusNotFound
+		case err != nil:
+			resp.Status, result = StatusError, err.Error()
+		}
+		resp.Value = []byte(result)
+		if err := WriteFrame(writer, resp); err != nil {
+			return
+		}
+		// Pipelined frames are answered together once the input is drained
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// executeFrame runs the command of one request frame for the session
+func executeFrame[U, K src.Uints, V ~[]byte](sess *session[U, K, V], req Frame) (string, error) {
+	if req.Op == OpNoop {
+		return "", nil
+	}
+	if req.Op == OpText {
+		cmd, err := Parse[K, V](req.Value)
+		if err != nil {
+			return "", err
+		}
+		switch cmd.operation {
+		case Cmd_REPLSYNC, Cmd_SUBSCRIBE, Cmd_UNSUBSCRIBE, Cmd_BINARY:
+			return "", fmt.Errorf("%s is not supported in binary mode", cmd.operation)
+		}
+		if cmd.operation == Cmd_CLUSTER && cmd.sub == Cmd_GOSSIP {
+			return "", fmt.Errorf("%s %s is not supported in binary mode", cmd.operation, cmd.sub)
+		}
+		return sess.Execute(cmd)
+	}
+
+	var op Cmd
+	switch req.Op {
+	case OpGet:
+		op = Cmd_GET
+	case OpSet:
+		op = Cmd_SET
+	case OpDel:
+		op = Cmd_DEL
+	default:
+		return "", fmt.Errorf("unknown opcode: %d", req.Op)
+	}
+	if len(req.Cache) == 0 || len(req.Key) == 0 {
+		return "", fmt.Errorf("%s needs a cache name and a key", op)
+	}
+	cmd := &Command[K, V]{
+		operation: op,
+		mapTitle:  string(req.Cache),
+		key:       Hash[K](req.Key),
+		keySize:   len(req.Key),
+	}
+	if op == Cmd_SET {
+		cmd.value = req.Value
+	}
+	return sess.Execute(cmd)
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBinary(t *testing.T) {
+	srv, addr := startServer(t)
+	run(t, srv, "CREATE users 10")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	expect := func(want string) {
+		t.Helper()
+		line, err := reader.ReadString('\n')
+		if err != nil || line != want+"\r\n" {
+			t.Fatalf("Expected %q, got %q, %v", want, line, err)
+		}
+	}
+	expect("Connected to lru engine")
+	conn.Write([]byte("BINARY\r\n"))
+	expect("OK BINARY 1")
+
+	value := []byte("two  spaces\r\nand \x00 bytes")
+	requests := []Frame{
+		{Op: OpSet, RequestID: 1, Cache: []byte("users"), Key: []byte("a key\n"), Value: value},
+		{Op: OpGet, RequestID: 2, Cache: []byte("users"), Key: []byte("a key\n")},
+		{Op: OpGet, RequestID: 3, Cache: []byte("users"), Key: []byte("missing")},
+		{Op: OpText, RequestID: 4, Value: []byte("LIST")},
+		{Op: OpDel, RequestID: 5, Cache: []byte("users"), Key: []byte("a key\n")},
+		{Op: OpGet, RequestID: 6, Cache: []byte("nope"), Key: []byte("a")},
+		{Op: OpNoop, RequestID: 7},
+	}
+	// Frames are pipelined and answered in order
+	var out bytes.Buffer
+	for _, req := range requests {
+		if err := WriteFrame(&out, req); err != nil {
+			t.Fatalf("WriteFrame() error = %v", err)
+		}
+	}
+	conn.Write(out.Bytes())
+
+	want := []struct {
+		status BinaryStatus
+		value  string
+	}{
+		{StatusOK, "OK"},
+		{StatusOK, string(value)},
+		{StatusNotFound, ""},
+		{StatusOK, ""},
+		{StatusOK, "OK"},
+		{StatusError, ""},
+		{StatusOK, ""},
+	}
+	for i, w := range want {
+		resp, err := ReadFrame(reader)
+		if err != nil {
+			t.Fatalf("ReadFrame() error = %v", err)
+		}
+		if !resp.Response || resp.RequestID != requests[i].RequestID || resp.Op != requests[i].Op || resp.Status != w.status {
+			t.Errorf("Request %d: got %+v", requests[i].RequestID, resp)
+		}
+		if w.value != "" && string(resp.Value) != w.value {
+			t.Errorf("Request %d: expected value %q, got %q", requests[i].RequestID, w.value, resp.Value)
+		}
+	}
+}
@@ -8,9 +8,13 @@ import (
 	"os"
 )
 
-func Cli[U, K src.Uints, V ~[]byte](ctx context.Context, mgr *src.CacheManager[U, K, V]) {
+func Cli[U, K src.Uints, V ~[]byte](ctx context.Context, srv *Server[U, K, V]) {
 	scanner := bufio.NewScanner(os.Stdin)
 	fmt.Println("LRU Engine CLI")
+	sess := srv.newSession()
+	sess.user = consoleUser
+	sess.limiter = nil
+	defer sess.close()
 	for {
 		select {
 		case <-ctx.Done():
@@ -26,7 +30,7 @@ func Cli[U, K src.Uints, V ~[]byte](ctx context.Context, mgr *src.CacheManager[U
 				fmt.Println("Error:", err)
 				continue
 			}
-			result, err := Execute(mgr, cmd)
+			result, err := sess.Execute(cmd)
 			if err != nil {
 				fmt.Println("Error:", err)
 			} else {
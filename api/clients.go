@@ -0,0 +1,349 @@
+package api
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"lrue/src"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaxConnections is the number of clients served at once unless the
+// server is given another limit with SetMaxConnections
+const defaultMaxConnections = 256
+
+// defaultKeepAlive is the TCP keepalive period of accepted connections
+const defaultKeepAlive = 15 * time.Second
+
+// rejectTimeout bounds writing the refusal to a connection that is not served
+const rejectTimeout = time.Second
+
+var (
+	// errMaxClients is answered to connections above the connection limit
+	errMaxClients = errors.New("max clients reached")
+	errNoClient   = errors.New("no such client")
+	// errIdleTimeout and errReadTimeout are answered to clients dropped by
+	// the idle and read timeouts
+	errIdleTimeout = errors.New("idle timeout")
+	errReadTimeout = errors.New("read timeout")
+)
+
+// tcpClient is one connection accepted by Serve, ServeRESP or ServeMemcached
+type tcpClient struct {
+	id      uint64
+	conn    net.Conn
+	created time.Time
+	// streaming is set once the connection left text commands for a stream
+	// such as SUBSCRIBE or replication, which has no command to finish
+	streaming atomic.Bool
+	lastUsed  atomic.Int64 // unix nanoseconds of the last command
+	lastCmd   atomic.Pointer[Cmd]
+	user      atomic.Pointer[User]
+}
+
+// observe records the command the client is running
+func (c *tcpClient) observe(op Cmd) {
+	c.lastUsed.Store(time.Now().UnixNano())
+	c.lastCmd.Store(&op)
+}
+
+// describe renders the client's CLIENT LIST line
+func (c *tcpClient) describe(now time.Time) string {
+	name, cmd := "default", "NULL"
+	if user := c.user.Load(); user != nil {
+		name = user.Name
+	}
+	if op := c.lastCmd.Load(); op != nil {
+		cmd = strings.ToLower(string(*op))
+	}
+	idle := now.Sub(time.Unix(0, c.lastUsed.Load()))
+	return fmt.Sprintf("id=%d addr=%s user=%s age=%d idle=%d cmd=%s",
+		c.id, c.conn.RemoteAddr(), name, int(now.Sub(c.created).Seconds()), int(idle.Seconds()), cmd)
+}
+
+// tcpClients tracks the listeners and connections of every protocol,
+// limits how many connections they serve at once, and lets Shutdown stop
+// accepting and drain the connections. Its settings must be changed before
+// serving.
+type tcpClients struct {
+	mutex     sync.Mutex
+	draining  atomic.Bool
+	listeners map[net.Listener]struct{}
+	// httpServers serve the REST API on listeners of ServeHTTP
+	httpServers map[*http.Server]struct{}
+	conns       map[uint64]*tcpClient
+	lastID      uint64
+	active      sync.WaitGroup
+	// slots holds one token per served connection
+	slots       chan struct{}
+	readTimeout time.Duration
+	idleTimeout time.Duration
+	keepAlive   time.Duration
+}
+
+func newTCPClients() *tcpClients {
+	return &tcpClients{
+		listeners:   make(map[net.Listener]struct{}),
+		httpServers: make(map[*http.Server]struct{}),
+		conns:       make(map[uint64]*tcpClient),
+		slots:       make(chan struct{}, defaultMaxConnections),
+		keepAlive:   defaultKeepAlive,
+	}
+}
+
+// listen registers a listener, reporting false once the server is draining
+func (c *tcpClients) listen(listener net.Listener) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.draining.Load() {
+		return false
+	}
+	c.listeners[listener] = struct{}{}
+	return true
+}
+
+func (c *tcpClients) unlisten(listener net.Listener) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.listeners, listener)
+}
+
+// add registers an accepted connection, or returns why it is not served
+func (c *tcpClients) add(conn net.Conn) (*tcpClient, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.draining.Load() {
+		return nil, ErrServerClosed
+	}
+	if !c.take() {
+		return nil, errMaxClients
+	}
+	c.lastID++
+	now := time.Now()
+	client := &tcpClient{id: c.lastID, conn: conn, created: now}
+	client.lastUsed.Store(now.UnixNano())
+	c.conns[client.id] = client
+	c.active.Add(1)
+	return client, nil
+}
+
+func (c *tcpClients) remove(client *tcpClient) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.conns[client.id]; ok {
+		delete(c.conns, client.id)
+		c.release()
+		c.active.Done()
+	}
+}
+
+// take reserves a connection slot, reporting false when none is left
+func (c *tcpClients) take() bool {
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *tcpClients) release() {
+	<-c.slots
+}
+
+// serveHTTP registers an HTTP server for Shutdown, reporting false once the
+// server is draining
+func (c *tcpClients) serveHTTP(server *http.Server) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.draining.Load() {
+		return false
+	}
+	c.httpServers[server] = struct{}{}
+	return true
+}
+
+func (c *tcpClients) unserveHTTP(server *http.Server) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.httpServers, server)
+}
+
+// stream marks client as streaming and reports whether it may go on; a
+// streaming connection is closed as soon as the server drains
+func (c *tcpClients) stream(client *tcpClient) bool {
+	client.streaming.Store(true)
+	return !c.draining.Load()
+}
+
+// list renders CLIENT LIST, one line per connection in the order they came
+func (c *tcpClients) list() string {
+	c.mutex.Lock()
+	clients := make([]*tcpClient, 0, len(c.conns))
+	for _, client := range c.conns {
+		clients = append(clients, client)
+	}
+	c.mutex.Unlock()
+	if len(clients) == 0 {
+		return "No clients"
+	}
+	slices.SortFunc(clients, func(a, b *tcpClient) int { return cmp.Compare(a.id, b.id) })
+	now := time.Now()
+	lines := make([]string, len(clients))
+	for i, client := range clients {
+		lines[i] = client.describe(now)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// kill closes the connection with the given id or remote address
+func (c *tcpClients) kill(target string) error {
+	id, _ := strconv.ParseUint(target, 10, 64)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, client := range c.conns {
+		if client.id == id || client.conn.RemoteAddr().String() == target {
+			client.conn.Close()
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", errNoClient, target)
+}
+
+// serve accepts connections on listener until it is closed or the server
+// shuts down, and runs handle for each one that is served; handle must remove
+// its client when done. Refused connections get refusal, a format for the
+// error in the protocol of the listener.
+func (c *tcpClients) serve(listener net.Listener, refusal string, handle func(client *tcpClient)) {
+	if !c.listen(listener) {
+		listener.Close()
+		return
+	}
+	defer c.unlisten(listener)
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			src.LogError(err)
+			continue
+		}
+		if client := c.accept(conn, refusal); client != nil {
+			go handle(client)
+		}
+	}
+}
+
+// accept sets up a connection returned by Accept and registers it. A
+// connection that is not served is told why, with refusal, and closed.
+func (c *tcpClients) accept(conn net.Conn, refusal string) *tcpClient {
+	raw := conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		raw = tlsConn.NetConn()
+	}
+	if tcpConn, ok := raw.(*net.TCPConn); ok {
+		tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{Enable: c.keepAlive > 0, Idle: c.keepAlive, Interval: c.keepAlive})
+	}
+	client, err := c.add(conn)
+	if err != nil {
+		go reject(conn, fmt.Sprintf(refusal, err))
+		return nil
+	}
+	return client
+}
+
+// reject writes message to a connection that is not served and closes it. It
+// is meant to run aside, so that a slow client, or a TLS handshake, does not
+// hold up the accept loop.
+func reject(conn net.Conn, message string) {
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	io.WriteString(conn, message)
+	conn.Close()
+}
+
+// next waits until client starts its next command on reader, within the idle
+// timeout, and gives the rest of it the read timeout. It returns
+// ErrServerClosed once the server drains and errIdleTimeout when the client
+// stays idle too long, which the client is told, or the error that ended the
+// connection. It serves the RESP and memcached connections; a read of the
+// command failing afterwards is reported by readFailed.
+func (c *tcpClients) next(client *tcpClient, reader *bufio.Reader) error {
+	timeouts := c.readTimeout > 0 || c.idleTimeout > 0
+	for {
+		if timeouts {
+			client.conn.SetReadDeadline(readDeadline(c.idleTimeout))
+		}
+		// Shutdown interrupts the read, so it is checked after setting the
+		// deadline; replies to earlier commands still go out
+		if c.draining.Load() {
+			return ErrServerClosed
+		}
+		_, err := reader.Peek(1)
+		if err == nil {
+			if timeouts {
+				client.conn.SetReadDeadline(readDeadline(c.readTimeout))
+			}
+			return nil
+		}
+		var netErr net.Error
+		switch {
+		case c.draining.Load():
+			continue
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return errIdleTimeout
+		}
+		return err
+	}
+}
+
+// readFailed tells why reading a command started after next failed: it
+// returns errReadTimeout when the client was too slow, which it is told,
+// nil when the server drains, for next to report, or err.
+func (c *tcpClients) readFailed(err error) error {
+	var netErr net.Error
+	switch {
+	case c.draining.Load():
+		return nil
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errReadTimeout
+	}
+	return err
+}
+
+// readDeadline returns the read deadline for a timeout, none when it is zero
+func readDeadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// SetMaxConnections sets how many clients are served at once; others are
+// answered with an error and disconnected
+func (s *Server[U, K, V]) SetMaxConnections(n int) {
+	s.clients.slots = make(chan struct{}, n)
+}
+
+// SetTimeouts sets how long a client may take to send a command once it
+// started (read) and how long it may stay without sending one (idle). Zero
+// disables a timeout.
+func (s *Server[U, K, V]) SetTimeouts(read, idle time.Duration) {
+	s.clients.readTimeout, s.clients.idleTimeout = read, idle
+}
+
+// SetKeepAlive sets the TCP keepalive period of accepted connections; zero
+// disables keepalive probes
+func (s *Server[U, K, V]) SetKeepAlive(period time.Duration) {
+	s.clients.keepAlive = period
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"lrue/src"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveWith serves a fresh server after configure has set it up
+func serveWith(t *testing.T, configure func(srv *testServer)) (*testServer, string) {
+	t.Helper()
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	configure(srv)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go Serve(listener, 256, srv)
+	t.Cleanup(func() {
+		listener.Close()
+		srv.Close()
+	})
+	return srv, listener.Addr().String()
+}
+
+// dialLine connects to addr and returns the connection with its first line
+func dialLine(t *testing.T, addr string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	line, _ := reader.ReadString('\n')
+	return conn, reader, line
+}
+
+func TestMaxConnections(t *testing.T) {
+	srv, addr := serveWith(t, func(srv *testServer) { srv.SetMaxConnections(2) })
+	first, _, _ := dialLine(t, addr)
+	dialLine(t, addr)
+	if _, _, line := dialLine(t, addr); line != "ERR max clients reached\r\n" {
+		t.Errorf("Expected the third client to be refused, got %q", line)
+	}
+
+	first.Close()
+	waitFor(t, "the first client to leave", func() bool { return len(srv.clients.slots) == 1 })
+	if _, _, line := dialLine(t, addr); line != "Connected to lru engine\r\n" {
+		t.Errorf("Expected a freed slot to be reused, got %q", line)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	_, addr := serveWith(t, func(srv *testServer) { srv.SetTimeouts(100*time.Millisecond, 200*time.Millisecond) })
+
+	_, reader, _ := dialLine(t, addr)
+	start := time.Now()
+	if line, _ := reader.ReadString('\n'); line != "ERR idle timeout\r\n" {
+		t.Errorf("Expected an idle timeout, got %q", line)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Idle timeout after %v, want about 200ms", elapsed)
+	}
+
+	conn, reader, _ := dialLine(t, addr)
+	conn.Write([]byte("LIST\r\nSET users"))
+	if line, _ := reader.ReadString('\n'); line != "No caches\r\n" {
+		t.Errorf("LIST = %q", line)
+	}
+	if line, _ := reader.ReadString('\n'); line != "ERR read timeout\r\n" {
+		t.Errorf("Expected a read timeout for an unfinished command, got %q", line)
+	}
+}
+
+func TestTimeoutsRESPMemcached(t *testing.T) {
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	srv.SetTimeouts(100*time.Millisecond, 200*time.Millisecond)
+	t.Cleanup(func() { srv.Close() })
+	run(t, srv, "CREATE mc 8")
+	serve := func(accept func(net.Listener)) string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen() error = %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go accept(listener)
+		return listener.Addr().String()
+	}
+	dial := func(addr string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	expect := func(reader *bufio.Reader, want ...string) {
+		t.Helper()
+		for _, line := range want {
+			if got, _ := reader.ReadString('\n'); got != line+"\r\n" {
+				t.Errorf("Expected %q, got %q", line, got)
+			}
+		}
+	}
+	respAddr := serve(func(l net.Listener) { ServeRESP(l, srv) })
+	mcAddr := serve(func(l net.Listener) { ServeMemcached(l, srv, "mc") })
+
+	_, reader := dial(respAddr)
+	expect(reader, "-ERR idle timeout")
+	conn, reader := dial(respAddr)
+	conn.Write([]byte(respArray("PING") + "*2\r\n$3\r\nGET"))
+	expect(reader, "+PONG", "-ERR read timeout")
+
+	_, reader = dial(mcAddr)
+	expect(reader, "SERVER_ERROR idle timeout")
+	conn, reader = dial(mcAddr)
+	conn.Write([]byte("version\r\nset a 0 0 5\r\nab"))
+	expect(reader, "VERSION "+serverVersion, "SERVER_ERROR read timeout")
+}
+
+func TestClientCommands(t *testing.T) {
+	srv, addr := startServer(t)
+	first, firstReader, _ := dialLine(t, addr)
+	second, secondReader, _ := dialLine(t, addr)
+	second.Write([]byte("LIST\r\n"))
+	secondReader.ReadString('\n')
+
+	first.Write([]byte("CLIENT LIST\r\n"))
+	var lines []string
+	for len(lines) < 2 {
+		line, err := firstReader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("CLIENT LIST: %v", err)
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+	want := []string{
+		fmt.Sprintf("id=1 addr=%s user=default age=0 idle=0 cmd=client", first.LocalAddr()),
+		fmt.Sprintf("id=2 addr=%s user=default age=0 idle=0 cmd=list", second.LocalAddr()),
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("CLIENT LIST line %d = %q, want %q", i, lines[i], want[i])
+		}
+	}
+
+	if got, err := run(t, srv, "CLIENT KILL 2"); err != nil || got != "OK" {
+		t.Fatalf("CLIENT KILL = %q, %v", got, err)
+	}
+	if _, err := secondReader.ReadString('\n'); err == nil {
+		t.Errorf("Expected the killed client to be disconnected")
+	}
+	waitFor(t, "the killed client to leave", func() bool { return len(srv.clients.slots) == 1 })
+	if _, err := run(t, srv, "CLIENT KILL "+second.LocalAddr().String()); err == nil {
+		t.Errorf("Expected an error for a client that is gone")
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"lrue/src"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// dumpCache renders a cache for DUMP: a "<capacity> <options>" header followed
+// by one "<hashed_key> <expires_at> <tags|-> <base64_value|-> [flags]" line per
+// entry, least recently used first, so replaying the lines with RESTORE keeps
+// the order. Flags are only written when they are set
+func dumpCache[U, K src.Uints, V ~[]byte](cache *src.LRUMap[U, K, V]) string {
+	snap := cache.Snapshot()
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%d %s", snap.Capacity, snap.Options)
+	for _, entry := range snap.Entries {
+		tags, value := "-", "-"
+		if len(entry.Tags) > 0 {
+			tags = strings.Join(entry.Tags, ",")
+		}
+		if len(entry.Value) > 0 {
+			value = base64.StdEncoding.EncodeToString(entry.Value)
+		}
+		fmt.Fprintf(&builder, "\n%d %d %s %s", entry.Key, entry.ExpiresAt, tags, value)
+		if entry.Flags != 0 {
+			fmt.Fprintf(&builder, " %d", entry.Flags)
+		}
+	}
+	return builder.String()
+}
+
+// parseRestore fills a RESTORE command from the fields of a DUMP entry line
+func parseRestore[K src.Uints, V any](cmd *Command[K, V], fields [][]byte) error {
+	key, err := parseHashedKey[K](fields[0])
+	if err != nil {
+		return err
+	}
+	cmd.key = key
+	if cmd.expiresAt, err = strconv.ParseInt(string(fields[1]), 10, 64); err != nil {
+		return fmt.Errorf("invalid expiry: %s", fields[1])
+	}
+	if tags := string(fields[2]); tags != "-" {
+		cmd.tags = strings.Split(tags, ",")
+	}
+	cmd.value = []byte{}
+	if value := strings.TrimSpace(string(fields[3])); value != "-" {
+		if cmd.value, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return fmt.Errorf("invalid base64 value: %w", err)
+		}
+	}
+	if len(fields) > 4 {
+		flags, err := strconv.ParseUint(strings.TrimSpace(string(fields[4])), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid flags: %s", fields[4])
+		}
+		cmd.flags = uint32(flags)
+	}
+	return nil
+}
+
+// parseHashedKey reads a key in the hashed form reported by DUMP
+func parseHashedKey[K src.Uints](field []byte) (K, error) {
+	key, err := strconv.ParseUint(strings.TrimSpace(string(field)), 10, int(unsafe.Sizeof(K(0))*8))
+	if err != nil {
+		return 0, fmt.Errorf("invalid hashed key: %s", field)
+	}
+	return K(key), nil
+}
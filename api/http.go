@@ -0,0 +1,335 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"lrue/src"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpMaxBody limits the size of a value stored with PUT
+const httpMaxBody = 64 << 20
+
+// httpAPI serves the REST API: caches are resources under /caches and their
+// entries under /caches/{name}/keys/{key}. Values are raw request and
+// response bodies; everything else is JSON.
+type httpAPI[U, K src.Uints, V ~[]byte] struct {
+	srv *Server[U, K, V]
+}
+
+// createRequest is the body of POST /caches
+type createRequest struct {
+	Name     string         `json:"name"`
+	Capacity uint64         `json:"capacity"`
+	Options  map[string]any `json:"options"`
+}
+
+// cacheResponse describes one cache in GET /caches
+type cacheResponse struct {
+	Name     string            `json:"name"`
+	Capacity uint64            `json:"capacity"`
+	Length   uint64            `json:"length"`
+	Bytes    uint64            `json:"bytes"`
+	Options  map[string]string `json:"options"`
+}
+
+// NewHTTPHandler returns the REST API for srv
+func NewHTTPHandler[U, K src.Uints, V ~[]byte](srv *Server[U, K, V]) http.Handler {
+	h := &httpAPI[U, K, V]{srv: srv}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /caches", h.listCaches)
+	mux.HandleFunc("POST /caches", h.createCache)
+	mux.HandleFunc("DELETE /caches/{name}", h.destroyCache)
+	mux.HandleFunc("GET /caches/{name}/keys/{key}", h.getKey)
+	mux.HandleFunc("PUT /caches/{name}/keys/{key}", h.putKey)
+	mux.HandleFunc("DELETE /caches/{name}/keys/{key}", h.deleteKey)
+	return h.authenticate(mux)
+}
+
+type userKey struct{}
+
+// authenticate requires HTTP basic authentication as an ACL user once the
+// server has users configured, unless a verified TLS client certificate names
+// one
+func (h *httpAPI[U, K, V]) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acl := h.srv.acl.Load()
+		if acl == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.TLS != nil {
+			if user := acl.lookup(stateIdentity(r.TLS)); user != nil {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+				return
+			}
+		}
+		name, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lrue"`)
+			writeError(w, ErrNoAuth)
+			return
+		}
+		user, err := acl.authenticateCached(name, password, time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lrue"`)
+			writeError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// authorize reports whether the authenticated user may run cmd and is within
+// its rate limits, answering the request when it may not
+func (h *httpAPI[U, K, V]) authorize(w http.ResponseWriter, r *http.Request, cmd *Command[K, V]) bool {
+	user, _ := r.Context().Value(userKey{}).(*User)
+	err := authorize(h.srv.acl.Load(), user, cmd)
+	if err == nil {
+		err = h.srv.limits.allow(nil, user, commandCost(h.srv.limits, h.srv.mgr, cmd))
+	}
+	if err != nil {
+		var limited *rateLimitError
+		if errors.As(err, &limited) && limited.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.retryAfter.Seconds()))))
+		}
+		writeError(w, err)
+		return false
+	}
+	return true
+}
+
+// httpStatus maps an error to the status code reported for it
+func httpStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, src.ErrCacheNotFound), errors.Is(err, src.ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, src.ErrCacheExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrNoAuth), errors.Is(err, ErrWrongPass):
+		return http.StatusUnauthorized
+	case errors.Is(err, src.ErrReadOnly), errors.Is(err, ErrReplicaReadOnly), errors.Is(err, ErrNoPerm):
+		return http.StatusForbidden
+	case errors.Is(err, src.ErrKeyTooLarge), errors.Is(err, src.ErrValueTooLarge), errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, src.ErrMemoryLimit):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusBadRequest
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, httpStatus(err), map[string]string{"error": err.Error()})
+}
+
+func (h *httpAPI[U, K, V]) listCaches(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r, &Command[K, V]{operation: Cmd_LIST}) {
+		return
+	}
+	stats := h.srv.mgr.Stats()
+	caches := make([]cacheResponse, len(stats))
+	for i, s := range stats {
+		caches[i] = cacheResponse{
+			Name:     s.Title,
+			Capacity: s.Capacity,
+			Length:   s.Length,
+			Bytes:    s.Bytes,
+			Options:  s.Options.Values(),
+		}
+	}
+	writeJSON(w, http.StatusOK, caches)
+}
+
+func (h *httpAPI[U, K, V]) createCache(w http.ResponseWriter, r *http.Request) {
+	var req createRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	// Numbers keep their digits; as float64 large ones would print as 1e+06
+	decoder.UseNumber()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if req.Name == "" || strings.ContainsAny(req.Name, " \r\n") {
+		writeError(w, fmt.Errorf("name must be a non-empty word"))
+		return
+	}
+	cmd := &Command[K, V]{operation: Cmd_CREATE, mapTitle: req.Name, value: []byte(strconv.FormatUint(req.Capacity, 10))}
+	for name, value := range req.Options {
+		if err := cmd.options.Set(name, fmt.Sprint(value)); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if !h.authorize(w, r, cmd) {
+		return
+	}
+	if _, err := h.srv.Execute(cmd); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/caches/"+req.Name)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *httpAPI[U, K, V]) destroyCache(w http.ResponseWriter, r *http.Request) {
+	cmd := &Command[K, V]{operation: Cmd_DESTROY, mapTitle: r.PathValue("name")}
+	if !h.authorize(w, r, cmd) {
+		return
+	}
+	if _, err := h.srv.Execute(cmd); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keyCommand builds a command on the entry named by the request path
+func keyCommand[K src.Uints, V any](op Cmd, r *http.Request) *Command[K, V] {
+	key := r.PathValue("key")
+	return &Command[K, V]{operation: op, mapTitle: r.PathValue("name"), key: Hash[K]([]byte(key)), keySize: len(key)}
+}
+
+func (h *httpAPI[U, K, V]) getKey(w http.ResponseWriter, r *http.Request) {
+	cmd := keyCommand[K, V](Cmd_GET, r)
+	if !h.authorize(w, r, cmd) {
+		return
+	}
+	value, err := h.srv.Execute(cmd)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	io.WriteString(w, value)
+}
+
+// putKey stores the request body; a "tags" query parameter holds a comma
+// separated list of tags
+func (h *httpAPI[U, K, V]) putKey(w http.ResponseWriter, r *http.Request) {
+	cmd := keyCommand[K, V](Cmd_SET, r)
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, httpMaxBody))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	cmd.value = value
+	if tags := r.URL.Query().Get("tags"); tags != "" {
+		cmd.tags = strings.Split(tags, ",")
+	}
+	// Authorized once the body is read, so its size counts against the user's limits
+	if !h.authorize(w, r, cmd) {
+		return
+	}
+	if _, err := h.srv.Execute(cmd); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *httpAPI[U, K, V]) deleteKey(w http.ResponseWriter, r *http.Request) {
+	cmd := keyCommand[K, V](Cmd_DEL, r)
+	if !h.authorize(w, r, cmd) {
+		return
+	}
+	if h.srv.repl.following.Load() {
+		writeError(w, ErrReplicaReadOnly)
+		return
+	}
+	var removed bool
+	err := h.srv.mgr.Update([]string{cmd.mapTitle}, func(tx *src.Tx[U, K, V]) (err error) {
+		removed, err = tx.Eject(cmd.mapTitle, cmd.key)
+		return err
+	})
+	switch {
+	case err != nil:
+		writeError(w, fmt.Errorf("%w: %s", err, cmd.mapTitle))
+	case !removed:
+		writeError(w, src.ErrKeyNotFound)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ServeHTTP serves the REST API on listener until it is closed or the server
+// shuts down. Its connections count against the server's connection limit.
+func ServeHTTP[U, K src.Uints, V ~[]byte](listener net.Listener, srv *Server[U, K, V]) {
+	server := &http.Server{
+		Handler:           NewHTTPHandler(srv),
+		ReadHeaderTimeout: 10 * time.Second,
+		// Idle keep-alive connections hold a connection slot
+		IdleTimeout: time.Minute,
+	}
+	if !srv.clients.serveHTTP(server) {
+		listener.Close()
+		return
+	}
+	defer srv.clients.unserveHTTP(server)
+	err := server.Serve(&limitListener{Listener: listener, clients: srv.clients, config: srv.tlsConfig()})
+	if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+		src.LogError(err)
+	}
+}
+
+// limitListener takes a connection slot for every connection it accepts,
+// refusing connections once none is left. With a TLS config, connections and
+// refusals are served over TLS; the TLS connection is outermost so that
+// requests carry its state.
+type limitListener struct {
+	net.Listener
+	clients *tcpClients
+	config  *tls.Config
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		taken := l.clients.take()
+		if taken {
+			conn = &slotConn{Conn: conn, clients: l.clients}
+		}
+		if l.config != nil {
+			conn = tls.Server(conn, l.config)
+		}
+		if taken {
+			return conn, nil
+		}
+		body := errMaxClients.Error() + "\n"
+		go reject(conn, fmt.Sprintf("HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s", len(body), body))
+	}
+}
+
+// slotConn releases its connection slot when closed
+type slotConn struct {
+	net.Conn
+	clients *tcpClients
+	once    sync.Once
+}
+
+func (c *slotConn) Close() error {
+	c.once.Do(c.clients.release)
+	return c.Conn.Close()
+}
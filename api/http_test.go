@@ -0,0 +1,84 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"lrue/src"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTP(t *testing.T) {
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	defer srv.Close()
+	server := httptest.NewServer(NewHTTPHandler(srv))
+	defer server.Close()
+
+	do := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	steps := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"POST", "/caches", `{"name":"users","capacity":8,"options":{"ttl":"1h","max_value_size":32}}`, http.StatusCreated},
+		{"POST", "/caches", `{"name":"users","capacity":8}`, http.StatusConflict},
+		{"POST", "/caches", `{"name":"bad","capacity":8,"options":{"nope":1}}`, http.StatusBadRequest},
+		{"POST", "/caches", `{"name":"large","capacity":8,"options":{"max_value_size":1048576,"weight_limit":2097152}}`, http.StatusCreated},
+		{"POST", "/caches", `{"name":"bad","capacity":8,"options":{"max_value_size":1.5}}`, http.StatusBadRequest},
+		{"PUT", "/caches/users/keys/alice", "line one\nline two\x00", http.StatusNoContent},
+		{"PUT", "/caches/users/keys/big", strings.Repeat("x", 33), http.StatusRequestEntityTooLarge},
+		{"PUT", "/caches/missing/keys/alice", "1", http.StatusNotFound},
+		{"GET", "/caches/users/keys/bob", "", http.StatusNotFound},
+		{"DELETE", "/caches/users/keys/bob", "", http.StatusNotFound},
+		{"GET", "/caches/missing/keys/bob", "", http.StatusNotFound},
+	}
+	for _, step := range steps {
+		if status, body := do(step.method, step.path, step.body); status != step.status {
+			t.Errorf("%s %s = %d %s, want %d", step.method, step.path, status, body, step.status)
+		}
+	}
+
+	if status, body := do("GET", "/caches/users/keys/alice", ""); status != http.StatusOK || body != "line one\nline two\x00" {
+		t.Errorf("Expected the stored bytes back, got %d %q", status, body)
+	}
+
+	status, body := do("GET", "/caches", "")
+	var caches []cacheResponse
+	if err := json.Unmarshal([]byte(body), &caches); err != nil || status != http.StatusOK {
+		t.Fatalf("GET /caches = %d %s, %v", status, body, err)
+	}
+	if len(caches) != 2 || caches[1].Name != "users" || caches[1].Length != 1 || caches[1].Options["ttl"] != "1h0m0s" {
+		t.Errorf("Unexpected cache listing %+v", caches)
+	} else if large := caches[0].Options; large["max_value_size"] != "1048576" || large["weight_limit"] != "2097152" {
+		t.Errorf("Expected options of a million and more to be kept, got %+v", large)
+	}
+
+	if status, _ := do("DELETE", "/caches/users/keys/alice", ""); status != http.StatusNoContent {
+		t.Errorf("Expected DELETE of a present key to succeed, got %d", status)
+	}
+	if status, _ := do("DELETE", "/caches/users", ""); status != http.StatusNoContent {
+		t.Errorf("Expected DELETE of a cache to succeed, got %d", status)
+	}
+	if status, _ := do("DELETE", "/caches/users", ""); status != http.StatusNotFound {
+		t.Errorf("Expected DELETE of a missing cache to fail with 404, got %d", status)
+	}
+
+	var errBody map[string]string
+	_, body = do("GET", "/caches/users/keys/alice", "")
+	if json.NewDecoder(bytes.NewReader([]byte(body))).Decode(&errBody); !strings.Contains(errBody["error"], "cache not found") {
+		t.Errorf("Expected a JSON error body, got %q", body)
+	}
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"fmt"
+	"lrue/src"
+	"strings"
+)
+
+// infoSections renders INFO output; each section is a header followed by key:value lines
+func infoSections[U, K src.Uints, V ~[]byte](cm *src.CacheManager[U, K, V], section string) (string, error) {
+	switch strings.ToLower(section) {
+	case "", "all":
+		return infoMemory(cm) + "\n\n" + infoCaches(cm), nil
+	case "memory":
+		return infoMemory(cm), nil
+	case "caches":
+		return infoCaches(cm), nil
+	}
+	return "", fmt.Errorf("unknown INFO section: %s", section)
+}
+
+func infoMemory[U, K src.Uints, V ~[]byte](cm *src.CacheManager[U, K, V]) string {
+	stats := cm.MemoryStats()
+	var builder strings.Builder
+	builder.WriteString("# Memory\n")
+	fmt.Fprintf(&builder, "used_memory:%d\n", stats.Used)
+	fmt.Fprintf(&builder, "maxmemory:%d\n", stats.Limit)
+	fmt.Fprintf(&builder, "maxmemory_policy:%s\n", stats.Strategy)
+	for _, cache := range stats.Caches {
+		fmt.Fprintf(&builder, "cache:%s bytes=%d share=%.2f%%\n", cache.Title, cache.Bytes, cache.Share*100)
+	}
+	return strings.TrimSuffix(builder.String(), "\n")
+}
+
+func infoCaches[U, K src.Uints, V ~[]byte](cm *src.CacheManager[U, K, V]) string {
+	var builder strings.Builder
+	builder.WriteString("# Caches\n")
+	for _, cache := range cm.Stats() {
+		fmt.Fprintf(&builder, "cache:%s capacity=%d length=%d bytes=%d\n", cache.Title, cache.Capacity, cache.Length, cache.Bytes)
+	}
+	return strings.TrimSuffix(builder.String(), "\n")
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"lrue/src"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ProtocolTCP serves lrue commands, as on the TCP port
+	ProtocolTCP = "tcp"
+	// ProtocolHTTP serves the REST API
+	ProtocolHTTP = "http"
+	// ProtocolRESP serves the Redis protocol
+	ProtocolRESP = "resp"
+	// ProtocolMemcached serves the memcached text protocol on one cache
+	ProtocolMemcached = "memcached"
+)
+
+// DefaultMemcachedCache holds the items of memcached listeners that name no
+// cache
+const DefaultMemcachedCache = "memcached"
+
+// defaultSocketMode is the permission of Unix sockets that do not set one
+const defaultSocketMode os.FileMode = 0o660
+
+// Listener is one address the server accepts clients on
+type Listener struct {
+	Protocol string      // ProtocolTCP, ProtocolHTTP, ProtocolRESP or ProtocolMemcached
+	Network  string      // "tcp" or "unix"
+	Address  string      // host:port, or the path of a Unix socket
+	Mode     os.FileMode // permissions of a Unix socket
+	Cache    string      // cache of a memcached listener, DefaultMemcachedCache when empty
+}
+
+// ParseListener reads a listener written as <protocol>://<address>:
+//
+//	tcp://127.0.0.1:7333, tcp://[::1]:7333, tcp://:7333
+//	unix:///run/lrue.sock?mode=0660
+//	http://:8080, http+unix:///run/lrue-http.sock
+//	resp://:6379, resp+unix:///run/lrue-resp.sock
+//	memcached://:11211?cache=sessions, memcached+unix:///run/lrue-mc.sock
+func ParseListener(spec string) (Listener, error) {
+	scheme, address, ok := strings.Cut(strings.TrimSpace(spec), "://")
+	if !ok || address == "" {
+		return Listener{}, fmt.Errorf("listener must look like tcp://host:port or unix:///path: %s", spec)
+	}
+	var l Listener
+	switch scheme {
+	case "tcp":
+		l = Listener{Protocol: ProtocolTCP, Network: "tcp"}
+	case "unix":
+		l = Listener{Protocol: ProtocolTCP, Network: "unix"}
+	case "http", "resp", "memcached":
+		l = Listener{Protocol: scheme, Network: "tcp"}
+	case "http+unix", "resp+unix", "memcached+unix":
+		l = Listener{Protocol: strings.TrimSuffix(scheme, "+unix"), Network: "unix"}
+	default:
+		return Listener{}, fmt.Errorf("unknown listener scheme %q, expected tcp, unix, http, resp or memcached, the last three with +unix for a Unix socket", scheme)
+	}
+	address, query, _ := strings.Cut(address, "?")
+	if l.Network == "tcp" {
+		if _, port, err := net.SplitHostPort(address); err != nil || port == "" {
+			return Listener{}, fmt.Errorf("listener address must be host:port: %s", address)
+		}
+	} else {
+		l.Mode = defaultSocketMode
+	}
+	l.Address = address
+	if query == "" {
+		return l, nil
+	}
+	for _, option := range strings.Split(query, "&") {
+		key, value, _ := strings.Cut(option, "=")
+		switch {
+		case key == "mode" && l.Network == "unix":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 0o777 {
+				return Listener{}, fmt.Errorf("unix socket mode must be octal permissions: %s", value)
+			}
+			l.Mode = os.FileMode(mode)
+		case key == "cache" && l.Protocol == ProtocolMemcached && value != "":
+			l.Cache = value
+		default:
+			return Listener{}, fmt.Errorf("unknown listener option %q, expected mode=<octal permissions> on a Unix socket or cache=<name> on memcached", option)
+		}
+	}
+	return l, nil
+}
+
+func (l Listener) String() string {
+	var options []string
+	if l.Network == "unix" {
+		options = append(options, fmt.Sprintf("mode=%#o", l.Mode))
+	}
+	if l.Cache != "" {
+		options = append(options, "cache="+l.Cache)
+	}
+	scheme := l.Protocol
+	switch {
+	case l.Network != "unix":
+	case l.Protocol == ProtocolTCP:
+		scheme = "unix"
+	default:
+		scheme += "+unix"
+	}
+	spec := scheme + "://" + l.Address
+	if len(options) > 0 {
+		spec += "?" + strings.Join(options, "&")
+	}
+	return spec
+}
+
+// listen opens the listener. A Unix socket left behind by a server that did
+// not shut down is replaced, one still accepting connections is not.
+func (l Listener) listen() (net.Listener, error) {
+	if l.Network != "unix" {
+		return net.Listen(l.Network, l.Address)
+	}
+	if info, err := os.Stat(l.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", l.Address, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", l.Address)
+		}
+		os.Remove(l.Address)
+	}
+	listener, err := net.Listen("unix", l.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(l.Address, l.Mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ListenAndServe serves every listener until ctx is done, then shuts the
+// server down: see Shutdown, which it calls with the drain timeout of the
+// server. Every listener shares the server's caches, connection limit and
+// timeouts; the cache of a memcached listener must exist. It fails without
+// serving if one of the listeners cannot be opened.
+func ListenAndServe[U, K src.Uints, V ~[]byte](ctx context.Context, listeners []Listener, bufferSize uint16, srv *Server[U, K, V]) error {
+	opened := make([]net.Listener, 0, len(listeners))
+	for _, l := range listeners {
+		listener, err := l.listen()
+		if err != nil {
+			for _, listener := range opened {
+				listener.Close()
+			}
+			return fmt.Errorf("%s: %w", l, err)
+		}
+		opened = append(opened, listener)
+	}
+	for i, listener := range opened {
+		fmt.Printf("Listening on %s\n", listeners[i])
+		switch listeners[i].Protocol {
+		case ProtocolHTTP:
+			go ServeHTTP(listener, srv)
+		case ProtocolRESP:
+			go ServeRESP(listener, srv)
+		case ProtocolMemcached:
+			go ServeMemcached(listener, srv, cmp.Or(listeners[i].Cache, DefaultMemcachedCache))
+		default:
+			go Serve(listener, bufferSize, srv)
+		}
+	}
+	<-ctx.Done()
+
+	drain, cancel := context.WithTimeout(context.Background(), srv.drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(drain); err != nil {
+		fmt.Printf("Closed connections still running after %s\n", srv.drainTimeout)
+	}
+	return nil
+}
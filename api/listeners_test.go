@@ -0,0 +1,160 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"lrue/src"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseListener(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Listener
+	}{
+		{"tcp://127.0.0.1:7333", Listener{Protocol: ProtocolTCP, Network: "tcp", Address: "127.0.0.1:7333"}},
+		{"tcp://[::1]:7333", Listener{Protocol: ProtocolTCP, Network: "tcp", Address: "[::1]:7333"}},
+		{"tcp://:7333", Listener{Protocol: ProtocolTCP, Network: "tcp", Address: ":7333"}},
+		{"unix:///run/lrue.sock", Listener{Protocol: ProtocolTCP, Network: "unix", Address: "/run/lrue.sock", Mode: 0o660}},
+		{"unix:///run/lrue.sock?mode=0600", Listener{Protocol: ProtocolTCP, Network: "unix", Address: "/run/lrue.sock", Mode: 0o600}},
+		{"http://:8080", Listener{Protocol: ProtocolHTTP, Network: "tcp", Address: ":8080"}},
+		{"http+unix:///run/lrue-http.sock", Listener{Protocol: ProtocolHTTP, Network: "unix", Address: "/run/lrue-http.sock", Mode: 0o660}},
+		{"resp://:6379", Listener{Protocol: ProtocolRESP, Network: "tcp", Address: ":6379"}},
+		{"resp+unix:///run/lrue-resp.sock?mode=0600", Listener{Protocol: ProtocolRESP, Network: "unix", Address: "/run/lrue-resp.sock", Mode: 0o600}},
+		{"memcached://:11211", Listener{Protocol: ProtocolMemcached, Network: "tcp", Address: ":11211"}},
+		{"memcached://:11211?cache=sessions", Listener{Protocol: ProtocolMemcached, Network: "tcp", Address: ":11211", Cache: "sessions"}},
+		{"memcached+unix:///run/lrue-mc.sock?mode=0600&cache=sessions", Listener{Protocol: ProtocolMemcached, Network: "unix", Address: "/run/lrue-mc.sock", Mode: 0o600, Cache: "sessions"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseListener(tt.spec)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseListener(%q) = %+v, %v, want %+v", tt.spec, got, err, tt.want)
+		}
+		if again, err := ParseListener(got.String()); err != nil || again != got {
+			t.Errorf("ParseListener(%q) = %+v, %v, want %+v", got, again, err, got)
+		}
+	}
+
+	for _, spec := range []string{"", ":7333", "udp://:7333", "tcp://127.0.0.1", "tcp://", "unix:///run/lrue.sock?mode=999", "unix:///run/lrue.sock?perm=0600", "tcp://:7333?mode=0600", "resp://:6379?cache=mc", "memcached://:11211?cache=", "memcached+unix:///run/lrue-mc.sock?cache=mc&mode=9"} {
+		if _, err := ParseListener(spec); err == nil {
+			t.Errorf("ParseListener(%q) expected an error", spec)
+		}
+	}
+}
+
+func TestListenAndServe(t *testing.T) {
+	dir := t.TempDir()
+	socket, httpSocket := filepath.Join(dir, "lrue.sock"), filepath.Join(dir, "http.sock")
+	respSocket, mcSocket := filepath.Join(dir, "resp.sock"), filepath.Join(dir, "mc.sock")
+	// A socket left behind by a server that crashed is replaced
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	srv.SetMaxConnections(1)
+	run(t, srv, "CREATE mc 10")
+	listeners := []Listener{
+		{Protocol: ProtocolTCP, Network: "unix", Address: socket, Mode: 0o600},
+		{Protocol: ProtocolHTTP, Network: "unix", Address: httpSocket, Mode: 0o660},
+		{Protocol: ProtocolRESP, Network: "unix", Address: respSocket, Mode: 0o660},
+		{Protocol: ProtocolMemcached, Network: "unix", Address: mcSocket, Mode: 0o660, Cache: "mc"},
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- ListenAndServe(ctx, listeners, 256, srv) }()
+	t.Cleanup(stop)
+
+	var conn net.Conn
+	waitFor(t, "the socket to accept", func() bool {
+		conn, err = net.Dial("unix", socket)
+		return err == nil
+	})
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	conn.Write([]byte("CREATE users 10\r\n"))
+	if line, _ := reader.ReadString('\n'); line != "OK\r\n" {
+		t.Errorf("CREATE over the Unix socket = %q", line)
+	}
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Socket mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+	if _, err := (Listener{Protocol: ProtocolTCP, Network: "unix", Address: socket}).listen(); err == nil {
+		t.Errorf("Expected a socket in use to be kept")
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", httpSocket)
+		},
+	}}
+	get := func() int {
+		resp, err := client.Get("http://lrue/caches")
+		if err != nil {
+			t.Fatalf("GET /caches error = %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := get(); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected HTTP to share the connection limit, got %d", status)
+	}
+	// exchange sends line over the Unix socket at path and returns the reply
+	exchange := func(path, line string) string {
+		t.Helper()
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("Dial(%s) error = %v", path, err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(line))
+		reply, _ := bufio.NewReader(conn).ReadString('\n')
+		return reply
+	}
+	if reply := exchange(respSocket, "PING\r\n"); reply != "-ERR max clients reached\r\n" {
+		t.Errorf("Expected RESP to share the connection limit, got %q", reply)
+	}
+	if reply := exchange(mcSocket, "version\r\n"); reply != "SERVER_ERROR max clients reached\r\n" {
+		t.Errorf("Expected memcached to share the connection limit, got %q", reply)
+	}
+	conn.Close()
+	waitFor(t, "the client to leave", func() bool { return len(srv.clients.slots) == 0 })
+	if status := get(); status != http.StatusOK {
+		t.Errorf("GET /caches = %d", status)
+	}
+	client.CloseIdleConnections()
+	waitFor(t, "the HTTP client to leave", func() bool { return len(srv.clients.slots) == 0 })
+	if reply := exchange(respSocket, "PING\r\n"); reply != "+PONG\r\n" {
+		t.Errorf("PING over RESP = %q", reply)
+	}
+	waitFor(t, "the RESP client to leave", func() bool { return len(srv.clients.slots) == 0 })
+	if reply := exchange(mcSocket, "set a 0 0 1\r\nx\r\n"); reply != "STORED\r\n" {
+		t.Errorf("set over memcached = %q", reply)
+	}
+	if value, err := run(t, srv, "GET mc a"); err != nil || value != "x" {
+		t.Errorf("Expected the memcached listener to store in its cache, got %q, %v", value, err)
+	}
+
+	stop()
+	if err := <-done; err != nil {
+		t.Errorf("ListenAndServe() error = %v", err)
+	}
+	for _, path := range []string{socket, httpSocket, respSocket, mcSocket} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed on shutdown, got %v", path, err)
+		}
+	}
+}
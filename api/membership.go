@@ -0,0 +1,467 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gossipInterval = time.Second
+	suspectAfter   = 3 * time.Second
+	failAfter      = 6 * time.Second
+)
+
+// nodeInfo is what a node announces about itself. Heartbeat only ever grows,
+// so the copy with the highest heartbeat is the newest.
+type nodeInfo struct {
+	ID        string
+	Addr      string
+	Primary   string // address of the primary this node replicates, empty for primaries
+	Replaces  string // ID of the failed primary this node took over from
+	Epoch     uint64
+	Heartbeat uint64
+	Offset    uint64
+	Suspects  []string // IDs this node has not heard from recently
+}
+
+// gossipMessage is exchanged in both directions on a CLUSTER GOSSIP connection
+type gossipMessage struct {
+	From  nodeInfo
+	Nodes []nodeInfo
+}
+
+// peerState is one node's view of another node
+type peerState struct {
+	info      nodeInfo
+	lastHeard time.Time            // when its heartbeat last grew
+	reports   map[string]time.Time // reporter ID -> when it last suspected this node
+	suspect   bool
+	failed    bool
+}
+
+// membership runs a heartbeat gossip protocol between lrue nodes. Every node
+// periodically exchanges its view with every peer it knows. A peer whose
+// heartbeat stops growing is suspected after suspectAfter. A replica is
+// marked failed once another node confirms the suspicion or failAfter passes,
+// a primary only once a majority of the other primaries suspects it too, so
+// that a partitioned replica does not take over a primary that still serves.
+// When a primary fails, its replica with the highest offset promotes itself
+// and the other replicas follow it.
+type membership struct {
+	repl         replicaControl
+	dialer       *peerDialer
+	mutex        sync.Mutex
+	self         nodeInfo
+	peers        map[string]*peerState
+	seeds        map[string]struct{} // addresses met but not heard from yet
+	interval     time.Duration
+	suspectAfter time.Duration
+	failAfter    time.Duration
+	startOnce    sync.Once
+	stopOnce     sync.Once
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// replicaControl is the part of a server's replication that membership drives
+type replicaControl interface {
+	status() (primary string, offset uint64)
+	follow(addr string)
+	promote()
+}
+
+func newMembership(repl replicaControl) *membership {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return &membership{
+		repl:         repl,
+		self:         nodeInfo{ID: hex.EncodeToString(id)},
+		peers:        make(map[string]*peerState),
+		seeds:        make(map[string]struct{}),
+		interval:     gossipInterval,
+		suspectAfter: suspectAfter,
+		failAfter:    failAfter,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// announce sets the address other nodes reach this node at, unless one is already set
+func (m *membership) announce(addr string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.self.Addr == "" {
+		m.self.Addr = addr
+	}
+}
+
+// meet adds a node to gossip with; the rest of its cluster is learned from it
+func (m *membership) meet(addr string) {
+	m.mutex.Lock()
+	m.seeds[addr] = struct{}{}
+	m.mutex.Unlock()
+	m.start()
+}
+
+func (m *membership) start() {
+	m.startOnce.Do(func() { go m.run() })
+}
+
+func (m *membership) close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+	m.startOnce.Do(func() { close(m.done) })
+	<-m.done
+}
+
+func (m *membership) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.round()
+		}
+	}
+}
+
+// round gossips with every known node once and then acts on failures
+func (m *membership) round() {
+	m.mutex.Lock()
+	m.refresh(time.Now())
+	msg := m.message()
+	targets := make([]string, 0, len(m.peers)+len(m.seeds))
+	for _, peer := range m.peers {
+		targets = append(targets, peer.info.Addr)
+	}
+	for addr := range m.seeds {
+		targets = append(targets, addr)
+	}
+	m.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, addr := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reply, err := m.exchange(addr, msg); err == nil {
+				m.merge(reply)
+			}
+		}()
+	}
+	wg.Wait()
+	m.failover()
+}
+
+// refresh bumps the heartbeat, records the node's replication state and
+// updates suspicion while the mutex is held
+func (m *membership) refresh(now time.Time) {
+	m.self.Heartbeat++
+	m.self.Primary, m.self.Offset = m.repl.status()
+	if m.self.Primary != "" {
+		m.self.Replaces = ""
+	}
+
+	m.self.Suspects = m.self.Suspects[:0]
+	for id, peer := range m.peers {
+		silent := now.Sub(peer.lastHeard)
+		peer.suspect = silent > m.suspectAfter
+		if !peer.suspect {
+			continue
+		}
+		m.self.Suspects = append(m.self.Suspects, id)
+		if peer.info.Primary == "" {
+			peer.failed = peer.failed || m.quorum(id, peer, now)
+			continue
+		}
+		confirmed := false
+		for reporter, at := range peer.reports {
+			if other, ok := m.peers[reporter]; ok && !other.failed && now.Sub(at) < m.failAfter {
+				confirmed = true
+			}
+		}
+		if confirmed || silent > m.failAfter {
+			peer.failed = true
+		}
+	}
+	slices.Sort(m.self.Suspects)
+}
+
+// quorum reports whether a majority of the primaries other than the suspected
+// primary id, this node included when it is one, suspects it. Primaries that
+// cannot be reached count against it; with no other primary it never fails.
+func (m *membership) quorum(id string, suspect *peerState, now time.Time) bool {
+	voters, votes := 0, 0
+	if m.self.Primary == "" {
+		voters, votes = 1, 1
+	}
+	for other, peer := range m.peers {
+		if other == id || peer.failed || peer.info.Primary != "" {
+			continue
+		}
+		voters++
+		if at, ok := suspect.reports[other]; ok && now.Sub(at) < m.failAfter {
+			votes++
+		}
+	}
+	return votes > voters/2
+}
+
+func (m *membership) message() gossipMessage {
+	msg := gossipMessage{From: m.self, Nodes: make([]nodeInfo, 0, len(m.peers))}
+	msg.From.Suspects = slices.Clone(m.self.Suspects)
+	for _, peer := range m.peers {
+		msg.Nodes = append(msg.Nodes, peer.info)
+	}
+	return msg
+}
+
+// merge folds another node's view into ours
+func (m *membership) merge(msg gossipMessage) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	for _, info := range append(msg.Nodes, msg.From) {
+		if info.ID == m.self.ID || info.ID == "" {
+			continue
+		}
+		delete(m.seeds, info.Addr)
+		peer, known := m.peers[info.ID]
+		if !known {
+			peer = &peerState{info: info, lastHeard: now, reports: make(map[string]time.Time)}
+			m.peers[info.ID] = peer
+		} else if info.Heartbeat <= peer.info.Heartbeat {
+			continue
+		}
+		peer.info = info
+		peer.lastHeard = now
+		if peer.failed || peer.suspect {
+			peer.failed, peer.suspect = false, false
+			clear(peer.reports)
+		}
+		for _, suspect := range info.Suspects {
+			if target, ok := m.peers[suspect]; ok {
+				target.reports[info.ID] = now
+			}
+		}
+	}
+	m.start()
+}
+
+// failover promotes this replica when its primary has failed and it is the
+// best candidate, follows a replica that took over instead, and steps down
+// when this primary was replaced while it was unreachable
+func (m *membership) failover() {
+	m.mutex.Lock()
+	var follow string
+	promote := false
+	if m.self.Primary == "" {
+		for _, peer := range m.peers {
+			if !peer.failed && peer.info.Replaces == m.self.ID && peer.info.Epoch > m.self.Epoch {
+				follow = peer.info.Addr
+			}
+		}
+	} else if primary := m.peerAt(m.self.Primary); primary != nil && primary.failed {
+		best := m.self
+		for _, peer := range m.peers {
+			info := peer.info
+			switch {
+			case peer.failed:
+			case info.Primary == "" && info.Replaces == primary.info.ID:
+				follow = info.Addr
+			case info.Primary == m.self.Primary &&
+				(info.Offset > best.Offset || info.Offset == best.Offset && info.ID < best.ID):
+				best = info
+			}
+		}
+		if follow == "" && best.ID == m.self.ID {
+			promote = true
+			m.self.Epoch = m.currentEpoch() + 1
+			m.self.Replaces = primary.info.ID
+			m.self.Primary = ""
+		}
+	}
+	m.mutex.Unlock()
+
+	switch {
+	case promote:
+		m.repl.promote()
+	case follow != "":
+		m.repl.follow(follow)
+		m.mutex.Lock()
+		m.self.Primary = follow
+		m.mutex.Unlock()
+	}
+}
+
+func (m *membership) peerAt(addr string) *peerState {
+	for _, peer := range m.peers {
+		if peer.info.Addr == addr {
+			return peer
+		}
+	}
+	return nil
+}
+
+func (m *membership) currentEpoch() uint64 {
+	epoch := m.self.Epoch
+	for _, peer := range m.peers {
+		epoch = max(epoch, peer.info.Epoch)
+	}
+	return epoch
+}
+
+// exchange sends our view to the node at addr and returns its view
+func (m *membership) exchange(addr string, msg gossipMessage) (gossipMessage, error) {
+	var reply gossipMessage
+	conn, err := m.dialer.dial(context.Background(), addr, m.interval)
+	if err != nil {
+		return reply, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * m.interval))
+
+	reader := bufio.NewReader(conn)
+	if err := m.dialer.greet(conn, reader); err != nil {
+		return reply, err
+	}
+	if _, err := fmt.Fprintf(conn, "%s %s\r\n", Cmd_CLUSTER, Cmd_GOSSIP); err != nil {
+		return reply, err
+	}
+	if line, err := reader.ReadString('\n'); err != nil {
+		return reply, err
+	} else if strings.TrimSpace(line) != string(Cmd_GOSSIP) {
+		return reply, fmt.Errorf("unexpected gossip reply: %s", strings.TrimSpace(line))
+	}
+	if err := gob.NewEncoder(conn).Encode(msg); err != nil {
+		return reply, err
+	}
+	err = gob.NewDecoder(reader).Decode(&reply)
+	return reply, err
+}
+
+// serve answers a CLUSTER GOSSIP connection with our view
+func (m *membership) serve(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(2 * m.interval))
+	if _, err := fmt.Fprintf(conn, "%s\r\n", Cmd_GOSSIP); err != nil {
+		return
+	}
+	var msg gossipMessage
+	if err := gob.NewDecoder(conn).Decode(&msg); err != nil {
+		return
+	}
+	m.merge(msg)
+	m.mutex.Lock()
+	reply := m.message()
+	m.mutex.Unlock()
+	gob.NewEncoder(conn).Encode(reply)
+}
+
+// nodes renders CLUSTER NODES: one line per node with its ID, address, flags,
+// primary ID, milliseconds since it was last heard from, epoch and offset
+func (m *membership) nodes() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ids := make(map[string]string, len(m.peers)+1)
+	ids[m.self.Addr] = m.self.ID
+	for id, peer := range m.peers {
+		ids[peer.info.Addr] = id
+	}
+	line := func(info nodeInfo, flags []string, silent time.Duration) string {
+		if info.Primary == "" {
+			flags = append(flags, "primary")
+		} else {
+			flags = append(flags, "replica")
+		}
+		primary := "-"
+		if info.Primary != "" {
+			primary = ids[info.Primary]
+			if primary == "" {
+				primary = info.Primary
+			}
+		}
+		return fmt.Sprintf("%s %s %s %s %d %d %d", info.ID, info.Addr, strings.Join(flags, ","),
+			primary, silent.Milliseconds(), info.Epoch, info.Offset)
+	}
+
+	self := m.self
+	self.Primary, self.Offset = m.repl.status()
+	lines := []string{line(self, []string{"myself"}, 0)}
+	now := time.Now()
+	peers := make([]*peerState, 0, len(m.peers))
+	for _, peer := range m.peers {
+		peers = append(peers, peer)
+	}
+	slices.SortFunc(peers, func(a, b *peerState) int { return strings.Compare(a.info.Addr, b.info.Addr) })
+	for _, peer := range peers {
+		var flags []string
+		switch {
+		case peer.failed:
+			flags = append(flags, "fail")
+		case peer.suspect:
+			flags = append(flags, "pfail")
+		}
+		lines = append(lines, line(peer.info, flags, now.Sub(peer.lastHeard)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// info renders CLUSTER INFO. The cluster is in the fail state while a failed
+// primary has not been replaced.
+func (m *membership) info() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	primary, _ := m.repl.status()
+	primaries, suspected, failed := 0, 0, 0
+	if primary == "" {
+		primaries++
+	}
+	replaced := make(map[string]bool)
+	if m.self.Primary == "" && m.self.Replaces != "" {
+		replaced[m.self.Replaces] = true
+	}
+	for _, peer := range m.peers {
+		if peer.info.Replaces != "" && !peer.failed {
+			replaced[peer.info.Replaces] = true
+		}
+	}
+	state := "ok"
+	for id, peer := range m.peers {
+		switch {
+		case peer.failed:
+			failed++
+			if peer.info.Primary == "" && !replaced[id] {
+				state = "fail"
+			}
+		case peer.suspect:
+			suspected++
+		}
+		if !peer.failed && peer.info.Primary == "" {
+			primaries++
+		}
+	}
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "cluster_state:%s\n", state)
+	fmt.Fprintf(&builder, "cluster_my_id:%s\n", m.self.ID)
+	fmt.Fprintf(&builder, "cluster_known_nodes:%d\n", len(m.peers)+1)
+	fmt.Fprintf(&builder, "cluster_primaries:%d\n", primaries)
+	fmt.Fprintf(&builder, "cluster_suspected_nodes:%d\n", suspected)
+	fmt.Fprintf(&builder, "cluster_failed_nodes:%d\n", failed)
+	fmt.Fprintf(&builder, "cluster_current_epoch:%d", m.currentEpoch())
+	return builder.String()
+}
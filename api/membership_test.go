@@ -0,0 +1,124 @@
+package api
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func nodeFlags(t *testing.T, srv *testServer, addr string) string {
+	t.Helper()
+	nodes, _ := run(t, srv, "CLUSTER NODES")
+	for _, line := range strings.Split(nodes, "\n") {
+		if fields := strings.Fields(line); len(fields) >= 3 && fields[1] == addr {
+			return fields[2]
+		}
+	}
+	return ""
+}
+
+func TestMembershipFailover(t *testing.T) {
+	primary, listener := listen(t)
+	primaryAddr := listener.Addr().String()
+	replica, replicaAddr := startServer(t)
+	other, _ := startServer(t)
+	for _, srv := range []*testServer{primary, replica, other} {
+		srv.gossip.interval = 20 * time.Millisecond
+		srv.gossip.suspectAfter = 150 * time.Millisecond
+		srv.gossip.failAfter = 400 * time.Millisecond
+	}
+	host, port, _ := net.SplitHostPort(primaryAddr)
+
+	run(t, primary, "CREATE users 8")
+	run(t, primary, "SET users alice 1")
+	run(t, replica, "REPLICAOF "+host+" "+port)
+	run(t, replica, "CLUSTER MEET "+host+" "+port)
+	run(t, other, "CLUSTER MEET "+host+" "+port)
+
+	waitFor(t, "every node to know the others", func() bool {
+		for _, srv := range []*testServer{primary, replica, other} {
+			if info, _ := run(t, srv, "CLUSTER INFO"); !strings.Contains(info, "cluster_known_nodes:3") {
+				return false
+			}
+		}
+		return true
+	})
+	waitFor(t, "replica to sync", inSync(primary, replica))
+	if flags := nodeFlags(t, other, replicaAddr); flags != "replica" {
+		t.Errorf("Expected the replica to be gossiped as a replica, got %q", flags)
+	}
+	if info, _ := run(t, other, "CLUSTER INFO"); !strings.Contains(info, "cluster_state:ok") {
+		t.Errorf("Expected a healthy cluster, got\n%s", info)
+	}
+
+	// Stop the primary: it no longer accepts connections or gossips
+	listener.Close()
+	primary.Close()
+
+	waitFor(t, "primary to be marked failed", func() bool {
+		return nodeFlags(t, other, primaryAddr) == "fail,primary"
+	})
+	waitFor(t, "replica to be promoted", func() bool {
+		return nodeFlags(t, other, replicaAddr) == "primary" && nodeFlags(t, replica, replicaAddr) == "myself,primary"
+	})
+	if _, err := run(t, replica, "SET users bob 2"); errors.Is(err, ErrReplicaReadOnly) {
+		t.Errorf("Expected the promoted replica to accept writes")
+	}
+	if got, err := run(t, replica, "GET users alice"); err != nil || got != "1" {
+		t.Errorf("Expected the promoted replica to keep its data, got %q, %v", got, err)
+	}
+	waitFor(t, "cluster to recover", func() bool {
+		info, _ := run(t, other, "CLUSTER INFO")
+		return strings.Contains(info, "cluster_state:ok") && strings.Contains(info, "cluster_current_epoch:1")
+	})
+}
+
+// replicaOf is a replicaControl that replicates a fixed primary
+type replicaOf string
+
+func (r replicaOf) status() (string, uint64) { return string(r), 0 }
+func (replicaOf) follow(string)              {}
+func (replicaOf) promote()                   {}
+
+func TestMembershipQuorum(t *testing.T) {
+	m := newMembership(replicaOf("primary:7333"))
+	now := time.Now()
+	silent := now.Add(-2 * m.failAfter)
+	peer := func(id, addr, primary string, lastHeard time.Time) *peerState {
+		state := &peerState{info: nodeInfo{ID: id, Addr: addr, Primary: primary}, lastHeard: lastHeard, reports: make(map[string]time.Time)}
+		m.peers[id] = state
+		return state
+	}
+	primary := peer("p", "primary:7333", "", silent)
+	peer("r", "replica:7333", "primary:7333", now)
+
+	// A replica cut off from the primary alone does not fail it, however long the silence
+	m.refresh(now)
+	if !primary.suspect || primary.failed {
+		t.Fatalf("Expected the primary to be suspected only, got suspect=%v failed=%v", primary.suspect, primary.failed)
+	}
+
+	// One of two other primaries is no majority
+	peer("o1", "o1:7333", "", now)
+	peer("o2", "o2:7333", "", now)
+	primary.reports["o1"] = now
+	primary.reports["r"] = now
+	m.refresh(now)
+	if primary.failed {
+		t.Fatalf("Expected a minority of primaries not to fail the primary")
+	}
+	primary.reports["o2"] = now
+	m.refresh(now)
+	if !primary.failed {
+		t.Fatalf("Expected a majority of primaries to fail the primary")
+	}
+
+	// Replicas still fail on their own silence
+	replica := peer("r2", "replica2:7333", "primary:7333", silent)
+	m.refresh(now)
+	if !replica.failed {
+		t.Errorf("Expected a silent replica to be marked failed")
+	}
+}
@@ -0,0 +1,630 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"lrue/src"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	mcMaxKey      = 250
+	mcMaxItem     = 64 << 20
+	mcRelativeMax = 30 * 24 * 60 * 60 // larger exptimes are absolute Unix times
+)
+
+var errMemcachedData = errors.New("bad data chunk")
+
+// memcached serves the memcached text protocol on top of one cache. Client
+// flags are kept in the entry's Flags, next to the value, and CAS uniques are
+// the entries' versions. With an ACL, clients log in as memcached's text protocol
+// does, with a set whose data is "<user> <password>", and every command is
+// checked against the user's permissions on the cache.
+type memcached[U, K src.Uints, V ~[]byte] struct {
+	srv     *Server[U, K, V]
+	cache   string
+	started time.Time
+	stats   struct {
+		currConnections, totalConnections                    atomic.Int64
+		cmdGet, cmdSet, cmdTouch, cmdFlush, getHits          atomic.Uint64
+		getMisses, deleteHits, deleteMisses, incrHits        atomic.Uint64
+		incrMisses, decrHits, decrMisses, casHits, casMisses atomic.Uint64
+		casBadval, touchHits, touchMisses                    atomic.Uint64
+	}
+}
+
+// mcConn is one memcached client connection
+type mcConn[U, K src.Uints, V ~[]byte] struct {
+	*memcached[U, K, V]
+	sess   *session[U, K, V]
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// mcExpiry converts a memcached exptime into an absolute expiry in UnixNano:
+// zero keeps the cache's default ttl, and gone reports an exptime in the past
+func mcExpiry(exptime int64, now time.Time) (expiresAt int64, gone bool) {
+	switch {
+	case exptime == 0:
+		return 0, false
+	case exptime < 0:
+		return 0, true
+	case exptime <= mcRelativeMax:
+		return now.Add(time.Duration(exptime) * time.Second).UnixNano(), false
+	}
+	at := time.Unix(exptime, 0)
+	return at.UnixNano(), !at.After(now)
+}
+
+func (c *mcConn[U, K, V]) reply(noreply bool, format string, args ...any) {
+	if !noreply {
+		fmt.Fprintf(c.writer, format+"\r\n", args...)
+	}
+}
+
+// fail reports an error from the cache layer as a memcached server error
+func (c *mcConn[U, K, V]) fail(err error) {
+	fmt.Fprintf(c.writer, "SERVER_ERROR %s\r\n", err)
+}
+
+// update runs fn with the served cache locked
+func (c *mcConn[U, K, V]) update(fn func(tx *src.Tx[U, K, V]) error) error {
+	return c.srv.mgr.Update([]string{c.cache}, fn)
+}
+
+// allowed reports whether the user may run cmd on the served cache, and
+// charges it to the rate limits of the connection and of the user, answering
+// the client otherwise. Commands are mapped to the lrue command needing the
+// same permission and costing the same.
+func (c *mcConn[U, K, V]) allowed(cmd *Command[K, V]) bool {
+	cmd.mapTitle = c.cache
+	err := c.sess.authorize(cmd)
+	if err == nil {
+		err = c.sess.limit(cmd)
+	}
+	switch {
+	case errors.Is(err, ErrNoAuth):
+		c.writer.WriteString("CLIENT_ERROR unauthenticated\r\n")
+	case err != nil:
+		c.fail(err)
+	}
+	return err == nil
+}
+
+// authenticate handles the set sent before logging in, whose data is
+// "<user> <password>"
+func (c *mcConn[U, K, V]) authenticate(data []byte) {
+	name, password, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+	auth := &Command[K, V]{operation: Cmd_AUTH, option: name, value: V(password)}
+	if _, err := c.sess.Execute(auth); err != nil {
+		c.writer.WriteString("CLIENT_ERROR authentication failure\r\n")
+		return
+	}
+	c.writer.WriteString("STORED\r\n")
+}
+
+// writable fails writes on replicas
+func (c *mcConn[U, K, V]) writable() bool {
+	if c.srv.repl.following.Load() {
+		c.fail(ErrReplicaReadOnly)
+		return false
+	}
+	return true
+}
+
+func validKey(key string) bool {
+	return len(key) > 0 && len(key) <= mcMaxKey
+}
+
+// noreply strips a trailing "noreply" argument
+func noreply(fields []string) ([]string, bool) {
+	if n := len(fields); n > 0 && fields[n-1] == "noreply" {
+		return fields[:n-1], true
+	}
+	return fields, false
+}
+
+// store handles set, add, replace, append, prepend and cas
+func (c *mcConn[U, K, V]) store(name string, fields []string) error {
+	fields, quiet := noreply(fields)
+	want := 4
+	if name == "cas" {
+		want = 5
+	}
+	if len(fields) != want {
+		return fmt.Errorf("CLIENT_ERROR bad command line format")
+	}
+	key := fields[0]
+	flags, err1 := strconv.ParseUint(fields[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(fields[2], 10, 64)
+	size, err3 := strconv.Atoi(fields[3])
+	if err1 != nil || err2 != nil || err3 != nil || size < 0 || !validKey(key) {
+		return fmt.Errorf("CLIENT_ERROR bad command line format")
+	}
+	if size > mcMaxItem {
+		return fmt.Errorf("SERVER_ERROR object too large for cache")
+	}
+	var unique uint64
+	if name == "cas" {
+		var err error
+		if unique, err = strconv.ParseUint(fields[4], 10, 64); err != nil {
+			return fmt.Errorf("CLIENT_ERROR bad command line format")
+		}
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return errMemcachedData
+	}
+	data = data[:size]
+	if name == "set" && c.sess.user == nil && c.srv.acl.Load() != nil {
+		c.authenticate(data)
+		return nil
+	}
+	hashed := Hash[K]([]byte(key))
+	if !c.allowed(&Command[K, V]{operation: Cmd_SET, key: hashed, keySize: len(key), value: data}) || !c.writable() {
+		return nil
+	}
+
+	c.stats.cmdSet.Add(1)
+	expiresAt, gone := mcExpiry(exptime, time.Now())
+	var result string
+	err := c.update(func(tx *src.Tx[U, K, V]) error {
+		if err := tx.CheckWrite(c.cache, len(key), len(data)); err != nil {
+			return err
+		}
+		entry, version, found, err := tx.Lookup(c.cache, hashed)
+		if err != nil {
+			return err
+		}
+		value, tags := V(data), entry.Tags
+		switch name {
+		case "add":
+			if found {
+				result = "NOT_STORED"
+				return nil
+			}
+		case "replace":
+			if !found {
+				result = "NOT_STORED"
+				return nil
+			}
+		case "append", "prepend":
+			// Both keep the entry's flags and expiry
+			if !found {
+				result = "NOT_STORED"
+				return nil
+			}
+			if name == "append" {
+				value = V(slices.Concat([]byte(entry.Value), data))
+			} else {
+				value = V(slices.Concat(data, []byte(entry.Value)))
+			}
+			entry.Value = value
+			result = "STORED"
+			return tx.Restore(c.cache, entry)
+		case "cas":
+			switch {
+			case !found:
+				c.stats.casMisses.Add(1)
+				result = "NOT_FOUND"
+				return nil
+			case version != unique:
+				c.stats.casBadval.Add(1)
+				result = "EXISTS"
+				return nil
+			}
+			c.stats.casHits.Add(1)
+		}
+		result = "STORED"
+		switch {
+		case gone:
+			_, err := tx.Eject(c.cache, hashed)
+			return err
+		case expiresAt == 0:
+			return tx.PutFlagged(c.cache, hashed, value, uint32(flags), tags...)
+		}
+		return tx.Restore(c.cache, src.Entry[K, V]{Key: hashed, Value: value, Tags: tags, ExpiresAt: expiresAt, Flags: uint32(flags)})
+	})
+	if err != nil {
+		c.fail(err)
+		return nil
+	}
+	c.reply(quiet, "%s", result)
+	return nil
+}
+
+// get handles get and gets, which also returns the CAS unique
+func (c *mcConn[U, K, V]) get(withCAS bool, keys []string) error {
+	if len(keys) == 0 {
+		return errors.New("ERROR")
+	}
+	for _, key := range keys {
+		if !validKey(key) {
+			return fmt.Errorf("CLIENT_ERROR bad command line format")
+		}
+	}
+	if !c.allowed(&Command[K, V]{operation: Cmd_GET}) {
+		return nil
+	}
+	var out bytes.Buffer
+	err := c.update(func(tx *src.Tx[U, K, V]) error {
+		for _, key := range keys {
+			c.stats.cmdGet.Add(1)
+			entry, version, found, err := tx.Lookup(c.cache, Hash[K]([]byte(key)))
+			if err != nil {
+				return err
+			}
+			if !found {
+				c.stats.getMisses.Add(1)
+				continue
+			}
+			c.stats.getHits.Add(1)
+			fmt.Fprintf(&out, "VALUE %s %d %d", key, entry.Flags, len(entry.Value))
+			if withCAS {
+				fmt.Fprintf(&out, " %d", version)
+			}
+			out.WriteString("\r\n")
+			out.Write(entry.Value)
+			out.WriteString("\r\n")
+		}
+		return nil
+	})
+	if err != nil {
+		c.fail(err)
+		return nil
+	}
+	c.writer.Write(out.Bytes())
+	c.writer.WriteString("END\r\n")
+	return nil
+}
+
+// delete handles delete <key> [0] [noreply]
+func (c *mcConn[U, K, V]) delete(fields []string) error {
+	fields, quiet := noreply(fields)
+	if len(fields) == 2 && fields[1] == "0" {
+		fields = fields[:1]
+	}
+	if len(fields) != 1 || !validKey(fields[0]) {
+		return fmt.Errorf("CLIENT_ERROR bad command line format. Usage: delete <key> [noreply]")
+	}
+	if !c.allowed(&Command[K, V]{operation: Cmd_DEL}) || !c.writable() {
+		return nil
+	}
+	var removed bool
+	err := c.update(func(tx *src.Tx[U, K, V]) (err error) {
+		removed, err = tx.Eject(c.cache, Hash[K]([]byte(fields[0])))
+		return err
+	})
+	switch {
+	case err != nil:
+		c.fail(err)
+	case removed:
+		c.stats.deleteHits.Add(1)
+		c.reply(quiet, "DELETED")
+	default:
+		c.stats.deleteMisses.Add(1)
+		c.reply(quiet, "NOT_FOUND")
+	}
+	return nil
+}
+
+// incr handles incr and decr on decimal values. incr wraps at 64 bits and
+// decr stops at zero.
+func (c *mcConn[U, K, V]) incr(decr bool, fields []string) error {
+	fields, quiet := noreply(fields)
+	if len(fields) != 2 || !validKey(fields[0]) {
+		return fmt.Errorf("CLIENT_ERROR bad command line format")
+	}
+	delta, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("CLIENT_ERROR invalid numeric delta argument")
+	}
+	// Like DEL, incr and decr need write access but neither create keys nor
+	// write more than a few bytes
+	if !c.allowed(&Command[K, V]{operation: Cmd_DEL}) || !c.writable() {
+		return nil
+	}
+	hits, misses := &c.stats.incrHits, &c.stats.incrMisses
+	if decr {
+		hits, misses = &c.stats.decrHits, &c.stats.decrMisses
+	}
+
+	var result string
+	var clientErr error
+	err = c.update(func(tx *src.Tx[U, K, V]) error {
+		entry, _, found, err := tx.Lookup(c.cache, Hash[K]([]byte(fields[0])))
+		if err != nil || !found {
+			return err
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(string(entry.Value)), 10, 64)
+		if err != nil {
+			clientErr = fmt.Errorf("CLIENT_ERROR cannot increment or decrement non-numeric value")
+			return nil
+		}
+		switch {
+		case !decr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		result = strconv.FormatUint(n, 10)
+		entry.Value = V(result)
+		return tx.Restore(c.cache, entry)
+	})
+	switch {
+	case err != nil:
+		c.fail(err)
+	case clientErr != nil:
+		return clientErr
+	case result == "":
+		misses.Add(1)
+		c.reply(quiet, "NOT_FOUND")
+	default:
+		hits.Add(1)
+		c.reply(quiet, "%s", result)
+	}
+	return nil
+}
+
+// touch handles touch <key> <exptime> [noreply]
+func (c *mcConn[U, K, V]) touch(fields []string) error {
+	fields, quiet := noreply(fields)
+	if len(fields) != 2 || !validKey(fields[0]) {
+		return fmt.Errorf("CLIENT_ERROR bad command line format")
+	}
+	exptime, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("CLIENT_ERROR invalid exptime argument")
+	}
+	if !c.allowed(&Command[K, V]{operation: Cmd_DEL}) || !c.writable() {
+		return nil
+	}
+	c.stats.cmdTouch.Add(1)
+	expiresAt, gone := mcExpiry(exptime, time.Now())
+	var found bool
+	err = c.update(func(tx *src.Tx[U, K, V]) error {
+		entry, _, ok, err := tx.Lookup(c.cache, Hash[K]([]byte(fields[0])))
+		if err != nil || !ok {
+			return err
+		}
+		found = true
+		if gone {
+			_, err := tx.Eject(c.cache, entry.Key)
+			return err
+		}
+		entry.ExpiresAt = expiresAt
+		return tx.Restore(c.cache, entry)
+	})
+	switch {
+	case err != nil:
+		c.fail(err)
+	case found:
+		c.stats.touchHits.Add(1)
+		c.reply(quiet, "TOUCHED")
+	default:
+		c.stats.touchMisses.Add(1)
+		c.reply(quiet, "NOT_FOUND")
+	}
+	return nil
+}
+
+// flushAll clears the cache now or after a delay in seconds
+func (c *mcConn[U, K, V]) flushAll(fields []string) error {
+	fields, quiet := noreply(fields)
+	var delay int64
+	if len(fields) > 1 {
+		return fmt.Errorf("CLIENT_ERROR bad command line format")
+	}
+	if len(fields) == 1 {
+		var err error
+		if delay, err = strconv.ParseInt(fields[0], 10, 64); err != nil || delay < 0 {
+			return fmt.Errorf("CLIENT_ERROR bad command line format")
+		}
+	}
+	if !c.allowed(&Command[K, V]{operation: Cmd_CLEAR}) || !c.writable() {
+		return nil
+	}
+	clear := func(tx *src.Tx[U, K, V]) error {
+		return tx.Clear(c.cache)
+	}
+	c.stats.cmdFlush.Add(1)
+	if delay > 0 {
+		// A delayed flush of a cache that became read-only meanwhile, or that
+		// falls due once the server shut down, is dropped
+		time.AfterFunc(time.Duration(delay)*time.Second, func() {
+			if c.srv.ctx.Err() == nil {
+				c.update(clear)
+			}
+		})
+	} else if err := c.update(clear); err != nil {
+		c.fail(err)
+		return nil
+	}
+	c.reply(quiet, "OK")
+	return nil
+}
+
+// writeStats renders the general-purpose statistics
+func (c *mcConn[U, K, V]) writeStats() {
+	var items, bytes uint64
+	var capacity U
+	if cache := c.srv.mgr.GetCache(c.cache); cache != nil {
+		items, bytes, capacity = uint64(cache.Length()), cache.Footprint(), cache.Capacity()
+		cache.Release()
+	}
+	now := time.Now()
+	s := &c.stats
+	stats := []struct {
+		name  string
+		value any
+	}{
+		{"pid", os.Getpid()},
+		{"uptime", int64(now.Sub(c.started).Seconds())},
+		{"time", now.Unix()},
+		{"version", serverVersion},
+		{"curr_connections", s.currConnections.Load()},
+		{"total_connections", s.totalConnections.Load()},
+		{"cmd_get", s.cmdGet.Load()},
+		{"cmd_set", s.cmdSet.Load()},
+		{"cmd_flush", s.cmdFlush.Load()},
+		{"cmd_touch", s.cmdTouch.Load()},
+		{"get_hits", s.getHits.Load()},
+		{"get_misses", s.getMisses.Load()},
+		{"delete_hits", s.deleteHits.Load()},
+		{"delete_misses", s.deleteMisses.Load()},
+		{"incr_hits", s.incrHits.Load()},
+		{"incr_misses", s.incrMisses.Load()},
+		{"decr_hits", s.decrHits.Load()},
+		{"decr_misses", s.decrMisses.Load()},
+		{"cas_hits", s.casHits.Load()},
+		{"cas_misses", s.casMisses.Load()},
+		{"cas_badval", s.casBadval.Load()},
+		{"touch_hits", s.touchHits.Load()},
+		{"touch_misses", s.touchMisses.Load()},
+		{"curr_items", items},
+		{"bytes", bytes},
+		{"limit_maxitems", capacity},
+	}
+	for _, stat := range stats {
+		fmt.Fprintf(c.writer, "STAT %s %v\r\n", stat.name, stat.value)
+	}
+	c.writer.WriteString("END\r\n")
+}
+
+// execute runs one command line. It returns false once the connection should close.
+func (c *mcConn[U, K, V]) execute(line string) (bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true, errors.New("ERROR")
+	}
+	switch name := fields[0]; name {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return true, c.store(name, fields[1:])
+	case "get", "gets":
+		return true, c.get(name == "gets", fields[1:])
+	case "delete":
+		return true, c.delete(fields[1:])
+	case "incr", "decr":
+		return true, c.incr(name == "decr", fields[1:])
+	case "touch":
+		return true, c.touch(fields[1:])
+	case "flush_all":
+		return true, c.flushAll(fields[1:])
+	case "stats":
+		if len(fields) > 1 {
+			return true, fmt.Errorf("CLIENT_ERROR unsupported stats group %s", fields[1])
+		}
+		if c.allowed(&Command[K, V]{operation: Cmd_GET}) {
+			c.writeStats()
+		}
+	case "version":
+		fmt.Fprintf(c.writer, "VERSION %s\r\n", serverVersion)
+	case "verbosity":
+		_, quiet := noreply(fields)
+		c.reply(quiet, "OK")
+	case "quit":
+		return false, nil
+	default:
+		return true, errors.New("ERROR")
+	}
+	return true, nil
+}
+
+func (m *memcached[U, K, V]) handle(client *tcpClient) {
+	conn := client.conn
+	defer m.srv.clients.remove(client)
+	defer conn.Close()
+	m.stats.currConnections.Add(1)
+	m.stats.totalConnections.Add(1)
+	defer m.stats.currConnections.Add(-1)
+
+	c := &mcConn[U, K, V]{
+		memcached: m,
+		sess:      m.srv.newSession(),
+		reader:    bufio.NewReaderSize(conn, 16<<10),
+		writer:    bufio.NewWriterSize(conn, 16<<10),
+	}
+	defer c.sess.close()
+	if !c.sess.handshake(client) {
+		return
+	}
+	for {
+		if err := m.srv.clients.next(client, c.reader); err != nil {
+			if errors.Is(err, ErrServerClosed) || errors.Is(err, errIdleTimeout) {
+				c.fail(err)
+				c.writer.Flush()
+			}
+			return
+		}
+		line, err := c.reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			c.writer.WriteString("CLIENT_ERROR line too long\r\n")
+			c.writer.Flush()
+			return
+		}
+		if err != nil {
+			switch err = m.srv.clients.readFailed(err); {
+			case err == nil:
+				continue
+			case errors.Is(err, errReadTimeout):
+				c.fail(err)
+				c.writer.Flush()
+			}
+			return
+		}
+		if verb, _, _ := strings.Cut(strings.TrimSpace(string(line)), " "); verb != "" {
+			client.observe(Cmd(strings.ToUpper(verb)))
+		}
+		open, err := c.execute(string(line))
+		client.user.Store(c.sess.user)
+		switch {
+		case errors.Is(err, errMemcachedData):
+			fmt.Fprintf(c.writer, "CLIENT_ERROR %s\r\n", err)
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+			return
+		case errors.As(err, new(net.Error)):
+			// Reading the data block failed
+			switch err = m.srv.clients.readFailed(err); {
+			case err == nil:
+				continue
+			case errors.Is(err, errReadTimeout):
+				c.fail(err)
+				c.writer.Flush()
+			}
+			return
+		case err != nil:
+			fmt.Fprintf(c.writer, "%s\r\n", err)
+		}
+		// Pipelined commands are answered together once the input is drained
+		if c.reader.Buffered() == 0 || !open {
+			if err := c.writer.Flush(); err != nil {
+				return
+			}
+		}
+		if !open {
+			return
+		}
+	}
+}
+
+// ServeMemcached accepts memcached connections on listener until it is closed
+// or the server shuts down. They share the server's connection limit and
+// timeouts.
+func ServeMemcached[U, K src.Uints, V ~[]byte](listener net.Listener, srv *Server[U, K, V], cache string) {
+	m := &memcached[U, K, V]{srv: srv, cache: cache, started: time.Now()}
+	srv.clients.serve(srv.tlsListener(listener), "SERVER_ERROR %s\r\n", m.handle)
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"lrue/src"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemcached(t *testing.T) {
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	defer srv.Close()
+	run(t, srv, "CREATE mc 16")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer listener.Close()
+	go ServeMemcached(listener, srv, "mc")
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	expect := func(want ...string) {
+		t.Helper()
+		for _, line := range want {
+			got, err := reader.ReadString('\n')
+			if err != nil || got != line+"\r\n" {
+				t.Fatalf("Expected %q, got %q, %v", line, got, err)
+			}
+		}
+	}
+	send := func(lines ...string) {
+		conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+	}
+
+	// Data blocks are binary safe and commands can be pipelined
+	send("set a 5 0 7", "x\r\ny z\x00", "add a 0 0 1", "b", "add b 0 0 1", "2", "replace c 0 0 1", "3",
+		"get a b c", "append b 0 0 2", "34", "prepend b 0 0 1", "1")
+	expect("STORED", "NOT_STORED", "STORED", "NOT_STORED",
+		"VALUE a 5 7", "x", "y z\x00", "VALUE b 0 1", "2", "END", "STORED", "STORED")
+
+	// cas only stores when the unique from gets is current
+	send("gets b")
+	var unique uint64
+	line, _ := reader.ReadString('\n')
+	if _, err := fmt.Sscanf(line, "VALUE b 0 4 %d", &unique); err != nil {
+		t.Fatalf("Unexpected gets reply %q", line)
+	}
+	expect("1234", "END")
+	send(fmt.Sprintf("cas b 0 0 1 %d", unique+1), "x", fmt.Sprintf("cas b 0 0 1 %d", unique), "9",
+		fmt.Sprintf("cas b 0 0 1 %d", unique), "8", "cas zz 0 0 1 1", "1")
+	expect("EXISTS", "STORED", "EXISTS", "NOT_FOUND")
+
+	send("incr b 5", "decr b 100", "incr a 1", "incr nope 1", "set n 0 0 20", "18446744073709551615", "incr n 2")
+	expect("14", "0", "CLIENT_ERROR cannot increment or decrement non-numeric value", "NOT_FOUND", "STORED", "1")
+
+	send("delete n", "delete n", "touch a 100", "touch nope 1", "set gone 0 -1 1", "x", "get gone", "set q 0 0 1 noreply", "q", "get q")
+	expect("DELETED", "NOT_FOUND", "TOUCHED", "NOT_FOUND", "STORED", "END", "VALUE q 0 1", "q", "END")
+	if node := srv.mgr.GetCache("mc").GetNode(Hash[uint64]([]byte("a"))); node == nil {
+		t.Fatal("Expected a to be present")
+	}
+
+	// A data block with the wrong length is rejected
+	send("set bad 0 0 2", "toolong")
+	expect("CLIENT_ERROR bad data chunk", "ERROR")
+
+	// Items are shared with the other protocols
+	if got, _ := run(t, srv, "GET mc q"); got != "q" {
+		t.Errorf("Expected memcached writes in the cache, got %q", got)
+	}
+
+	send("stats")
+	stats := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Reading stats: %v", err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		fields := strings.Fields(line)
+		stats[fields[1]] = fields[2]
+	}
+	for name, want := range map[string]string{"get_hits": "4", "get_misses": "2", "cas_badval": "2", "curr_connections": "1", "version": serverVersion} {
+		if stats[name] != want {
+			t.Errorf("Expected STAT %s %s, got %q", name, want, stats[name])
+		}
+	}
+
+	// Flags are kept apart from the tags and survive DUMP and RESTORE
+	if got, _ := run(t, srv, "INVALIDATE mc mcflags=0"); got != "0" {
+		t.Errorf("Expected no entries tagged by their flags, got %q", got)
+	}
+	dump, _ := run(t, srv, "DUMP mc")
+	hashed := fmt.Sprint(Hash[uint64]([]byte("a")))
+	var entry string
+	for _, line := range strings.Split(dump, "\n") {
+		if strings.HasPrefix(line, hashed+" ") {
+			entry = line
+		}
+	}
+	if fields := strings.Fields(entry); len(fields) != 5 || fields[2] != "-" || fields[4] != "5" {
+		t.Fatalf("Expected a untagged with flags 5 in DUMP, got %q", entry)
+	}
+	run(t, srv, "DELRAW mc "+hashed)
+	if _, err := run(t, srv, "RESTORE mc "+entry); err != nil {
+		t.Fatalf("RESTORE error = %v", err)
+	}
+	send("get a")
+	expect("VALUE a 5 7", "x", "y z\x00", "END")
+
+	// A read-only cache refuses every change
+	run(t, srv, "CONFIG SET mc readonly true")
+	send("delete q", "incr b 1", "touch a 1", "flush_all", "get q")
+	readOnly := "SERVER_ERROR " + src.ErrReadOnly.Error()
+	expect(readOnly, readOnly, readOnly, readOnly, "VALUE q 0 1", "q", "END")
+	run(t, srv, "CONFIG SET mc readonly false")
+
+	send("flush_all", "get a", "version", "bogus", "quit")
+	expect("OK", "END", "VERSION "+serverVersion, "ERROR")
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected quit to close the connection, got %v", err)
+	}
+}
+
+func TestMemcachedACL(t *testing.T) {
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	defer srv.Close()
+	srv.SetACL(testACL(t))
+	srv.mgr.CreateCache("sessions", 16, src.CacheOptions{})
+	srv.mgr.CreateCache("mc", 16, src.CacheOptions{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer listener.Close()
+	go ServeMemcached(listener, srv, "sessions")
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer other.Close()
+	go ServeMemcached(other, srv, "mc")
+
+	session := func(addr string) (func(...string), func(...string)) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		send := func(lines ...string) {
+			conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+		}
+		expect := func(want ...string) {
+			t.Helper()
+			for _, line := range want {
+				got, err := reader.ReadString('\n')
+				if err != nil || got != line+"\r\n" {
+					t.Fatalf("Expected %q, got %q, %v", line, got, err)
+				}
+			}
+		}
+		return send, expect
+	}
+
+	send, expect := session(listener.Addr().String())
+	send("get a", "delete a", "flush_all", "add a 0 0 1", "x", "set auth 0 0 15", "alice wrongpass", "get a")
+	expect("CLIENT_ERROR unauthenticated", "CLIENT_ERROR unauthenticated", "CLIENT_ERROR unauthenticated",
+		"CLIENT_ERROR unauthenticated", "CLIENT_ERROR authentication failure", "CLIENT_ERROR unauthenticated")
+	send("set auth 0 0 16", "alice wonderland", "set a 0 0 1", "x", "get a")
+	expect("STORED", "STORED", "VALUE a 0 1", "x", "END")
+
+	// alice has no access to the cache of the other listener
+	send, expect = session(other.Addr().String())
+	send("set auth 0 0 16", "alice wonderland", "get a", "flush_all")
+	expect("STORED",
+		"SERVER_ERROR NOPERM user alice has no read access to cache mc",
+		"SERVER_ERROR NOPERM user alice has no write access to cache mc")
+}
+
+func TestMemcachedRateLimits(t *testing.T) {
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	defer srv.Close()
+	srv.SetLimits(Limits{Commands: 3, Keys: 1}, Limits{})
+	run(t, srv, "CREATE mc 16")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer listener.Close()
+	go ServeMemcached(listener, srv, "mc")
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("set a 0 0 1\r\nx\r\nset b 0 0 1\r\ny\r\nget a b\r\nget a\r\nget a\r\n"))
+	for _, want := range []string{
+		"STORED",
+		"SERVER_ERROR RATELIMIT quota of 1 new keys in cache mc reached for connection",
+		"VALUE a 0 1", "x", "END",
+		"VALUE a 0 1", "x", "END",
+		"SERVER_ERROR RATELIMIT commands per second exceeded for connection",
+	} {
+		line, err := reader.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, want) {
+			t.Fatalf("Expected %q, got %q, %v", want, line, err)
+		}
+	}
+	info, _ := run(t, srv, "INFO limits")
+	for _, want := range []string{"throttled_commands:1", "throttled_keys:1"} {
+		if !strings.Contains(info, want) {
+			t.Errorf("Expected %q in INFO limits, got %q", want, info)
+		}
+	}
+}
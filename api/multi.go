@@ -0,0 +1,266 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"lrue/src"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrExecAbort is returned by EXEC when a command failed to queue
+	ErrExecAbort = errors.New("EXECABORT transaction discarded because of previous errors")
+	// ErrWatchChanged is returned by EXEC when a watched key changed
+	ErrWatchChanged = errors.New("EXECABORT watched key changed")
+)
+
+// session is the per-connection state of a client: who it is, the commands
+// queued by MULTI and the keys watched for the next EXEC
+type session[U, K src.Uints, V ~[]byte] struct {
+	srv      *Server[U, K, V]
+	identity string   // subject of the client certificate on TLS connections
+	user     *User    // nil until the client authenticates
+	limiter  *limiter // nil for clients without rate limits
+	multi    bool
+	failed   bool
+	queue    []*Command[K, V]
+	watches  []*src.Watch[U, K, V]
+}
+
+func (s *Server[U, K, V]) newSession() *session[U, K, V] {
+	return &session[U, K, V]{srv: s, limiter: newLimiter()}
+}
+
+// setIdentity records the verified certificate subject of the client, which
+// authenticates it as the user of that name
+func (s *session[U, K, V]) setIdentity(identity string) {
+	s.identity = identity
+	if acl := s.srv.acl.Load(); acl != nil && identity != "" {
+		s.user = acl.lookup(identity)
+	}
+}
+
+// authorize checks that the session's user may run cmd
+func (s *session[U, K, V]) authorize(cmd *Command[K, V]) error {
+	return authorize(s.srv.acl.Load(), s.user, cmd)
+}
+
+// limit charges cmd to the rate limits of the connection and of its user
+func (s *session[U, K, V]) limit(cmd *Command[K, V]) error {
+	if s.limiter == nil {
+		return nil
+	}
+	limits := s.srv.limits
+	return limits.allow(s.limiter, s.user, commandCost(limits, s.srv.mgr, cmd))
+}
+
+// readLimit is the most a client may send in one command before it
+// authenticates against the ACL, the command line limit, or 0 once it may send
+// as much as the protocol allows
+func (s *session[U, K, V]) readLimit() int {
+	if s.user != nil || s.srv.acl.Load() == nil {
+		return 0
+	}
+	return int(s.srv.maxCommand.Load())
+}
+
+// Execute runs a command for the connection, queueing it while a MULTI is open
+func (s *session[U, K, V]) Execute(cmd *Command[K, V]) (string, error) {
+	err := s.authorize(cmd)
+	if err == nil {
+		err = s.limit(cmd)
+	}
+	if err != nil {
+		if s.multi {
+			s.failed = true
+		}
+		return "", err
+	}
+	switch cmd.operation {
+	case Cmd_AUTH:
+		acl := s.srv.acl.Load()
+		if acl == nil {
+			return "", fmt.Errorf("AUTH called without any users configured")
+		}
+		user, err := acl.authenticateCached(cmd.option, string(cmd.value), time.Now())
+		if err != nil {
+			return "", err
+		}
+		s.user = user
+		return "OK", nil
+	case Cmd_ACL:
+		acl := s.srv.acl.Load()
+		if cmd.sub == Cmd_WHOAMI {
+			if s.user == nil {
+				return "default", nil
+			}
+			return s.user.Name, nil
+		}
+		if acl == nil {
+			return "No users", nil
+		}
+		return acl.list(), nil
+	case Cmd_MULTI:
+		if s.multi {
+			return "", fmt.Errorf("MULTI calls can not be nested")
+		}
+		s.multi = true
+		return "OK", nil
+	case Cmd_EXEC:
+		if !s.multi {
+			return "", fmt.Errorf("EXEC without MULTI")
+		}
+		return s.exec()
+	case Cmd_DISCARD:
+		if !s.multi {
+			return "", fmt.Errorf("DISCARD without MULTI")
+		}
+		s.reset()
+		return "OK", nil
+	case Cmd_WATCH:
+		if s.multi {
+			return "", fmt.Errorf("WATCH inside MULTI is not allowed")
+		}
+		for _, key := range cmd.keys {
+			s.watches = append(s.watches, s.srv.mgr.Watch(cmd.mapTitle, key))
+		}
+		return "OK", nil
+	case Cmd_UNWATCH:
+		s.unwatch()
+		return "OK", nil
+	}
+	if !s.multi {
+		return s.srv.Execute(cmd)
+	}
+
+	switch cmd.operation {
+	case Cmd_SET, Cmd_GET, Cmd_DEL, Cmd_CLEAR, Cmd_INVALIDATE:
+	default:
+		s.failed = true
+		return "", fmt.Errorf("%s is not allowed in MULTI", cmd.operation)
+	}
+	if cmd.writes() && s.srv.repl.following.Load() {
+		s.failed = true
+		return "", ErrReplicaReadOnly
+	}
+	s.queue = append(s.queue, cmd)
+	return "QUEUED", nil
+}
+
+// exec runs the queued commands with every cache they or the watches touch
+// locked, and returns their replies as one numbered batch
+func (s *session[U, K, V]) exec() (string, error) {
+	defer s.reset()
+	if s.failed {
+		return "", ErrExecAbort
+	}
+	var titles []string
+	for _, w := range s.watches {
+		titles = append(titles, w.Title())
+	}
+	for _, cmd := range s.queue {
+		titles = append(titles, cmd.mapTitle)
+	}
+
+	replies := make([]string, len(s.queue))
+	err := s.srv.mgr.Update(titles, func(tx *src.Tx[U, K, V]) error {
+		for _, w := range s.watches {
+			if tx.Changed(w) {
+				return ErrWatchChanged
+			}
+		}
+		for i, cmd := range s.queue {
+			result, err := executeTx(tx, cmd)
+			if err != nil {
+				result = "ERR " + err.Error()
+			}
+			replies[i] = fmt.Sprintf("%d) %s", i+1, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(replies) == 0 {
+		return "(empty)", nil
+	}
+	return strings.Join(replies, "\n"), nil
+}
+
+// executeTx runs one queued command on the locked caches
+func executeTx[U, K src.Uints, V ~[]byte](tx *src.Tx[U, K, V], cmd *Command[K, V]) (string, error) {
+	notFound := func(err error) error {
+		return fmt.Errorf("%w: %s", err, cmd.mapTitle)
+	}
+	switch cmd.operation {
+	case Cmd_SET:
+		if err := tx.CheckWrite(cmd.mapTitle, cmd.keySize, len(cmd.value)); err != nil {
+			return "", notFound(err)
+		}
+		if err := tx.Put(cmd.mapTitle, cmd.key, cmd.value, cmd.tags...); err != nil {
+			return "", notFound(err)
+		}
+		return "OK", nil
+	case Cmd_GET:
+		value, ok, err := tx.Get(cmd.mapTitle, cmd.key)
+		if err != nil {
+			return "", notFound(err)
+		}
+		if !ok || value == nil {
+			return "", src.ErrKeyNotFound
+		}
+		return string(value), nil
+	case Cmd_DEL:
+		if _, err := tx.Eject(cmd.mapTitle, cmd.key); err != nil {
+			return "", notFound(err)
+		}
+		return "OK", nil
+	case Cmd_CLEAR:
+		if err := tx.Clear(cmd.mapTitle); err != nil {
+			return "", notFound(err)
+		}
+		return "OK", nil
+	case Cmd_INVALIDATE:
+		n, err := tx.InvalidateTag(cmd.mapTitle, cmd.tags[0])
+		if err != nil {
+			return "", notFound(err)
+		}
+		return strconv.Itoa(n), nil
+	case Cmd_RESTORE:
+		// Entries that expired while in transit are dropped
+		if cmd.expiresAt != 0 && cmd.expiresAt <= time.Now().UnixNano() {
+			return "OK", nil
+		}
+		entry := src.Entry[K, V]{Key: cmd.key, Value: V(cmd.value), Tags: cmd.tags, ExpiresAt: cmd.expiresAt, Flags: cmd.flags}
+		if err := tx.Restore(cmd.mapTitle, entry); err != nil {
+			return "", notFound(err)
+		}
+		return "OK", nil
+	case Cmd_DELRAW:
+		if _, err := tx.Eject(cmd.mapTitle, cmd.key); err != nil {
+			return "", notFound(err)
+		}
+		return "OK", nil
+	}
+	return "", fmt.Errorf("unhandled command: %s", cmd.operation)
+}
+
+// reset ends the transaction and drops the watches, as EXEC and DISCARD do
+func (s *session[U, K, V]) reset() {
+	s.multi, s.failed, s.queue = false, false, nil
+	s.unwatch()
+}
+
+func (s *session[U, K, V]) unwatch() {
+	for _, w := range s.watches {
+		w.Close()
+	}
+	s.watches = nil
+}
+
+// close releases the session's watches when its connection ends
+func (s *session[U, K, V]) close() {
+	s.reset()
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"lrue/src"
+	"sync"
+	"testing"
+)
+
+func exec(t *testing.T, sess *session[uint8, uint64, []byte], line string) (string, error) {
+	t.Helper()
+	cmd, err := Parse[uint64, []byte]([]byte(line))
+	if err != nil {
+		t.Fatalf("Parse(%q) error = %v", line, err)
+	}
+	return sess.Execute(cmd)
+}
+
+func TestMulti(t *testing.T) {
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	defer srv.Close()
+	run(t, srv, "CREATE users 8")
+	run(t, srv, "CREATE index 8")
+	sess, other := srv.newSession(), srv.newSession()
+	defer sess.close()
+	defer other.close()
+
+	t.Run("Exec", func(t *testing.T) {
+		steps := []struct{ line, want string }{
+			{"MULTI", "OK"},
+			{"SET users alice 1", "QUEUED"},
+			{"SET index 1 alice", "QUEUED"},
+			{"GET users alice", "QUEUED"},
+			{"GET users bob", "QUEUED"},
+		}
+		for _, step := range steps {
+			if got, err := exec(t, sess, step.line); err != nil || got != step.want {
+				t.Fatalf("%s = %q, %v, want %q", step.line, got, err, step.want)
+			}
+		}
+		if got, _ := run(t, srv, "GET users alice"); got != "" {
+			t.Errorf("Expected queued commands not to run before EXEC, got %q", got)
+		}
+		want := "1) OK\n2) OK\n3) 1\n4) ERR key not found"
+		if got, err := exec(t, sess, "EXEC"); err != nil || got != want {
+			t.Errorf("EXEC = %q, %v, want %q", got, err, want)
+		}
+		if got, _ := run(t, srv, "GET index 1"); got != "alice" {
+			t.Errorf("Expected EXEC to apply the writes, got %q", got)
+		}
+	})
+
+	t.Run("Discard", func(t *testing.T) {
+		exec(t, sess, "MULTI")
+		exec(t, sess, "SET users carol 3")
+		if got, err := exec(t, sess, "DISCARD"); err != nil || got != "OK" {
+			t.Fatalf("DISCARD = %q, %v", got, err)
+		}
+		if _, err := run(t, srv, "GET users carol"); err == nil {
+			t.Errorf("Expected DISCARD to drop the queued SET")
+		}
+		if _, err := exec(t, sess, "EXEC"); err == nil {
+			t.Errorf("Expected EXEC without MULTI to fail")
+		}
+	})
+
+	t.Run("QueueError", func(t *testing.T) {
+		exec(t, sess, "MULTI")
+		exec(t, sess, "SET users dave 4")
+		if _, err := exec(t, sess, "CREATE more 8"); err == nil {
+			t.Errorf("Expected CREATE to be refused inside MULTI")
+		}
+		if _, err := exec(t, sess, "EXEC"); !errors.Is(err, ErrExecAbort) {
+			t.Errorf("Expected ErrExecAbort, got %v", err)
+		}
+		if _, err := run(t, srv, "GET users dave"); err == nil {
+			t.Errorf("Expected the aborted transaction not to apply")
+		}
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		exec(t, sess, "WATCH users alice")
+		exec(t, other, "SET users alice 2")
+		exec(t, sess, "MULTI")
+		exec(t, sess, "SET users alice 10")
+		if _, err := exec(t, sess, "EXEC"); !errors.Is(err, ErrWatchChanged) {
+			t.Errorf("Expected ErrWatchChanged, got %v", err)
+		}
+		if got, _ := run(t, srv, "GET users alice"); got != "2" {
+			t.Errorf("Expected the other client's write to stand, got %q", got)
+		}
+
+		// EXEC drops the watches, so the retry succeeds
+		exec(t, sess, "WATCH users alice")
+		exec(t, other, "SET users bob 5")
+		exec(t, sess, "MULTI")
+		exec(t, sess, "SET users alice 10")
+		if got, err := exec(t, sess, "EXEC"); err != nil || got != "1) OK" {
+			t.Errorf("Expected EXEC to succeed when the watched key is untouched, got %q, %v", got, err)
+		}
+
+		for _, change := range []string{"DEL users alice", "CLEAR users", "DESTROY users"} {
+			exec(t, sess, "WATCH users alice")
+			exec(t, other, change)
+			exec(t, sess, "MULTI")
+			if _, err := exec(t, sess, "EXEC"); !errors.Is(err, ErrWatchChanged) {
+				t.Errorf("Expected %s to abort the transaction, got %v", change, err)
+			}
+		}
+	})
+}
+
+func TestMultiAtomic(t *testing.T) {
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	defer srv.Close()
+	run(t, srv, "CREATE users 8")
+	run(t, srv, "CREATE index 8")
+
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess := srv.newSession()
+			defer sess.close()
+			for i := range 200 {
+				value := fmt.Sprintf("%d-%d", w, i)
+				exec(t, sess, "MULTI")
+				exec(t, sess, "SET users k "+value)
+				exec(t, sess, "SET index k "+value)
+				exec(t, sess, "EXEC")
+			}
+		}()
+	}
+	sess := srv.newSession()
+	defer sess.close()
+	for range 200 {
+		exec(t, sess, "MULTI")
+		exec(t, sess, "GET users k")
+		exec(t, sess, "GET index k")
+		got, err := exec(t, sess, "EXEC")
+		if err != nil {
+			t.Fatalf("EXEC error = %v", err)
+		}
+		var a, b string
+		fmt.Sscanf(got, "1) %s\n2) %s", &a, &b)
+		if a != b && a != "ERR" {
+			t.Fatalf("Expected both caches to change together, got %q", got)
+		}
+	}
+	wg.Wait()
+}
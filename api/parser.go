@@ -2,10 +2,13 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"lrue/src"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 	"unsafe"
 )
 
@@ -13,25 +16,76 @@ type Cmd string
 type Command[K src.Uints, V any] struct {
 	operation Cmd
 	mapTitle  string
-	mapKey    K
+	target    string
 	key       K
+	keySize   int
 	value     []byte
+	tags      []string
+	create    createMode
+	options   src.CacheOptions
+	sub       Cmd
+	option    string
+	expiresAt int64
+	flags     uint32
+	events    []src.EventKind
+	timeout   time.Duration
+	keys      []K
 }
 
+// createMode selects how CREATE treats an existing cache of the same name
+type createMode uint8
+
+const (
+	createNew createMode = iota
+	createIfNotExists
+	createReplace
+)
+
 const (
-	Cmd_CREATE    Cmd = "CREATE"
-	Cmd_DESTROY   Cmd = "DESTROY"
-	Cmd_LIST      Cmd = "LIST"
-	Cmd_SET       Cmd = "SET"
-	Cmd_GET       Cmd = "GET"
-	Cmd_DEL       Cmd = "DEL"
-	Cmd_PRINT     Cmd = "PRINT"
-	Cmd_CLEAR     Cmd = "CLEAR"
-	Cmd_CLEAR_ALL Cmd = "CLEAR_ALL"
-	Cmd_HELP      Cmd = "HELP"
+	Cmd_CREATE      Cmd = "CREATE"
+	Cmd_DESTROY     Cmd = "DESTROY"
+	Cmd_LIST        Cmd = "LIST"
+	Cmd_SET         Cmd = "SET"
+	Cmd_GET         Cmd = "GET"
+	Cmd_WAITGET     Cmd = "WAITGET"
+	Cmd_DEL         Cmd = "DEL"
+	Cmd_PRINT       Cmd = "PRINT"
+	Cmd_CLEAR       Cmd = "CLEAR"
+	Cmd_CLEAR_ALL   Cmd = "CLEAR_ALL"
+	Cmd_INVALIDATE  Cmd = "INVALIDATE"
+	Cmd_CONFIG      Cmd = "CONFIG"
+	Cmd_RENAME      Cmd = "RENAME"
+	Cmd_COPY        Cmd = "COPY"
+	Cmd_MOVE        Cmd = "MOVE"
+	Cmd_INFO        Cmd = "INFO"
+	Cmd_REPLICAOF   Cmd = "REPLICAOF"
+	Cmd_REPLSYNC    Cmd = "REPLSYNC"
+	Cmd_DUMP        Cmd = "DUMP"
+	Cmd_RESTORE     Cmd = "RESTORE"
+	Cmd_DELRAW      Cmd = "DELRAW"
+	Cmd_CLUSTER     Cmd = "CLUSTER"
+	Cmd_MEET        Cmd = "MEET"
+	Cmd_NODES       Cmd = "NODES"
+	Cmd_GOSSIP      Cmd = "GOSSIP"
+	Cmd_SUBSCRIBE   Cmd = "SUBSCRIBE"
+	Cmd_UNSUBSCRIBE Cmd = "UNSUBSCRIBE"
+	Cmd_MULTI       Cmd = "MULTI"
+	Cmd_EXEC        Cmd = "EXEC"
+	Cmd_DISCARD     Cmd = "DISCARD"
+	Cmd_WATCH       Cmd = "WATCH"
+	Cmd_UNWATCH     Cmd = "UNWATCH"
+	Cmd_BINARY      Cmd = "BINARY"
+	Cmd_AUTH        Cmd = "AUTH"
+	Cmd_ACL         Cmd = "ACL"
+	Cmd_WHOAMI      Cmd = "WHOAMI"
+	Cmd_CLIENT      Cmd = "CLIENT"
+	Cmd_KILL        Cmd = "KILL"
+	Cmd_HELP        Cmd = "HELP"
 )
 
-func hash[K src.Uints](data []byte) K {
+// Hash maps a key to the number a cache stores it under. Cluster clients use
+// it to place keys exactly where DUMP reports them.
+func Hash[K src.Uints](data []byte) K {
 	var result K
 	for i, b := range data {
 		// Simple but effective hash mixing
@@ -60,7 +114,12 @@ func splitBytes(input []byte) [][]byte {
 }
 
 func Parse[K src.Uints, V any](input []byte) (*Command[K, V], error) {
-	args := splitBytes(input)
+	return parseArgs[K, V](splitBytes(input))
+}
+
+// parseArgs builds a command from its arguments, which RESP clients send
+// already split so that they may hold spaces and newlines
+func parseArgs[K src.Uints, V any](args [][]byte) (*Command[K, V], error) {
 	if len(args) == 0 {
 		return nil, fmt.Errorf("empty command")
 	}
@@ -70,39 +129,245 @@ func Parse[K src.Uints, V any](input []byte) (*Command[K, V], error) {
 
 	switch cmd.operation {
 	case Cmd_CREATE:
-		if len(args) != 3 {
-			return nil, fmt.Errorf("usage: CREATE <cache_name> <capacity>")
+		if len(args) < 3 {
+			return nil, fmt.Errorf("usage: CREATE <cache_name> <capacity> [IFNOTEXISTS|REPLACE] [option=value ...]")
 		}
 		cmd.mapTitle = string(args[1])
-		cmd.mapKey = hash[K](args[1])
 		cmd.value = []byte(args[2])
+		for i, arg := range args[3:] {
+			if name, value, ok := strings.Cut(string(arg), "="); ok {
+				if err := cmd.options.Set(name, value); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			switch strings.ToUpper(string(arg)) {
+			case "IFNOTEXISTS":
+				cmd.create = createIfNotExists
+			case "REPLACE":
+				cmd.create = createReplace
+			default:
+				return nil, fmt.Errorf("unknown CREATE option: %s", arg)
+			}
+			if i != 0 {
+				return nil, fmt.Errorf("%s must come before option=value pairs", arg)
+			}
+		}
+
+	case Cmd_CONFIG:
+		if len(args) < 3 {
+			return nil, fmt.Errorf("usage: CONFIG GET|SET [cache_name] <option> [value]")
+		}
+		cmd.sub = Cmd(strings.ToUpper(string(args[1])))
+		switch {
+		case cmd.sub == Cmd_GET && len(args) == 3, cmd.sub == Cmd_SET && len(args) == 4:
+			// Server options have no cache name
+			cmd.option = strings.ToLower(string(args[2]))
+			if cmd.sub == Cmd_SET {
+				cmd.value = args[3]
+			}
+		case cmd.sub == Cmd_GET && len(args) == 4:
+			cmd.mapTitle = string(args[2])
+			cmd.option = strings.ToLower(string(args[3]))
+		case cmd.sub == Cmd_SET && len(args) >= 5:
+			cmd.mapTitle = string(args[2])
+			cmd.option = strings.ToLower(string(args[3]))
+			cmd.value = bytes.Join(args[4:], []byte(" "))
+		default:
+			return nil, fmt.Errorf("usage: CONFIG GET [cache_name] <option> | CONFIG SET [cache_name] <option> <value>")
+		}
+
+	case Cmd_DESTROY:
+		if len(args) != 2 {
+			return nil, fmt.Errorf("usage: DESTROY <cache_name>")
+		}
+		cmd.mapTitle = string(args[1])
 
 	case Cmd_LIST:
 		if len(args) != 1 {
 			return nil, fmt.Errorf("usage: LIST")
 		}
 
-	case Cmd_SET, Cmd_GET, Cmd_DEL, Cmd_PRINT, Cmd_CLEAR:
+	case Cmd_RENAME, Cmd_COPY, Cmd_MOVE:
+		switch {
+		case cmd.operation == Cmd_RENAME && len(args) != 3:
+			return nil, fmt.Errorf("usage: RENAME <cache_name> <new_name>")
+		case cmd.operation == Cmd_COPY && len(args) != 3 && len(args) != 4:
+			return nil, fmt.Errorf("usage: COPY <source_cache> <target_cache> [capacity]")
+		case cmd.operation == Cmd_MOVE && len(args) != 4:
+			return nil, fmt.Errorf("usage: MOVE <source_cache> <target_cache> <key>")
+		}
+		cmd.mapTitle = string(args[1])
+		cmd.target = string(args[2])
+		if cmd.operation == Cmd_COPY && len(args) == 4 {
+			cmd.value = []byte(args[3])
+		}
+		if cmd.operation == Cmd_MOVE {
+			cmd.key = Hash[K](args[3])
+			cmd.keySize = len(args[3])
+		}
+
+	case Cmd_SET, Cmd_GET, Cmd_DEL, Cmd_PRINT, Cmd_CLEAR, Cmd_INVALIDATE, Cmd_DUMP, Cmd_RESTORE, Cmd_DELRAW:
 		if len(args) < 2 {
 			return nil, fmt.Errorf("usage: %s <cache_name> [args...]", cmd.operation)
 		}
-		cmd.mapKey = hash[K](args[1])
+		cmd.mapTitle = string(args[1])
 
 		switch cmd.operation {
 		case Cmd_SET:
 			if len(args) < 4 {
 				return nil, fmt.Errorf("usage: SET <cache_name> <key> <value>")
 			}
-			cmd.key = hash[K](args[2])
-			cmd.value = bytes.Join(args[3:], []byte(" "))
+			cmd.key = Hash[K](args[2])
+			cmd.keySize = len(args[2])
+			valueArgs := args[3:]
+			if n := len(valueArgs); n >= 3 && strings.EqualFold(string(valueArgs[n-2]), "TAGS") {
+				cmd.tags = strings.Split(string(valueArgs[n-1]), ",")
+				valueArgs = valueArgs[:n-2]
+			}
+			cmd.value = bytes.Join(valueArgs, []byte(" "))
+		case Cmd_INVALIDATE:
+			if len(args) != 3 {
+				return nil, fmt.Errorf("usage: INVALIDATE <cache_name> <tag>")
+			}
+			cmd.tags = []string{string(args[2])}
 		case Cmd_GET, Cmd_DEL:
 			if len(args) != 3 {
 				return nil, fmt.Errorf("usage: %s <cache_name> <key>", cmd.operation)
 			}
-			cmd.key = hash[K](args[2])
+			cmd.key = Hash[K](args[2])
+		case Cmd_DUMP:
+			if len(args) != 2 {
+				return nil, fmt.Errorf("usage: DUMP <cache_name>")
+			}
+		case Cmd_RESTORE:
+			if len(args) != 6 && len(args) != 7 {
+				return nil, fmt.Errorf("usage: RESTORE <cache_name> <hashed_key> <expires_at> <tags|-> <base64_value|-> [flags]")
+			}
+			if err := parseRestore(cmd, args[2:]); err != nil {
+				return nil, err
+			}
+		case Cmd_DELRAW:
+			if len(args) != 3 {
+				return nil, fmt.Errorf("usage: DELRAW <cache_name> <hashed_key>")
+			}
+			key, err := parseHashedKey[K](args[2])
+			if err != nil {
+				return nil, err
+			}
+			cmd.key = key
 		}
 
-	case Cmd_HELP, Cmd_CLEAR_ALL:
+	case Cmd_INFO:
+		if len(args) > 2 {
+			return nil, fmt.Errorf("usage: INFO [section]")
+		}
+		if len(args) == 2 {
+			cmd.option = string(args[1])
+		}
+
+	case Cmd_REPLICAOF:
+		if len(args) != 3 {
+			return nil, fmt.Errorf("usage: REPLICAOF <host> <port> | REPLICAOF NO ONE")
+		}
+		if strings.EqualFold(string(args[1]), "NO") && strings.EqualFold(strings.TrimSpace(string(args[2])), "ONE") {
+			break
+		}
+		addr, err := parseHostPort(args[1], args[2])
+		if err != nil {
+			return nil, err
+		}
+		cmd.target = addr
+
+	case Cmd_CLUSTER:
+		if len(args) >= 2 {
+			cmd.sub = Cmd(strings.ToUpper(strings.TrimSpace(string(args[1]))))
+		}
+		switch {
+		case cmd.sub == Cmd_MEET && len(args) == 4:
+			addr, err := parseHostPort(args[2], args[3])
+			if err != nil {
+				return nil, err
+			}
+			cmd.target = addr
+		case (cmd.sub == Cmd_NODES || cmd.sub == Cmd_INFO || cmd.sub == Cmd_GOSSIP) && len(args) == 2:
+		default:
+			return nil, fmt.Errorf("usage: CLUSTER MEET <host> <port> | CLUSTER NODES | CLUSTER INFO")
+		}
+
+	case Cmd_AUTH:
+		if len(args) != 3 {
+			return nil, fmt.Errorf("usage: AUTH <user> <password>")
+		}
+		cmd.option = string(args[1])
+		cmd.value = args[2]
+
+	case Cmd_ACL:
+		if len(args) == 2 {
+			cmd.sub = Cmd(strings.ToUpper(string(args[1])))
+		}
+		if cmd.sub != Cmd_LIST && cmd.sub != Cmd_WHOAMI {
+			return nil, fmt.Errorf("usage: ACL LIST | ACL WHOAMI")
+		}
+
+	case Cmd_CLIENT:
+		if len(args) >= 2 {
+			cmd.sub = Cmd(strings.ToUpper(string(args[1])))
+		}
+		switch {
+		case cmd.sub == Cmd_LIST && len(args) == 2:
+		case cmd.sub == Cmd_KILL && len(args) == 3:
+			cmd.target = string(args[2])
+		default:
+			return nil, fmt.Errorf("usage: CLIENT LIST | CLIENT KILL <id|addr>")
+		}
+
+	case Cmd_REPLSYNC:
+		if len(args) != 3 {
+			return nil, fmt.Errorf("usage: REPLSYNC <replication_id> <offset>")
+		}
+		cmd.option = string(args[1])
+		cmd.value = bytes.TrimSpace(args[2])
+		if _, err := strconv.ParseUint(string(cmd.value), 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid offset: %s", cmd.value)
+		}
+
+	case Cmd_WAITGET:
+		if len(args) != 4 {
+			return nil, fmt.Errorf("usage: WAITGET <cache_name> <key> <timeout>")
+		}
+		cmd.mapTitle = string(args[1])
+		cmd.key = Hash[K](args[2])
+		timeout, err := parseTimeout(strings.TrimSpace(string(args[3])))
+		if err != nil {
+			return nil, err
+		}
+		cmd.timeout = timeout
+
+	case Cmd_SUBSCRIBE:
+		if len(args) != 2 && len(args) != 3 {
+			return nil, fmt.Errorf("usage: SUBSCRIBE <cache_name> [event1,event2,...]")
+		}
+		cmd.mapTitle = strings.TrimSpace(string(args[1]))
+		cmd.events = subscribeKinds
+		if len(args) == 3 {
+			kinds, err := parseEventKinds(strings.TrimSpace(string(args[2])))
+			if err != nil {
+				return nil, err
+			}
+			cmd.events = kinds
+		}
+
+	case Cmd_WATCH:
+		if len(args) < 3 {
+			return nil, fmt.Errorf("usage: WATCH <cache_name> <key> [key ...]")
+		}
+		cmd.mapTitle = string(args[1])
+		for _, key := range args[2:] {
+			cmd.keys = append(cmd.keys, Hash[K](bytes.TrimSpace(key)))
+		}
+
+	case Cmd_HELP, Cmd_CLEAR_ALL, Cmd_UNSUBSCRIBE, Cmd_MULTI, Cmd_EXEC, Cmd_DISCARD, Cmd_UNWATCH, Cmd_BINARY:
 		// No arguments
 
 	default:
@@ -112,23 +377,98 @@ func Parse[K src.Uints, V any](input []byte) (*Command[K, V], error) {
 	return cmd, nil
 }
 
+// parseHostPort validates a port and joins it with host
+func parseHostPort(host, port []byte) (string, error) {
+	p := strings.TrimSpace(string(port))
+	if n, err := strconv.ParseUint(p, 10, 16); err != nil || n == 0 {
+		return "", fmt.Errorf("invalid port: %s", p)
+	}
+	return net.JoinHostPort(string(host), p), nil
+}
+
+// parseTimeout reads a timeout in seconds, possibly fractional, or as a Go duration
+func parseTimeout(value string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(value, 64); err == nil && secs >= 0 {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	if timeout, err := time.ParseDuration(value); err == nil && timeout >= 0 {
+		return timeout, nil
+	}
+	return 0, fmt.Errorf("invalid timeout: %s", value)
+}
+
+// writes reports whether the command changes cache contents or the set of caches
+func (c *Command[K, V]) writes() bool {
+	switch c.operation {
+	case Cmd_CREATE, Cmd_DESTROY, Cmd_RENAME, Cmd_COPY, Cmd_MOVE,
+		Cmd_SET, Cmd_DEL, Cmd_CLEAR, Cmd_CLEAR_ALL, Cmd_INVALIDATE, Cmd_RESTORE, Cmd_DELRAW:
+		return true
+	case Cmd_CONFIG:
+		return c.sub == Cmd_SET && c.mapTitle != ""
+	}
+	return false
+}
+
 func Execute[U src.Uints, K src.Uints, V ~[]byte](cm *src.CacheManager[U, K, V], cmd *Command[K, V]) (string, error) {
 	switch cmd.operation {
 	case Cmd_CREATE:
-		capacity, err := strconv.ParseUint(string(cmd.value), 10, 8)
-		if err != nil {
+		capacity, err := strconv.ParseUint(string(cmd.value), 10, int(unsafe.Sizeof(U(0))*8))
+		if err != nil || capacity == 0 {
 			return "", fmt.Errorf("invalid capacity: %s", cmd.value)
 		}
-		cm.CreateCache(cmd.mapTitle, cmd.mapKey, U(capacity))
+		switch cmd.create {
+		case createIfNotExists:
+			cache, _, err := cm.CreateIfAbsent(cmd.mapTitle, U(capacity), cmd.options)
+			if err != nil {
+				return "", err
+			}
+			cache.Release()
+		case createReplace:
+			if err := cm.ReplaceCache(cmd.mapTitle, U(capacity), cmd.options); err != nil {
+				return "", err
+			}
+		default:
+			if err := cm.CreateCache(cmd.mapTitle, U(capacity), cmd.options); err != nil {
+				return "", fmt.Errorf("%w: %s", err, cmd.mapTitle)
+			}
+		}
 		return "OK", nil
 
 	case Cmd_DESTROY:
-		if cache := cm.GetCache(cmd.mapKey); cache == nil {
-			return "", fmt.Errorf("cache not found: %s", cmd.mapTitle)
+		if err := cm.DestroyCache(cmd.mapTitle); err != nil {
+			return "", fmt.Errorf("%w: %s", err, cmd.mapTitle)
+		}
+		return "OK", nil
+
+	case Cmd_RENAME:
+		if err := cm.RenameCache(cmd.mapTitle, cmd.target); err != nil {
+			return "", err
+		}
+		return "OK", nil
+
+	case Cmd_COPY:
+		var capacity uint64
+		if cmd.value != nil {
+			var err error
+			capacity, err = strconv.ParseUint(string(cmd.value), 10, int(unsafe.Sizeof(U(0))*8))
+			if err != nil || capacity == 0 {
+				return "", fmt.Errorf("invalid capacity: %s", cmd.value)
+			}
+		}
+		if err := cm.CopyCache(cmd.mapTitle, cmd.target, U(capacity)); err != nil {
+			return "", err
 		}
-		cm.DestroyCache(cmd.mapKey)
 		return "OK", nil
 
+	case Cmd_MOVE:
+		if err := cm.MoveKey(cmd.mapTitle, cmd.target, cmd.key, cmd.keySize); err != nil {
+			return "", err
+		}
+		return "OK", nil
+
+	case Cmd_WAITGET:
+		return waitGet(context.Background(), cm, cmd)
+
 	case Cmd_LIST:
 		names := cm.ListCaches()
 		if len(names) == 0 {
@@ -136,46 +476,91 @@ func Execute[U src.Uints, K src.Uints, V ~[]byte](cm *src.CacheManager[U, K, V],
 		}
 		return strings.Join(names, "\n"), nil
 
-	case Cmd_SET, Cmd_GET, Cmd_DEL, Cmd_PRINT, Cmd_CLEAR:
-		cache := cm.GetCache(cmd.mapKey)
+	case Cmd_SET, Cmd_DEL, Cmd_CLEAR, Cmd_INVALIDATE, Cmd_RESTORE, Cmd_DELRAW:
+		// Writes run as one-command transactions, so read-only caches refuse them
+		var result string
+		err := cm.Update([]string{cmd.mapTitle}, func(tx *src.Tx[U, K, V]) (err error) {
+			result, err = executeTx(tx, cmd)
+			return err
+		})
+		return result, err
+
+	case Cmd_GET, Cmd_PRINT, Cmd_CONFIG, Cmd_DUMP:
+		cache := cm.GetCache(cmd.mapTitle)
 		if cache == nil {
-			return "", fmt.Errorf("cache not found: %s", cmd.mapTitle)
+			return "", fmt.Errorf("%w: %s", src.ErrCacheNotFound, cmd.mapTitle)
 		}
+		defer cache.Release()
 
 		switch cmd.operation {
-		case Cmd_SET:
-			cache.Put(cmd.key, cmd.value)
-			return "OK", nil
 		case Cmd_GET:
 			if value := cache.Get(cmd.key); value != nil {
 				return string(value), nil
 			}
-			return "", fmt.Errorf("key not found")
-		case Cmd_DEL:
-			cache.Eject(cmd.key)
-			return "OK", nil
+			return "", src.ErrKeyNotFound
 		case Cmd_PRINT:
 			return cache.Print(), nil
-		case Cmd_CLEAR:
-			cache.Clear()
+		case Cmd_CONFIG:
+			if cmd.sub == Cmd_GET {
+				return cache.Option(cmd.option)
+			}
+			if err := cache.SetOption(cmd.option, string(cmd.value)); err != nil {
+				return "", err
+			}
 			return "OK", nil
+		case Cmd_DUMP:
+			return dumpCache(cache), nil
 		}
 
 	case Cmd_CLEAR_ALL:
 		cm.ClearAllCaches()
 		return "OK", nil
 
+	case Cmd_INFO:
+		return infoSections(cm, cmd.option)
+
 	case Cmd_HELP:
 		return `Available commands:
-CREATE <cache_name> <capacity>
+CREATE <cache_name> <capacity> [IFNOTEXISTS|REPLACE] [option=value ...]
 DESTROY <cache_name>
+RENAME <cache_name> <new_name>
+COPY <source_cache> <target_cache> [capacity]
+MOVE <source_cache> <target_cache> <key>
 LIST
-SET <cache_name> <key> <value>
+SET <cache_name> <key> <value> [TAGS <tag1,tag2,...>]
 GET <cache_name> <key>
+WAITGET <cache_name> <key> <timeout>
 DEL <cache_name> <key>
 PRINT <cache_name>
 CLEAR <cache_name>
+INVALIDATE <cache_name> <tag>
+CONFIG GET <cache_name> <option>
+CONFIG SET <cache_name> <option> <value>
+CONFIG GET conn-limits|user-limits
+CONFIG SET conn-limits|user-limits commands=<n>,bytes=<n>,keys=<n>
+DUMP <cache_name>
+RESTORE <cache_name> <hashed_key> <expires_at> <tags|-> <base64_value|-> [flags]
+DELRAW <cache_name> <hashed_key>
 CLEAR_ALL
+INFO [memory|caches|replication|limits]
+REPLICAOF <host> <port>
+REPLICAOF NO ONE
+CLUSTER MEET <host> <port>
+CLUSTER NODES
+CLUSTER INFO
+SUBSCRIBE <cache_name> [set,del,expire,evict,clear]
+UNSUBSCRIBE
+MULTI
+EXEC
+DISCARD
+WATCH <cache_name> <key> [key ...]
+UNWATCH
+BINARY
+AUTH <user> <password>
+ACL LIST
+ACL WHOAMI
+CLIENT LIST
+CLIENT KILL <id|addr>
 QUIT`, nil
 	}
 
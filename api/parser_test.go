@@ -1,8 +1,10 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"lrue/src"
+	"strings"
 	"testing"
 )
 
@@ -19,18 +21,38 @@ func TestExecute(t *testing.T) {
 			cmd: &Command[uint64, []byte]{
 				operation: Cmd_CREATE,
 				mapTitle:  "test-cache",
-				mapKey:    hash[uint64]([]byte("test-cache")),
 				value:     []byte("5"),
 			},
 			want:    "OK",
 			wantErr: false,
 		},
+		{
+			name: "CREATE existing cache",
+			cmd: &Command[uint64, []byte]{
+				operation: Cmd_CREATE,
+				mapTitle:  "test-cache",
+				value:     []byte("5"),
+			},
+			want:    "",
+			wantErr: true,
+		},
+		{
+			name: "CREATE IFNOTEXISTS existing cache",
+			cmd: &Command[uint64, []byte]{
+				operation: Cmd_CREATE,
+				mapTitle:  "test-cache",
+				value:     []byte("5"),
+				create:    createIfNotExists,
+			},
+			want:    "OK",
+			wantErr: false,
+		},
 		{
 			name: "SET command",
 			cmd: &Command[uint64, []byte]{
 				operation: Cmd_SET,
-				mapKey:    hash[uint64]([]byte("test-cache")),
-				key:       hash[uint64]([]byte("test")),
+				mapTitle:  "test-cache",
+				key:       Hash[uint64]([]byte("test")),
 				value:     []byte("value"),
 			},
 			want:    "OK",
@@ -40,8 +62,8 @@ func TestExecute(t *testing.T) {
 			name: "GET existing key",
 			cmd: &Command[uint64, []byte]{
 				operation: Cmd_GET,
-				mapKey:    hash[uint64]([]byte("test-cache")),
-				key:       hash[uint64]([]byte("test")),
+				mapTitle:  "test-cache",
+				key:       Hash[uint64]([]byte("test")),
 			},
 			want:    "value",
 			wantErr: false,
@@ -50,8 +72,8 @@ func TestExecute(t *testing.T) {
 			name: "GET non-existing key",
 			cmd: &Command[uint64, []byte]{
 				operation: Cmd_GET,
-				mapKey:    hash[uint64]([]byte("test-cache")),
-				key:       hash[uint64]([]byte("nonexistent")),
+				mapTitle:  "test-cache",
+				key:       Hash[uint64]([]byte("nonexistent")),
 			},
 			want:    "",
 			wantErr: true,
@@ -60,26 +82,49 @@ func TestExecute(t *testing.T) {
 			name: "GET from non-existing cache",
 			cmd: &Command[uint64, []byte]{
 				operation: Cmd_GET,
-				mapKey:    hash[uint64]([]byte("nonexistent-cache")),
-				key:       hash[uint64]([]byte("test")),
+				mapTitle:  "nonexistent-cache",
+				key:       Hash[uint64]([]byte("test")),
 			},
 			want:    "",
 			wantErr: true,
 		},
+		{
+			name: "SET with tags",
+			cmd: &Command[uint64, []byte]{
+				operation: Cmd_SET,
+				mapTitle:  "test-cache",
+				key:       Hash[uint64]([]byte("tagged")),
+				value:     []byte("value"),
+				tags:      []string{"group"},
+			},
+			want:    "OK",
+			wantErr: false,
+		},
+		{
+			name: "INVALIDATE tag",
+			cmd: &Command[uint64, []byte]{
+				operation: Cmd_INVALIDATE,
+				mapTitle:  "test-cache",
+				tags:      []string{"group"},
+			},
+			want:    "1",
+			wantErr: false,
+		},
 		{
 			name: "LIST caches",
 			cmd: &Command[uint64, []byte]{
 				operation: Cmd_LIST,
 			},
-			want:    fmt.Sprintf("test-cache\nKey: %d, Value: %v", hash[uint64]([]byte("test")), []byte("value")),
+			want: fmt.Sprintf("test-cache capacity=5 %s\nKey: %d, Value: %v",
+				src.CacheOptions{}, Hash[uint64]([]byte("test")), []byte("value")),
 			wantErr: false,
 		},
 		{
 			name: "DEL command",
 			cmd: &Command[uint64, []byte]{
 				operation: Cmd_DEL,
-				mapKey:    hash[uint64]([]byte("test-cache")),
-				key:       hash[uint64]([]byte("test")),
+				mapTitle:  "test-cache",
+				key:       Hash[uint64]([]byte("test")),
 			},
 			want:    "OK",
 			wantErr: false,
@@ -88,11 +133,20 @@ func TestExecute(t *testing.T) {
 			name: "DESTROY cache",
 			cmd: &Command[uint64, []byte]{
 				operation: Cmd_DESTROY,
-				mapKey:    hash[uint64]([]byte("test-cache")),
+				mapTitle:  "test-cache",
 			},
 			want:    "OK",
 			wantErr: false,
 		},
+		{
+			name: "DESTROY unknown cache",
+			cmd: &Command[uint64, []byte]{
+				operation: Cmd_DESTROY,
+				mapTitle:  "test-cache",
+			},
+			want:    "",
+			wantErr: true,
+		},
 		{
 			name: "CLEAR_ALL caches",
 			cmd: &Command[uint64, []byte]{
@@ -116,3 +170,224 @@ func TestExecute(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTags(t *testing.T) {
+	cmd, err := Parse[uint64, []byte]([]byte("SET users 1 hello world TAGS tenant:a,admin"))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if string(cmd.value) != "hello world" {
+		t.Errorf("Parse() value = %q, want %q", cmd.value, "hello world")
+	}
+	if len(cmd.tags) != 2 || cmd.tags[0] != "tenant:a" || cmd.tags[1] != "admin" {
+		t.Errorf("Parse() tags = %v", cmd.tags)
+	}
+
+	cmd, err = Parse[uint64, []byte]([]byte("SET users 1 TAGS x"))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if string(cmd.value) != "TAGS x" || cmd.tags != nil {
+		t.Errorf("Parse() should keep short values verbatim, got %q %v", cmd.value, cmd.tags)
+	}
+
+	if _, err := Parse[uint64, []byte]([]byte("INVALIDATE users")); err == nil {
+		t.Error("Parse() expected usage error for INVALIDATE without tag")
+	}
+}
+
+func TestParseCreateDestroy(t *testing.T) {
+	cmd, err := Parse[uint64, []byte]([]byte("CREATE users 10 replace"))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if cmd.mapTitle != "users" || cmd.create != createReplace {
+		t.Errorf("Parse() = %+v, want REPLACE on users", cmd)
+	}
+	if _, err := Parse[uint64, []byte]([]byte("CREATE users 10 SOMETIMES")); err == nil {
+		t.Error("Parse() expected error for unknown CREATE option")
+	}
+
+	cmd, err = Parse[uint64, []byte]([]byte("DESTROY users"))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if cmd.operation != Cmd_DESTROY || cmd.mapTitle != "users" {
+		t.Errorf("Parse() = %+v, want DESTROY users", cmd)
+	}
+	if _, err := Parse[uint64, []byte]([]byte("DESTROY")); err == nil {
+		t.Error("Parse() expected usage error for DESTROY without name")
+	}
+}
+
+func TestCacheOptionsCommands(t *testing.T) {
+	cm := src.NewCacheManager[uint8, uint64, []byte]()
+	run := func(line string) (string, error) {
+		cmd, err := Parse[uint64, []byte]([]byte(line))
+		if err != nil {
+			return "", err
+		}
+		return Execute(cm, cmd)
+	}
+
+	if _, err := run("CREATE users 4 policy=fifo max_key_size=4 max_value_size=8 description=sessions"); err != nil {
+		t.Fatalf("CREATE with options error = %v", err)
+	}
+	if _, err := run("CREATE other 4 IFNOTEXISTS ttl=5m"); err != nil {
+		t.Fatalf("CREATE IFNOTEXISTS with options error = %v", err)
+	}
+	if _, err := run("CREATE bad 4 ttl=5m REPLACE"); err == nil {
+		t.Error("Expected error when REPLACE follows option pairs")
+	}
+	if _, err := run("CREATE bad 4 colour=blue"); !errors.Is(err, src.ErrUnknownOption) {
+		t.Errorf("Expected ErrUnknownOption, got %v", err)
+	}
+
+	if got, _ := run("CONFIG GET users policy"); got != "fifo" {
+		t.Errorf("CONFIG GET policy = %q, want fifo", got)
+	}
+	if _, err := run("SET users toolong v"); !errors.Is(err, src.ErrKeyTooLarge) {
+		t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+	}
+	if _, err := run("SET users k 123456789"); !errors.Is(err, src.ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+	if _, err := run("CONFIG SET users readonly true"); err != nil {
+		t.Fatalf("CONFIG SET readonly error = %v", err)
+	}
+	for _, line := range []string{"SET users k v", "DEL users k", "CLEAR users", "INVALIDATE users tag", "RESTORE users 1 0 - -", "DELRAW users 1"} {
+		if _, err := run(line); !errors.Is(err, src.ErrReadOnly) {
+			t.Errorf("%s: expected ErrReadOnly, got %v", line, err)
+		}
+	}
+	if _, err := run("CONFIG SET users capacity 10"); !errors.Is(err, src.ErrOptionImmutable) {
+		t.Errorf("Expected ErrOptionImmutable, got %v", err)
+	}
+	if got, _ := run("CONFIG GET users capacity"); got != "4" {
+		t.Errorf("CONFIG GET capacity = %q, want 4", got)
+	}
+
+	list, _ := run("LIST")
+	if !strings.Contains(list, "users capacity=4 policy=fifo") || !strings.Contains(list, "description=sessions") {
+		t.Errorf("LIST should show effective options, got %q", list)
+	}
+}
+
+func TestReorganizeCommands(t *testing.T) {
+	cm := src.NewCacheManager[uint8, uint64, []byte]()
+	run := func(line string) (string, error) {
+		cmd, err := Parse[uint64, []byte]([]byte(line))
+		if err != nil {
+			return "", err
+		}
+		return Execute(cm, cmd)
+	}
+
+	for _, line := range []string{
+		"CREATE a 4",
+		"SET a k1 v1",
+		"SET a k2 v2",
+		"RENAME a b",
+		"COPY b c 2",
+		"CREATE d 4",
+		"MOVE b d k1",
+	} {
+		if _, err := run(line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	if got, _ := run("GET d k1"); got != "v1" {
+		t.Errorf("GET d k1 = %q, want v1", got)
+	}
+	if _, err := run("GET b k1"); !errors.Is(err, src.ErrKeyNotFound) {
+		t.Errorf("Expected moved key to be gone from source, got %v", err)
+	}
+	if got, _ := run("GET c k2"); got != "v2" {
+		t.Errorf("GET c k2 = %q, want v2", got)
+	}
+	if _, err := run("RENAME b c"); !errors.Is(err, src.ErrCacheExists) {
+		t.Errorf("Expected ErrCacheExists, got %v", err)
+	}
+	if _, err := run("CONFIG SET d readonly true"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("MOVE c d k2"); !errors.Is(err, src.ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly moving into a read-only cache, got %v", err)
+	}
+	if _, err := Parse[uint64, []byte]([]byte("MOVE a b")); err == nil {
+		t.Error("Expected usage error for MOVE without key")
+	}
+}
+
+func TestInfoMemory(t *testing.T) {
+	cm := src.NewCacheManager[uint8, uint64, []byte]()
+	cm.SetMemoryLimit(1<<20, src.MemoryEvictLargest)
+	cm.CreateCache("users", 4, src.CacheOptions{})
+
+	cmd, err := Parse[uint64, []byte]([]byte("INFO memory"))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	got, err := Execute(cm, cmd)
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	for _, want := range []string{"maxmemory:1048576", "maxmemory_policy:largest", "cache:users bytes="} {
+		if !strings.Contains(got, want) {
+			t.Errorf("INFO memory missing %q in %q", want, got)
+		}
+	}
+	if _, err := Execute(cm, &Command[uint64, []byte]{operation: Cmd_INFO, option: "nope"}); err == nil {
+		t.Error("Expected error for unknown INFO section")
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	source := src.NewCacheManager[uint8, uint64, []byte]()
+	target := src.NewCacheManager[uint8, uint64, []byte]()
+	exec := func(cm *src.CacheManager[uint8, uint64, []byte], line string) string {
+		t.Helper()
+		cmd, err := Parse[uint64, []byte]([]byte(line))
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", line, err)
+		}
+		result, err := Execute(cm, cmd)
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		return result
+	}
+
+	exec(source, "CREATE a 4 policy=fifo")
+	exec(source, "SET a k1 hello world TAGS x,y")
+	exec(source, "SET a k2 v2")
+	dump := strings.Split(exec(source, "DUMP a"), "\n")
+	if len(dump) != 3 || !strings.HasPrefix(dump[0], "4 policy=fifo ") {
+		t.Fatalf("Unexpected DUMP output %q", dump)
+	}
+
+	capacity, opts, _ := strings.Cut(dump[0], " ")
+	exec(target, "CREATE a "+capacity+" "+opts)
+	for _, entry := range dump[1:] {
+		exec(target, "RESTORE a "+entry)
+	}
+	if got := exec(target, "GET a k1"); got != "hello world" {
+		t.Errorf("GET a k1 = %q, want %q", got, "hello world")
+	}
+	if got := exec(target, "INVALIDATE a y"); got != "1" {
+		t.Errorf("Expected restored tags to be indexed, INVALIDATE removed %s", got)
+	}
+
+	hashed, _, _ := strings.Cut(dump[2], " ")
+	exec(source, "DELRAW a "+hashed)
+	if cmd, _ := Parse[uint64, []byte]([]byte("GET a k2")); cmd != nil {
+		if _, err := Execute(source, cmd); !errors.Is(err, src.ErrKeyNotFound) {
+			t.Errorf("Expected DELRAW to remove k2, got %v", err)
+		}
+	}
+	for _, line := range []string{"RESTORE a 1 0 - not-base64!", "DELRAW a k2", "RESTORE a 1 0 -"} {
+		if _, err := Parse[uint64, []byte]([]byte(line)); err == nil {
+			t.Errorf("Parse(%q) expected an error", line)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"lrue/src"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRateLimited is returned for commands over one of the client's rate limits
+var ErrRateLimited = errors.New("RATELIMIT")
+
+// Limits are applied to one client: token bucket rates, each allowing a burst
+// of one second's worth, and a quota of new keys. Zero disables a limit.
+type Limits struct {
+	Commands uint64 // commands per second
+	Bytes    uint64 // bytes of keys and values written per second
+	Keys     uint64 // keys the client may create in each cache
+}
+
+// ParseLimits reads limits written as commands=<n>,bytes=<n>,keys=<n>; byte
+// counts may end in kb, mb or gb and missing limits are disabled
+func ParseLimits(s string) (Limits, error) {
+	var limits Limits
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" || s == "none" {
+		return limits, nil
+	}
+	for pair := range strings.SplitSeq(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return limits, fmt.Errorf("limits must look like commands=<n>,bytes=<n>,keys=<n>: %s", pair)
+		}
+		var err error
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "commands":
+			limits.Commands, err = strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		case "bytes":
+			limits.Bytes, err = ParseBytes(value)
+		case "keys":
+			limits.Keys, err = strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		default:
+			return limits, fmt.Errorf("unknown limit: %s", name)
+		}
+		if err != nil {
+			return limits, fmt.Errorf("invalid %s limit: %s", name, value)
+		}
+	}
+	return limits, nil
+}
+
+func (l Limits) String() string {
+	return fmt.Sprintf("commands=%d,bytes=%d,keys=%d", l.Commands, l.Bytes, l.Keys)
+}
+
+// ParseBytes reads a byte count with an optional kb, mb or gb suffix, refusing
+// counts that do not fit in 64 bits
+func ParseBytes(value string) (uint64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	multiplier := uint64(1)
+	for suffix, m := range map[string]uint64{"kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30} {
+		if strings.HasSuffix(value, suffix) {
+			value, multiplier = strings.TrimSuffix(value, suffix), m
+			break
+		}
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxUint64/multiplier {
+		return 0, fmt.Errorf("byte count out of range: %s", value)
+	}
+	return n * multiplier, nil
+}
+
+// bucket is a token bucket; its rate is passed in on every use so that
+// changed limits apply to existing clients
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// wait refills the bucket and returns how long the client must wait before
+// n tokens are available. A cost over the burst only needs a full bucket, so
+// large writes are still possible at low rates.
+func (b *bucket) wait(rate uint64, n int, now time.Time) time.Duration {
+	burst := float64(rate)
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*burst)
+	}
+	b.last = now
+	need := min(float64(n), burst)
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / burst * float64(time.Second))
+}
+
+// limiter holds the buckets of one connection or one user and the number of
+// keys it created in each cache
+type limiter struct {
+	mutex    sync.Mutex
+	commands bucket
+	bytes    bucket
+	keys     map[string]uint64
+}
+
+func newLimiter() *limiter {
+	return &limiter{keys: make(map[string]uint64)}
+}
+
+// cost is what one command takes from a client's buckets
+type cost struct {
+	bytes  int
+	newKey string // cache a new key is created in, if any
+}
+
+// throttle names the limit a command exceeded
+type throttle int
+
+const (
+	throttleCommands throttle = iota
+	throttleBytes
+	throttleKeys
+)
+
+// check reports whether c fits in the buckets and key quota of l under
+// limits and, when it does not, the limit that refused it and the wait before
+// retrying. An exhausted key quota has no wait.
+func (l *limiter) check(limits Limits, c cost, now time.Time) (bool, throttle, time.Duration) {
+	if limits.Commands > 0 {
+		if wait := l.commands.wait(limits.Commands, 1, now); wait > 0 {
+			return false, throttleCommands, wait
+		}
+	}
+	if limits.Bytes > 0 && c.bytes > 0 {
+		if wait := l.bytes.wait(limits.Bytes, c.bytes, now); wait > 0 {
+			return false, throttleBytes, wait
+		}
+	}
+	if limits.Keys > 0 && c.newKey != "" && l.keys[c.newKey] >= limits.Keys {
+		return false, throttleKeys, 0
+	}
+	return true, 0, 0
+}
+
+// take charges c to the buckets checked by check
+func (l *limiter) take(limits Limits, c cost) {
+	if limits.Commands > 0 {
+		l.commands.tokens--
+	}
+	if limits.Bytes > 0 {
+		l.bytes.tokens -= float64(c.bytes)
+	}
+	if c.newKey != "" {
+		l.keys[c.newKey]++
+	}
+}
+
+// rateLimits are the limits of a server with the buckets of its users and
+// the number of commands each kind of limit refused
+type rateLimits struct {
+	conn      atomic.Pointer[Limits]
+	user      atomic.Pointer[Limits]
+	mutex     sync.Mutex
+	users     map[string]*limiter
+	throttled [3]atomic.Int64
+}
+
+func newRateLimits() *rateLimits {
+	r := &rateLimits{users: make(map[string]*limiter)}
+	r.conn.Store(&Limits{})
+	r.user.Store(&Limits{})
+	return r
+}
+
+func (r *rateLimits) userLimiter(name string) *limiter {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	l, ok := r.users[name]
+	if !ok {
+		l = newLimiter()
+		r.users[name] = l
+	}
+	return l
+}
+
+// allow charges c to the connection's buckets and the user's, or to neither
+// when one of them is exhausted. Either may be nil.
+func (r *rateLimits) allow(conn *limiter, user *User, c cost) error {
+	connLimits, userLimits := *r.conn.Load(), *r.user.Load()
+	var limiters []*limiter
+	var limits []Limits
+	var owners []string
+	if conn != nil && connLimits != (Limits{}) {
+		limiters, limits, owners = append(limiters, conn), append(limits, connLimits), append(owners, "connection")
+	}
+	if user != nil && userLimits != (Limits{}) {
+		limiters, limits, owners = append(limiters, r.userLimiter(user.Name)), append(limits, userLimits), append(owners, "user "+user.Name)
+	}
+	for _, l := range limiters {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+	}
+	now := time.Now()
+	for i, l := range limiters {
+		if ok, kind, wait := l.check(limits[i], c, now); !ok {
+			r.throttled[kind].Add(1)
+			return newRateLimitError(kind, owners[i], c.newKey, limits[i], wait)
+		}
+	}
+	for i, l := range limiters {
+		l.take(limits[i], c)
+	}
+	return nil
+}
+
+// rateLimitError reports an exceeded limit and how long to wait before
+// retrying, zero when retrying cannot help
+type rateLimitError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func newRateLimitError(kind throttle, owner, cache string, limits Limits, wait time.Duration) *rateLimitError {
+	// Round up so that retrying after the advertised delay succeeds
+	err := &rateLimitError{retryAfter: (wait + time.Millisecond - 1).Truncate(time.Millisecond)}
+	switch kind {
+	case throttleCommands:
+		err.reason = "commands per second exceeded for " + owner
+	case throttleBytes:
+		err.reason = "bytes per second exceeded for " + owner
+	case throttleKeys:
+		err.reason = fmt.Sprintf("quota of %d new keys in cache %s reached for %s", limits.Keys, cache, owner)
+	}
+	return err
+}
+
+func (e *rateLimitError) Error() string {
+	if e.retryAfter == 0 {
+		return fmt.Sprintf("%s %s", ErrRateLimited, e.reason)
+	}
+	return fmt.Sprintf("%s %s, retry after %s", ErrRateLimited, e.reason, e.retryAfter)
+}
+
+func (e *rateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// commandCost returns what cmd takes from the buckets; finding out whether a
+// SET creates a key is only done when new keys are limited
+func commandCost[U, K src.Uints, V ~[]byte](r *rateLimits, mgr *src.CacheManager[U, K, V], cmd *Command[K, V]) cost {
+	switch cmd.operation {
+	case Cmd_SET, Cmd_RESTORE:
+	default:
+		return cost{}
+	}
+	c := cost{bytes: cmd.keySize + len(cmd.value)}
+	if cmd.operation == Cmd_SET && (r.conn.Load().Keys > 0 || r.user.Load().Keys > 0) {
+		if cache := mgr.GetCache(cmd.mapTitle); cache != nil {
+			if !cache.Contains(cmd.key) {
+				c.newKey = cmd.mapTitle
+			}
+			cache.Release()
+		}
+	}
+	return c
+}
+
+func (r *rateLimits) info() string {
+	var builder strings.Builder
+	builder.WriteString("# Limits\n")
+	fmt.Fprintf(&builder, "conn_limits:%s\n", r.conn.Load())
+	fmt.Fprintf(&builder, "user_limits:%s\n", r.user.Load())
+	fmt.Fprintf(&builder, "throttled_commands:%d\n", r.throttled[throttleCommands].Load())
+	fmt.Fprintf(&builder, "throttled_bytes:%d\n", r.throttled[throttleBytes].Load())
+	fmt.Fprintf(&builder, "throttled_keys:%d", r.throttled[throttleKeys].Load())
+	return builder.String()
+}
+
+// SetLimits sets the rate limits of every connection and of every user, shared
+// by all connections authenticated as that user
+func (s *Server[U, K, V]) SetLimits(conn, user Limits) {
+	s.limits.conn.Store(&conn)
+	s.limits.user.Store(&user)
+}
+
+// serverOptions are the options CONFIG GET and CONFIG SET take without a cache
+var serverOptions = []string{"conn-limits", "user-limits"}
+
+// config runs CONFIG GET and CONFIG SET on server options
+func (s *Server[U, K, V]) config(cmd *Command[K, V]) (string, error) {
+	var target *atomic.Pointer[Limits]
+	switch cmd.option {
+	case "conn-limits":
+		target = &s.limits.conn
+	case "user-limits":
+		target = &s.limits.user
+	default:
+		return "", fmt.Errorf("unknown server option: %s", cmd.option)
+	}
+	if cmd.sub == Cmd_GET {
+		return target.Load().String(), nil
+	}
+	limits, err := ParseLimits(string(cmd.value))
+	if err != nil {
+		return "", err
+	}
+	target.Store(&limits)
+	return "OK", nil
+}
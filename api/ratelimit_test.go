@@ -0,0 +1,133 @@
+package api
+
+import (
+	"errors"
+	"lrue/src"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	var b bucket
+	now := time.Now()
+	for i := range 10 {
+		if wait := b.wait(10, 1, now); wait != 0 {
+			t.Fatalf("command %d: wait = %v, want 0", i, wait)
+		}
+		b.tokens--
+	}
+	if wait := b.wait(10, 1, now); wait != 100*time.Millisecond {
+		t.Errorf("wait = %v, want 100ms", wait)
+	}
+	if wait := b.wait(10, 1, now.Add(100*time.Millisecond)); wait != 0 {
+		t.Errorf("wait after refill = %v, want 0", wait)
+	}
+	// A cost over the burst fits a full bucket
+	if wait := b.wait(10, 50, now.Add(2*time.Second)); wait != 0 {
+		t.Errorf("wait for a large cost = %v, want 0", wait)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits("commands=100, bytes=1mb")
+	if err != nil || limits != (Limits{Commands: 100, Bytes: 1 << 20}) {
+		t.Errorf("ParseLimits() = %+v, %v", limits, err)
+	}
+	for _, s := range []string{"commands", "commands=-1", "reads=5", "bytes=17179869184gb"} {
+		if _, err := ParseLimits(s); err == nil {
+			t.Errorf("ParseLimits(%q) expected an error", s)
+		}
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	for value, want := range map[string]uint64{"512": 512, "2kb": 2 << 10, " 1MB": 1 << 20, "17179869183gb": 17179869183 << 30} {
+		if got, err := ParseBytes(value); err != nil || got != want {
+			t.Errorf("ParseBytes(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "kb", "-1", "1tb", "17179869184gb", "18446744073709551616"} {
+		if _, err := ParseBytes(value); err == nil {
+			t.Errorf("ParseBytes(%q) expected an error", value)
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	defer srv.Close()
+	run(t, srv, "CREATE users 8")
+	run(t, srv, "CREATE other 8")
+
+	expectLimited := func(sess *session[uint8, uint64, []byte], line, reason string) {
+		t.Helper()
+		_, err := exec(t, sess, line)
+		if !errors.Is(err, ErrRateLimited) || !strings.Contains(err.Error(), reason) {
+			t.Errorf("%s: expected RATELIMIT for %s, got %v", line, reason, err)
+		}
+	}
+
+	t.Run("Commands", func(t *testing.T) {
+		run(t, srv, "CONFIG SET conn-limits commands=3")
+		defer run(t, srv, "CONFIG SET conn-limits none")
+		sess := srv.newSession()
+		defer sess.close()
+		for _, line := range []string{"SET users a 1", "SET users b 2", "GET users a"} {
+			if _, err := exec(t, sess, line); err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+		}
+		expectLimited(sess, "GET users a", "commands per second exceeded for connection, retry after")
+		other := srv.newSession()
+		defer other.close()
+		if _, err := exec(t, other, "GET users a"); err != nil {
+			t.Errorf("Expected another connection to have its own limit, got %v", err)
+		}
+	})
+
+	t.Run("Keys", func(t *testing.T) {
+		srv.SetLimits(Limits{Keys: 2}, Limits{})
+		defer srv.SetLimits(Limits{}, Limits{})
+		sess := srv.newSession()
+		defer sess.close()
+		for _, line := range []string{"SET users k1 1", "SET users k2 1", "SET users k1 2", "SET other k3 1"} {
+			if _, err := exec(t, sess, line); err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+		}
+		// The quota does not refill, only a higher limit lifts it
+		expectLimited(sess, "SET users k3 1", "RATELIMIT quota of 2 new keys in cache users reached for connection")
+		if _, err := exec(t, sess, "SET users k3 1"); err == nil || strings.Contains(err.Error(), "retry after") {
+			t.Errorf("Expected the key quota to have no retry delay, got %v", err)
+		}
+		srv.SetLimits(Limits{Keys: 3}, Limits{})
+		if _, err := exec(t, sess, "SET users k3 1"); err != nil {
+			t.Errorf("Expected a higher quota to allow a new key, got %v", err)
+		}
+	})
+
+	t.Run("User", func(t *testing.T) {
+		srv.SetLimits(Limits{}, Limits{Bytes: 10})
+		defer srv.SetLimits(Limits{}, Limits{})
+		alice := &User{Name: "alice"}
+		first, second := srv.newSession(), srv.newSession()
+		defer first.close()
+		defer second.close()
+		first.user, second.user = alice, alice
+		if _, err := exec(t, first, "SET users a 1234567"); err != nil {
+			t.Fatalf("SET: %v", err)
+		}
+		expectLimited(second, "SET users b 1234567", "bytes per second exceeded for user alice, retry after")
+	})
+
+	if got, err := run(t, srv, "CONFIG GET conn-limits"); err != nil || got != "commands=0,bytes=0,keys=0" {
+		t.Errorf("CONFIG GET conn-limits = %q, %v", got, err)
+	}
+	info, _ := run(t, srv, "INFO limits")
+	for _, want := range []string{"throttled_commands:1", "throttled_bytes:1", "throttled_keys:2"} {
+		if !strings.Contains(info, want) {
+			t.Errorf("Expected %q in INFO limits, got %q", want, info)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"lrue/src"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	replBacklogSize   = 16384 // entries kept for partial resyncs
+	replLinkBuffer    = 16384 // entries queued per replica before it is dropped
+	replHeartbeat     = time.Second
+	replTimeout       = 5 * time.Second
+	replAckInterval   = 250 * time.Millisecond
+	replRetryInterval = 100 * time.Millisecond
+	replRetryMax      = 2 * time.Second
+)
+
+// replEntry is one replicated event. Entries with a zero event kind are
+// heartbeats carrying the primary's latest offset.
+type replEntry[U, K src.Uints, V ~[]byte] struct {
+	Offset uint64
+	Event  src.Event[U, K, V]
+}
+
+// replication records a primary's changes in a backlog and streams them to
+// replicas, or, while following a primary, applies that primary's stream.
+//
+// Sync protocol, after the usual greeting:
+//
+//	replica: REPLSYNC <replication_id> <offset>
+//	primary: FULLSYNC <replication_id> <offset>   followed by a gob snapshot, or
+//	         CONTINUE <replication_id>            when the backlog covers the offset
+//
+// The primary then sends gob encoded entries; the replica answers with
+// REPLACK <offset> lines.
+type replication[U, K src.Uints, V ~[]byte] struct {
+	mgr         *src.CacheManager[U, K, V]
+	stopObserve func()
+	following   atomic.Bool
+	peers       *peerDialer
+	roleMutex   sync.Mutex // serializes role changes
+
+	mutex    sync.Mutex
+	id       string
+	offset   uint64
+	backlog  []replEntry[U, K, V]
+	replicas map[*replicaLink[U, K, V]]struct{}
+	primary  *primaryLink
+}
+
+// primaryLink is a replica's connection state towards its primary
+type primaryLink struct {
+	addr          string
+	cancel        context.CancelFunc
+	done          chan struct{}
+	connected     bool
+	lastIO        time.Time
+	lastError     error
+	primaryOffset uint64
+	fullSyncs     int
+	partialSyncs  int
+}
+
+// replicaLink is a primary's view of one connected replica
+type replicaLink[U, K src.Uints, V ~[]byte] struct {
+	addr     string
+	entries  chan replEntry[U, K, V]
+	dropped  chan struct{}
+	dropOnce sync.Once
+	ack      atomic.Uint64
+	lastAck  atomic.Int64
+}
+
+func newReplication[U, K src.Uints, V ~[]byte](mgr *src.CacheManager[U, K, V]) *replication[U, K, V] {
+	r := &replication[U, K, V]{
+		mgr:      mgr,
+		peers:    &peerDialer{},
+		id:       newReplicationID(),
+		replicas: make(map[*replicaLink[U, K, V]]struct{}),
+	}
+	r.stopObserve = mgr.Observe(r.record)
+	return r
+}
+
+func newReplicationID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// record appends a change to the backlog and queues it for every replica
+func (r *replication[U, K, V]) record(ev src.Event[U, K, V]) {
+	if r.following.Load() {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.offset++
+	entry := replEntry[U, K, V]{Offset: r.offset, Event: ev}
+	r.backlog = append(r.backlog, entry)
+	if len(r.backlog) >= 2*replBacklogSize {
+		r.backlog = slices.Clone(r.backlog[len(r.backlog)-replBacklogSize:])
+	}
+	for link := range r.replicas {
+		select {
+		case link.entries <- entry:
+		default:
+			r.drop(link) // too far behind; it will resync
+		}
+	}
+}
+
+// drop disconnects a replica while the mutex is held
+func (r *replication[U, K, V]) drop(link *replicaLink[U, K, V]) {
+	delete(r.replicas, link)
+	link.dropOnce.Do(func() { close(link.dropped) })
+}
+
+// follow starts replicating from the primary at addr, replacing any previous primary
+func (r *replication[U, K, V]) follow(addr string) {
+	r.roleMutex.Lock()
+	defer r.roleMutex.Unlock()
+	r.stopFollowing()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	link := &primaryLink{addr: addr, cancel: cancel, done: make(chan struct{})}
+	r.mutex.Lock()
+	r.following.Store(true)
+	for replica := range r.replicas {
+		r.drop(replica)
+	}
+	r.primary = link
+	r.mutex.Unlock()
+
+	go r.run(ctx, link)
+}
+
+// promote stops following and starts a new history as a primary
+func (r *replication[U, K, V]) promote() {
+	r.roleMutex.Lock()
+	defer r.roleMutex.Unlock()
+	if !r.stopFollowing() {
+		return
+	}
+	r.mutex.Lock()
+	r.id = newReplicationID()
+	r.backlog = nil
+	r.following.Store(false)
+	r.mutex.Unlock()
+}
+
+// status reports the primary being followed, empty for a primary, and the current offset
+func (r *replication[U, K, V]) status() (string, uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.primary != nil {
+		return r.primary.addr, r.offset
+	}
+	return "", r.offset
+}
+
+// stopFollowing disconnects from the primary and waits for the link to shut down
+func (r *replication[U, K, V]) stopFollowing() bool {
+	r.mutex.Lock()
+	link := r.primary
+	r.primary = nil
+	r.mutex.Unlock()
+	if link == nil {
+		return false
+	}
+	link.cancel()
+	<-link.done
+	return true
+}
+
+func (r *replication[U, K, V]) close() {
+	r.roleMutex.Lock()
+	defer r.roleMutex.Unlock()
+	r.stopFollowing()
+	r.stopObserve()
+	r.mutex.Lock()
+	for replica := range r.replicas {
+		r.drop(replica)
+	}
+	r.mutex.Unlock()
+}
+
+// run keeps a replica synced with its primary, reconnecting with backoff
+func (r *replication[U, K, V]) run(ctx context.Context, link *primaryLink) {
+	defer close(link.done)
+	delay := replRetryInterval
+	for {
+		err := r.sync(ctx, link)
+		r.mutex.Lock()
+		if link.connected {
+			delay = replRetryInterval
+		}
+		link.connected = false
+		link.lastError = err
+		r.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, replRetryMax)
+	}
+}
+
+// sync performs one full or partial sync and then applies the stream until
+// the connection fails
+func (r *replication[U, K, V]) sync(ctx context.Context, link *primaryLink) error {
+	conn, err := r.peers.dial(ctx, link.addr, replTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(replTimeout))
+	if err := r.peers.greet(conn, reader); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	id, offset := r.id, r.offset
+	r.mutex.Unlock()
+	if _, err := fmt.Fprintf(conn, "%s %s %d\r\n", Cmd_REPLSYNC, id, offset); err != nil {
+		return err
+	}
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	decoder := gob.NewDecoder(reader)
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLSYNC":
+		start, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid sync offset: %s", fields[2])
+		}
+		var snapshots []src.CacheSnapshot[U, K, V]
+		if err := decoder.Decode(&snapshots); err != nil {
+			return err
+		}
+		r.mgr.LoadSnapshot(snapshots)
+		r.mutex.Lock()
+		r.id, r.offset = fields[1], start
+		link.fullSyncs++
+		r.mutex.Unlock()
+	case len(fields) == 2 && fields[0] == "CONTINUE":
+		r.mutex.Lock()
+		link.partialSyncs++
+		r.mutex.Unlock()
+	default:
+		return fmt.Errorf("unexpected sync reply: %s", strings.TrimSpace(reply))
+	}
+
+	r.mutex.Lock()
+	link.connected = true
+	link.lastIO = time.Now()
+	r.mutex.Unlock()
+
+	acking := make(chan struct{})
+	defer close(acking)
+	go r.sendAcks(conn, acking)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		var entry replEntry[U, K, V]
+		if err := decoder.Decode(&entry); err != nil {
+			return err
+		}
+		if entry.Event.Kind != 0 {
+			r.apply(entry.Event)
+		}
+		r.mutex.Lock()
+		if entry.Event.Kind != 0 {
+			r.offset = entry.Offset
+		}
+		link.primaryOffset = max(link.primaryOffset, entry.Offset)
+		link.lastIO = time.Now()
+		r.mutex.Unlock()
+	}
+}
+
+// sendAcks reports the applied offset to the primary until done is closed
+func (r *replication[U, K, V]) sendAcks(conn net.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(replAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			r.mutex.Lock()
+			offset := r.offset
+			r.mutex.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(replTimeout))
+			if _, err := fmt.Fprintf(conn, "REPLACK %d\r\n", offset); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// apply replays one of the primary's changes. Failures are ignored: after a
+// full sync the stream may repeat changes the snapshot already contains.
+func (r *replication[U, K, V]) apply(ev src.Event[U, K, V]) {
+	switch ev.Kind {
+	case src.EventCreate:
+		r.mgr.ReplaceCache(ev.Cache, ev.Capacity, ev.Options)
+		return
+	case src.EventDestroy:
+		r.mgr.DestroyCache(ev.Cache)
+		return
+	case src.EventRename:
+		r.mgr.RenameCache(ev.Cache, ev.Target)
+		return
+	}
+
+	cache := r.mgr.GetCache(ev.Cache)
+	if cache == nil {
+		return
+	}
+	defer cache.Release()
+	switch ev.Kind {
+	case src.EventSet:
+		cache.Restore(ev.Entry)
+	case src.EventDel, src.EventExpire, src.EventEvict:
+		cache.Eject(ev.Key)
+	case src.EventClear:
+		cache.Clear()
+	case src.EventConfig:
+		cache.SetOption(ev.Option, ev.Setting)
+	}
+}
+
+// serveReplica takes over a connection that sent REPLSYNC and streams the
+// snapshot or backlog followed by every new change
+func (r *replication[U, K, V]) serveReplica(conn net.Conn, id string, offset uint64) {
+	r.mutex.Lock()
+	if r.following.Load() {
+		r.mutex.Unlock()
+		fmt.Fprintf(conn, "ERR a replica cannot serve replicas\r\n")
+		return
+	}
+	link := &replicaLink[U, K, V]{
+		addr:    conn.RemoteAddr().String(),
+		entries: make(chan replEntry[U, K, V], replLinkBuffer),
+		dropped: make(chan struct{}),
+	}
+	link.lastAck.Store(time.Now().UnixNano())
+
+	first := r.offset - uint64(len(r.backlog))
+	partial := id == r.id && offset >= first && offset <= r.offset
+	var header string
+	var pending []replEntry[U, K, V]
+	if partial {
+		header = fmt.Sprintf("CONTINUE %s\r\n", r.id)
+		pending = slices.Clone(r.backlog[offset-first:])
+		link.ack.Store(offset)
+	} else {
+		header = fmt.Sprintf("FULLSYNC %s %d\r\n", r.id, r.offset)
+	}
+	r.replicas[link] = struct{}{}
+	r.mutex.Unlock()
+
+	defer func() {
+		r.mutex.Lock()
+		r.drop(link)
+		r.mutex.Unlock()
+	}()
+	go r.readAcks(conn, link)
+
+	writer := bufio.NewWriter(conn)
+	encoder := gob.NewEncoder(writer)
+	conn.SetWriteDeadline(time.Now().Add(replTimeout))
+	writer.WriteString(header)
+	if !partial {
+		if err := encoder.Encode(r.mgr.Snapshot()); err != nil {
+			return
+		}
+	}
+	for _, entry := range pending {
+		if err := encoder.Encode(entry); err != nil {
+			return
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(replHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-link.dropped:
+			return
+		case entry := <-link.entries:
+			conn.SetWriteDeadline(time.Now().Add(replTimeout))
+			err = encoder.Encode(entry)
+			for queued := len(link.entries); err == nil && queued > 0; queued-- {
+				err = encoder.Encode(<-link.entries)
+			}
+		case <-heartbeat.C:
+			r.mutex.Lock()
+			offset := r.offset
+			r.mutex.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(replTimeout))
+			err = encoder.Encode(replEntry[U, K, V]{Offset: offset})
+		}
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readAcks records the offsets a replica reports until its connection closes
+func (r *replication[U, K, V]) readAcks(conn net.Conn, link *replicaLink[U, K, V]) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "REPLACK" {
+			continue
+		}
+		if offset, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			link.ack.Store(offset)
+			link.lastAck.Store(time.Now().UnixNano())
+		}
+	}
+	r.mutex.Lock()
+	r.drop(link)
+	r.mutex.Unlock()
+}
+
+// info renders the replication section of INFO
+func (r *replication[U, K, V]) info() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var builder strings.Builder
+	builder.WriteString("# Replication\n")
+	if link := r.primary; link != nil {
+		status := "down"
+		if link.connected {
+			status = "up"
+		}
+		fmt.Fprintf(&builder, "role:replica\n")
+		fmt.Fprintf(&builder, "primary:%s\n", link.addr)
+		fmt.Fprintf(&builder, "link_status:%s\n", status)
+		fmt.Fprintf(&builder, "replid:%s\n", r.id)
+		fmt.Fprintf(&builder, "offset:%d\n", r.offset)
+		fmt.Fprintf(&builder, "primary_offset:%d\n", link.primaryOffset)
+		fmt.Fprintf(&builder, "lag:%d\n", link.primaryOffset-min(link.primaryOffset, r.offset))
+		if !link.lastIO.IsZero() {
+			fmt.Fprintf(&builder, "last_io_seconds_ago:%.1f\n", time.Since(link.lastIO).Seconds())
+		}
+		fmt.Fprintf(&builder, "full_syncs:%d\n", link.fullSyncs)
+		fmt.Fprintf(&builder, "partial_syncs:%d\n", link.partialSyncs)
+		if link.lastError != nil && !link.connected {
+			fmt.Fprintf(&builder, "last_error:%s\n", link.lastError)
+		}
+		return strings.TrimSuffix(builder.String(), "\n")
+	}
+
+	fmt.Fprintf(&builder, "role:primary\n")
+	fmt.Fprintf(&builder, "replid:%s\n", r.id)
+	fmt.Fprintf(&builder, "offset:%d\n", r.offset)
+	fmt.Fprintf(&builder, "backlog_entries:%d\n", len(r.backlog))
+	fmt.Fprintf(&builder, "connected_replicas:%d\n", len(r.replicas))
+	links := make([]*replicaLink[U, K, V], 0, len(r.replicas))
+	for link := range r.replicas {
+		links = append(links, link)
+	}
+	slices.SortFunc(links, func(a, b *replicaLink[U, K, V]) int { return strings.Compare(a.addr, b.addr) })
+	for _, link := range links {
+		ack := link.ack.Load()
+		fmt.Fprintf(&builder, "replica:%s ack_offset=%d lag=%d last_ack_seconds_ago=%.1f\n",
+			link.addr, ack, r.offset-min(r.offset, ack),
+			time.Since(time.Unix(0, link.lastAck.Load())).Seconds())
+	}
+	return strings.TrimSuffix(builder.String(), "\n")
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"errors"
+	"lrue/src"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testServer = Server[uint8, uint64, []byte]
+
+// listen serves a fresh manager on a loopback port
+func listen(t *testing.T) (*testServer, net.Listener) {
+	t.Helper()
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go Serve(listener, 256, srv)
+	t.Cleanup(func() {
+		listener.Close()
+		srv.Close()
+	})
+	return srv, listener
+}
+
+func startServer(t *testing.T) (*testServer, string) {
+	t.Helper()
+	srv, listener := listen(t)
+	return srv, listener.Addr().String()
+}
+
+func run(t *testing.T, srv *testServer, line string) (string, error) {
+	t.Helper()
+	cmd, err := Parse[uint64, []byte]([]byte(line))
+	if err != nil {
+		t.Fatalf("Parse(%q) error = %v", line, err)
+	}
+	return srv.Execute(cmd)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func inSync(primary, replica *testServer) func() bool {
+	return func() bool {
+		return reflect.DeepEqual(primary.mgr.Snapshot(), replica.mgr.Snapshot())
+	}
+}
+
+func TestReplication(t *testing.T) {
+	primary, addr := startServer(t)
+	replica, _ := startServer(t)
+	host, port, _ := net.SplitHostPort(addr)
+
+	for _, line := range []string{"CREATE users 16 ttl=1h", "SET users a 1", "SET users b 2 TAGS x"} {
+		if _, err := run(t, primary, line); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+	}
+
+	if _, err := run(t, replica, "REPLICAOF "+host+" "+port); err != nil {
+		t.Fatalf("REPLICAOF error = %v", err)
+	}
+	waitFor(t, "full sync", inSync(primary, replica))
+
+	if _, err := run(t, replica, "SET users c 3"); !errors.Is(err, ErrReplicaReadOnly) {
+		t.Errorf("Expected replica to reject writes, got %v", err)
+	}
+	if got, err := run(t, replica, "GET users a"); err != nil || got != "1" {
+		t.Errorf("Expected replica to serve reads, got %q, %v", got, err)
+	}
+
+	for _, line := range []string{"SET users c 3", "DEL users a", "INVALIDATE users x", "RENAME users people", "COPY people staff 4"} {
+		if _, err := run(t, primary, line); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+	}
+	waitFor(t, "streamed changes", inSync(primary, replica))
+
+	waitFor(t, "lag reporting", func() bool {
+		primaryInfo, _ := run(t, primary, "INFO replication")
+		replicaInfo, _ := run(t, replica, "INFO replication")
+		return strings.Contains(primaryInfo, "connected_replicas:1") &&
+			strings.Contains(primaryInfo, " lag=0 ") &&
+			strings.Contains(replicaInfo, "link_status:up") &&
+			strings.Contains(replicaInfo, "lag:0")
+	})
+
+	// A short disconnect resumes from the backlog instead of a new snapshot
+	primary.repl.mutex.Lock()
+	for link := range primary.repl.replicas {
+		primary.repl.drop(link)
+	}
+	primary.repl.mutex.Unlock()
+	run(t, primary, "SET people d 4")
+	waitFor(t, "partial resync", func() bool {
+		info, _ := run(t, replica, "INFO replication")
+		return strings.Contains(info, "partial_syncs:1") && inSync(primary, replica)()
+	})
+	if info, _ := run(t, replica, "INFO replication"); !strings.Contains(info, "full_syncs:1") {
+		t.Errorf("Expected a single full sync, got\n%s", info)
+	}
+
+	if _, err := run(t, replica, "REPLICAOF NO ONE"); err != nil {
+		t.Fatalf("REPLICAOF NO ONE error = %v", err)
+	}
+	if _, err := run(t, replica, "SET people e 5"); err != nil {
+		t.Errorf("Expected promoted replica to accept writes, got %v", err)
+	}
+	if info, _ := run(t, replica, "INFO replication"); !strings.Contains(info, "role:primary") {
+		t.Errorf("Expected promoted replica to report role:primary, got\n%s", info)
+	}
+}
+
+func TestParseReplicaOf(t *testing.T) {
+	for line, want := range map[string]string{
+		"REPLICAOF 127.0.0.1 7333": "127.0.0.1:7333",
+		"replicaof ::1 7333":       "[::1]:7333",
+		"REPLICAOF no one":         "",
+	} {
+		cmd, err := Parse[uint64, []byte]([]byte(line))
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", line, err)
+		} else if cmd.target != want {
+			t.Errorf("Parse(%q) target = %q, want %q", line, cmd.target, want)
+		}
+	}
+	for _, line := range []string{"REPLICAOF host", "REPLICAOF host port", "REPLICAOF host 0"} {
+		if _, err := Parse[uint64, []byte]([]byte(line)); err == nil {
+			t.Errorf("Parse(%q) expected an error", line)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"lrue/src"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	respMaxBulk  = 512 << 20
+	respMaxArray = 1 << 20
+)
+
+var errRESPProtocol = errors.New("Protocol error")
+
+// respConn is one RESP client. Keys are either written as "<cache>:<key>" or
+// belong to the cache chosen with SELECT.
+type respConn[U, K src.Uints, V ~[]byte] struct {
+	srv      *Server[U, K, V]
+	sess     *session[U, K, V]
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	proto    int
+	selected string
+}
+
+// readCommand reads a RESP array of bulk strings, or an inline command
+func (c *respConn[U, K, V]) readCommand() ([][]byte, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > respMaxArray {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	// Before AUTH the whole command must fit the command line limit
+	budget, total := c.sess.readLimit(), 0
+	args := make([][]byte, 0, min(max(n, 0), 64))
+	for range n {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errRESPProtocol, line)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > respMaxBulk || budget > 0 && total+size > budget {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		total += size
+		arg, err := readFull(c.reader, size+2)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: bulk string not terminated", errRESPProtocol)
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+func (c *respConn[U, K, V]) readLine() ([]byte, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("%w: line too long", errRESPProtocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+func (c *respConn[U, K, V]) simple(s string) {
+	fmt.Fprintf(c.writer, "+%s\r\n", s)
+}
+
+func (c *respConn[U, K, V]) fail(err error) {
+	msg := err.Error()
+	// Errors that already start with a Redis error code keep it
+	switch code, _, _ := strings.Cut(msg, " "); code {
+	case "READONLY", "EXECABORT", "NOPROTO", "NOAUTH", "NOPERM", "WRONGPASS", "RATELIMIT":
+	default:
+		msg = "ERR " + msg
+	}
+	fmt.Fprintf(c.writer, "-%s\r\n", strings.ReplaceAll(msg, "\n", " "))
+}
+
+func (c *respConn[U, K, V]) integer(n int) {
+	fmt.Fprintf(c.writer, ":%d\r\n", n)
+}
+
+func (c *respConn[U, K, V]) bulk(b []byte) {
+	fmt.Fprintf(c.writer, "$%d\r\n", len(b))
+	c.writer.Write(b)
+	c.writer.WriteString("\r\n")
+}
+
+func (c *respConn[U, K, V]) null() {
+	if c.proto == 3 {
+		c.writer.WriteString("_\r\n")
+	} else {
+		c.writer.WriteString("$-1\r\n")
+	}
+}
+
+func (c *respConn[U, K, V]) array(n int) {
+	fmt.Fprintf(c.writer, "*%d\r\n", n)
+}
+
+// locate splits a key into its cache and the key within it
+func (c *respConn[U, K, V]) locate(key []byte) (string, []byte, error) {
+	if c.selected != "" {
+		return c.selected, key, nil
+	}
+	if title, rest, ok := bytes.Cut(key, []byte(":")); ok && len(title) > 0 {
+		return string(title), rest, nil
+	}
+	return "", nil, fmt.Errorf("no cache for key '%s': use SELECT <cache> or <cache>:<key>", key)
+}
+
+// keyCommand builds a GET or SET command for a RESP key
+func (c *respConn[U, K, V]) keyCommand(op Cmd, key []byte) (*Command[K, V], error) {
+	title, key, err := c.locate(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Command[K, V]{operation: op, mapTitle: title, key: Hash[K](key), keySize: len(key)}, nil
+}
+
+// count runs fn on the cache of every key and returns how many calls reported
+// true, stopping at the first error. The user needs the permissions of op on
+// every cache.
+func (c *respConn[U, K, V]) count(op Cmd, keys [][]byte, fn func(tx *src.Tx[U, K, V], title string, key K) (bool, error)) (int, error) {
+	titles := make([]string, len(keys))
+	hashed := make([]K, len(keys))
+	for i, key := range keys {
+		title, key, err := c.locate(key)
+		if err != nil {
+			return 0, err
+		}
+		if err := c.sess.authorize(&Command[K, V]{operation: op, mapTitle: title}); err != nil {
+			return 0, err
+		}
+		titles[i], hashed[i] = title, Hash[K](key)
+	}
+	if err := c.sess.limit(&Command[K, V]{operation: op}); err != nil {
+		return 0, err
+	}
+	n := 0
+	err := c.srv.mgr.Update(titles, func(tx *src.Tx[U, K, V]) error {
+		for i := range keys {
+			ok, err := fn(tx, titles[i], hashed[i])
+			if err != nil {
+				return fmt.Errorf("%w: %s", err, titles[i])
+			}
+			if ok {
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// queue queues op on every key while a MULTI is open, replying QUEUED, so
+// that EXEC answers for each key. It reports false outside a transaction.
+func (c *respConn[U, K, V]) queue(op Cmd, keys [][]byte) bool {
+	if !c.sess.multi {
+		return false
+	}
+	for _, key := range keys {
+		cmd, err := c.keyCommand(op, key)
+		if err == nil {
+			_, err = c.sess.Execute(cmd)
+		}
+		if err != nil {
+			c.sess.failed = true
+			c.fail(err)
+			return true
+		}
+	}
+	c.simple("QUEUED")
+	return true
+}
+
+// execute runs one RESP command and writes its reply. It returns false once
+// the connection should be closed.
+func (c *respConn[U, K, V]) execute(args [][]byte) bool {
+	if len(args) == 0 {
+		return true
+	}
+	name := strings.ToUpper(string(args[0]))
+	arity := func(min, max int) bool {
+		if len(args) < min || (max > 0 && len(args) > max) {
+			c.fail(fmt.Errorf("wrong number of arguments for '%s' command", strings.ToLower(name)))
+			return false
+		}
+		return true
+	}
+
+	switch name {
+	case "PING":
+		if arity(1, 2) {
+			if len(args) == 2 {
+				c.bulk(args[1])
+			} else {
+				c.simple("PONG")
+			}
+		}
+	case "ECHO":
+		if arity(2, 2) {
+			c.bulk(args[1])
+		}
+	case "QUIT":
+		c.simple("OK")
+		return false
+	case "HELLO":
+		if len(args) >= 2 {
+			proto, err := strconv.Atoi(string(args[1]))
+			if err != nil || proto < 2 || proto > 3 {
+				c.fail(errors.New("NOPROTO unsupported protocol version"))
+				return true
+			}
+			c.proto = proto
+		}
+		fields := []string{"server", "lrue", "version", serverVersion, "proto", strconv.Itoa(c.proto), "mode", "standalone"}
+		if c.proto == 3 {
+			fmt.Fprintf(c.writer, "%%%d\r\n", len(fields)/2)
+		} else {
+			c.array(len(fields))
+		}
+		for i, field := range fields {
+			if i == 5 {
+				c.integer(c.proto)
+			} else {
+				c.bulk([]byte(field))
+			}
+		}
+	case "SELECT":
+		if arity(2, 2) {
+			title := string(args[1])
+			cache := c.srv.mgr.GetCache(title)
+			if cache == nil {
+				c.fail(fmt.Errorf("%w: %s", src.ErrCacheNotFound, title))
+				return true
+			}
+			cache.Release()
+			c.selected = title
+			c.simple("OK")
+		}
+	case "GET":
+		if !arity(2, 2) {
+			return true
+		}
+		cmd, err := c.keyCommand(Cmd_GET, args[1])
+		if err != nil {
+			c.fail(err)
+			return true
+		}
+		result, err := c.sess.Execute(cmd)
+		switch {
+		case errors.Is(err, src.ErrKeyNotFound):
+			c.null()
+		case err != nil:
+			c.fail(err)
+		case result == "QUEUED":
+			c.simple(result)
+		default:
+			c.bulk([]byte(result))
+		}
+	case "SET":
+		if len(args) > 3 {
+			c.fail(errors.New("SET options are not supported, caches apply their own ttl"))
+			return true
+		}
+		if !arity(3, 3) {
+			return true
+		}
+		cmd, err := c.keyCommand(Cmd_SET, args[1])
+		if err != nil {
+			c.fail(err)
+			return true
+		}
+		cmd.value = args[2]
+		if result, err := c.sess.Execute(cmd); err != nil {
+			c.fail(err)
+		} else {
+			c.reply(result)
+		}
+	case "DEL", "UNLINK":
+		if !arity(2, 0) || c.queue(Cmd_DEL, args[1:]) {
+			return true
+		}
+		if c.srv.repl.following.Load() {
+			c.fail(ErrReplicaReadOnly)
+			return true
+		}
+		n, err := c.count(Cmd_DEL, args[1:], func(tx *src.Tx[U, K, V], title string, key K) (bool, error) {
+			return tx.Eject(title, key)
+		})
+		if err != nil {
+			c.fail(err)
+		} else {
+			c.integer(n)
+		}
+	case "EXISTS":
+		if !arity(2, 0) || c.queue(Cmd_GET, args[1:]) {
+			return true
+		}
+		n, err := c.count(Cmd_GET, args[1:], func(tx *src.Tx[U, K, V], title string, key K) (bool, error) {
+			_, found, _ := tx.Get(title, key)
+			return found, nil
+		})
+		if err != nil {
+			c.fail(err)
+		} else {
+			c.integer(n)
+		}
+	case "COMMAND":
+		// redis-cli asks for command docs on startup; an empty reply is accepted
+		c.array(0)
+	case "CLIENT":
+		// redis-cli sends CLIENT SETINFO and the like, which need no reply
+		if len(args) >= 2 && (strings.EqualFold(string(args[1]), "LIST") || strings.EqualFold(string(args[1]), "KILL")) {
+			c.passThrough(args)
+			return true
+		}
+		c.simple("OK")
+	case "CONFIG":
+		// redis-benchmark reads Redis settings such as "save" before running
+		if len(args) == 3 && strings.EqualFold(string(args[1]), "GET") &&
+			!slices.Contains(serverOptions, strings.ToLower(string(args[2]))) {
+			c.array(0)
+			return true
+		}
+		c.passThrough(args)
+	default:
+		c.passThrough(args)
+	}
+	return true
+}
+
+// passThrough runs any other lrue command given as RESP arguments
+func (c *respConn[U, K, V]) passThrough(args [][]byte) {
+	cmd, err := parseArgs[K, V](args)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	switch cmd.operation {
+	case Cmd_REPLSYNC, Cmd_SUBSCRIBE, Cmd_UNSUBSCRIBE, Cmd_BINARY:
+		c.fail(fmt.Errorf("%s is not supported over RESP", cmd.operation))
+		return
+	}
+	if cmd.operation == Cmd_CLUSTER && cmd.sub == Cmd_GOSSIP {
+		c.fail(fmt.Errorf("%s %s is not supported over RESP", cmd.operation, cmd.sub))
+		return
+	}
+	result, err := c.sess.Execute(cmd)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.reply(result)
+}
+
+// reply writes a command result: single-line status replies as simple
+// strings, anything else as a bulk string
+func (c *respConn[U, K, V]) reply(result string) {
+	if result == "OK" || result == "QUEUED" {
+		c.simple(result)
+		return
+	}
+	c.bulk([]byte(result))
+}
+
+func handleRESP[U, K src.Uints, V ~[]byte](client *tcpClient, srv *Server[U, K, V]) {
+	conn := client.conn
+	defer srv.clients.remove(client)
+	defer conn.Close()
+	c := &respConn[U, K, V]{
+		srv:    srv,
+		sess:   srv.newSession(),
+		reader: bufio.NewReaderSize(conn, 64<<10),
+		writer: bufio.NewWriterSize(conn, 64<<10),
+		proto:  2,
+	}
+	defer c.sess.close()
+	if !c.sess.handshake(client) {
+		return
+	}
+
+	for {
+		if err := srv.clients.next(client, c.reader); err != nil {
+			if errors.Is(err, ErrServerClosed) || errors.Is(err, errIdleTimeout) {
+				c.fail(err)
+				c.writer.Flush()
+			}
+			return
+		}
+		args, err := c.readCommand()
+		if err != nil && !errors.Is(err, errRESPProtocol) {
+			if err = srv.clients.readFailed(err); err == nil {
+				continue
+			}
+		}
+		if errors.Is(err, errRESPProtocol) || errors.Is(err, errReadTimeout) {
+			c.fail(err)
+			c.writer.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) > 0 {
+			client.observe(Cmd(strings.ToUpper(string(args[0]))))
+		}
+		open := c.execute(args)
+		client.user.Store(c.sess.user)
+		// Pipelined commands are answered together once the input is drained
+		if c.reader.Buffered() == 0 || !open {
+			if err := c.writer.Flush(); err != nil {
+				return
+			}
+		}
+		if !open {
+			return
+		}
+	}
+}
+
+// ServeRESP accepts RESP connections on listener until it is closed or the
+// server shuts down. They share the server's connection limit and timeouts.
+func ServeRESP[U, K src.Uints, V ~[]byte](listener net.Listener, srv *Server[U, K, V]) {
+	srv.clients.serve(srv.tlsListener(listener), "-ERR %s\r\n", func(client *tcpClient) {
+		handleRESP(client, srv)
+	})
+}
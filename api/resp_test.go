@@ -0,0 +1,126 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"lrue/src"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respArray encodes a command as a RESP array of bulk strings
+func respArray(args ...string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return b.String()
+}
+
+func TestRESP(t *testing.T) {
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	defer srv.Close()
+	run(t, srv, "CREATE users 8")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer listener.Close()
+	go ServeRESP(listener, srv)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	expect := func(want string) {
+		t.Helper()
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(reader, got); err != nil || string(got) != want {
+			t.Fatalf("Expected %q, got %q, %v", want, got, err)
+		}
+	}
+
+	// A pipeline is answered in order
+	conn.Write([]byte(respArray("PING") +
+		respArray("SET", "users:alice", "line\r\nbreak") +
+		respArray("GET", "users:alice") +
+		respArray("GET", "users:bob") +
+		respArray("EXISTS", "users:alice", "users:bob") +
+		respArray("DEL", "users:alice", "users:bob") +
+		respArray("GET", "alice") +
+		respArray("SET", "users:a", "1", "EX", "10")))
+	expect("+PONG\r\n")
+	expect("+OK\r\n")
+	expect("$11\r\nline\r\nbreak\r\n")
+	expect("$-1\r\n")
+	expect(":1\r\n")
+	expect(":1\r\n")
+	expect("-ERR no cache for key 'alice': use SELECT <cache> or <cache>:<key>\r\n")
+	expect("-ERR SET options are not supported, caches apply their own ttl\r\n")
+
+	// SELECT picks the cache for plain keys, and other lrue commands pass through
+	conn.Write([]byte(respArray("SELECT", "users") + respArray("SET", "carol", "3") + "GET carol\r\n" +
+		respArray("SELECT", "nope") + respArray("LIST")))
+	expect("+OK\r\n+OK\r\n$1\r\n3\r\n")
+	expect("-ERR cache not found: nope\r\n")
+	header, _ := reader.ReadString('\n')
+	size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+	list := make([]byte, size+2)
+	io.ReadFull(reader, list)
+	if !strings.HasPrefix(string(list), "users capacity=8") {
+		t.Errorf("Expected LIST as a bulk string, got %q%q", header, list)
+	}
+
+	// RESP3 has a dedicated null type
+	conn.Write([]byte(respArray("HELLO", "3") + respArray("GET", "missing")))
+	expect("%4\r\n$6\r\nserver\r\n$4\r\nlrue\r\n$7\r\nversion\r\n$5\r\n1.0.0\r\n$5\r\nproto\r\n:3\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n")
+	expect("_\r\n")
+
+	if got, _ := run(t, srv, "GET users carol"); got != "3" {
+		t.Errorf("Expected RESP writes to reach the cache, got %q", got)
+	}
+
+	// CONFIG GET answers Redis settings with nothing and lrue ones for real
+	conn.Write([]byte(respArray("CONFIG", "GET", "save") + respArray("CONFIG", "GET", "conn-limits") +
+		respArray("CONFIG", "GET", "users", "max_value_size")))
+	expect("*0\r\n")
+	limits := Limits{}.String()
+	expect(fmt.Sprintf("$%d\r\n%s\r\n", len(limits), limits))
+	expect("$1\r\n0\r\n")
+
+	// Arguments of passed through commands keep their spaces
+	conn.Write([]byte(respArray("CONFIG", "SET", "users", "description", "two  words")))
+	expect("+OK\r\n")
+	if got, _ := run(t, srv, "CONFIG GET users description"); got != "two  words" {
+		t.Errorf("Expected the description unchanged, got %q", got)
+	}
+
+	// Inside MULTI, DEL and EXISTS are queued like any other command
+	conn.Write([]byte(respArray("MULTI") + respArray("DEL", "carol") + respArray("EXISTS", "carol")))
+	expect("+OK\r\n+QUEUED\r\n+QUEUED\r\n")
+	if got, _ := run(t, srv, "GET users carol"); got != "3" {
+		t.Errorf("Expected a queued DEL to wait for EXEC, got %q", got)
+	}
+	conn.Write([]byte(respArray("EXEC")))
+	exec := "1) OK\n2) ERR key not found"
+	expect(fmt.Sprintf("$%d\r\n%s\r\n", len(exec), exec))
+
+	// DEL fails on a read-only cache instead of reporting nothing removed
+	run(t, srv, "CONFIG SET users readonly true")
+	conn.Write([]byte(respArray("UNLINK", "carol")))
+	expect("-ERR cache is read-only: users\r\n")
+
+	conn.Write([]byte(respArray("QUIT")))
+	expect("+OK\r\n")
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected QUIT to close the connection, got %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lrue/src"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverVersion is reported to clients of the compatibility protocols
+const serverVersion = "1.0.0"
+
+// ErrReplicaReadOnly is returned for writes sent to a replica
+var ErrReplicaReadOnly = errors.New("READONLY replica does not accept writes")
+
+// Server holds a cache manager together with the state shared by every
+// client interface serving it, such as replication
+type Server[U, K src.Uints, V ~[]byte] struct {
+	mgr    *src.CacheManager[U, K, V]
+	repl   *replication[U, K, V]
+	gossip *membership
+	peers  *peerDialer // shared by replication and gossip
+	acl    atomic.Pointer[ACL]
+	limits *rateLimits
+	// maxCommand is the longest command line accepted on TCP connections
+	maxCommand atomic.Int64
+	ctx        context.Context // cancelled by Close to release blocked commands
+	cancel     context.CancelFunc
+	// clients are the connections accepted by Serve, drained by Shutdown
+	clients      *tcpClients
+	drainTimeout time.Duration
+	hooks        []func()
+	shutdown     sync.Once
+	shutdownErr  error
+}
+
+func NewServer[U, K src.Uints, V ~[]byte](mgr *src.CacheManager[U, K, V]) *Server[U, K, V] {
+	repl := newReplication(mgr)
+	gossip := newMembership(repl)
+	gossip.dialer = repl.peers
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server[U, K, V]{
+		mgr:    mgr,
+		repl:   repl,
+		gossip: gossip,
+		peers:  repl.peers,
+		limits: newRateLimits(),
+		ctx:    ctx,
+		cancel: cancel,
+
+		clients:      newTCPClients(),
+		drainTimeout: defaultDrainTimeout,
+	}
+	s.maxCommand.Store(defaultMaxCommand)
+	return s
+}
+
+// SetMaxCommandSize sets the longest command line, in bytes, accepted on TCP
+// connections; longer commands are answered with an error
+func (s *Server[U, K, V]) SetMaxCommandSize(n int) {
+	s.maxCommand.Store(int64(n))
+}
+
+// Manager returns the cache manager the server executes commands against
+func (s *Server[U, K, V]) Manager() *src.CacheManager[U, K, V] {
+	return s.mgr
+}
+
+// ReplicaOf makes the server follow the primary at addr, or promotes it back to
+// a primary when addr is empty
+func (s *Server[U, K, V]) ReplicaOf(addr string) {
+	if addr == "" {
+		s.repl.promote()
+		return
+	}
+	s.repl.follow(addr)
+}
+
+// Announce sets the address other cluster nodes use to reach this server.
+// Without it the address of the first listener passed to Serve is used.
+func (s *Server[U, K, V]) Announce(addr string) {
+	s.gossip.announce(addr)
+}
+
+// Close stops cluster gossip and replication in both directions and releases
+// clients blocked in WAITGET
+func (s *Server[U, K, V]) Close() {
+	s.cancel()
+	s.gossip.close()
+	s.repl.close()
+}
+
+// Execute runs a command on behalf of a client, handling the commands that
+// need server state and rejecting writes while the server is a replica
+func (s *Server[U, K, V]) Execute(cmd *Command[K, V]) (string, error) {
+	switch cmd.operation {
+	case Cmd_REPLICAOF:
+		s.ReplicaOf(cmd.target)
+		return "OK", nil
+	case Cmd_REPLSYNC, Cmd_SUBSCRIBE, Cmd_BINARY:
+		return "", fmt.Errorf("%s is only accepted on TCP connections", cmd.operation)
+	case Cmd_CLUSTER:
+		switch cmd.sub {
+		case Cmd_MEET:
+			s.gossip.meet(cmd.target)
+			return "OK", nil
+		case Cmd_NODES:
+			return s.gossip.nodes(), nil
+		case Cmd_INFO:
+			return s.gossip.info(), nil
+		}
+		return "", fmt.Errorf("%s %s is only accepted on TCP connections", cmd.operation, cmd.sub)
+	case Cmd_WAITGET:
+		return waitGet(s.ctx, s.mgr, cmd)
+	case Cmd_MULTI, Cmd_EXEC, Cmd_DISCARD, Cmd_WATCH, Cmd_UNWATCH, Cmd_AUTH, Cmd_ACL:
+		return "", fmt.Errorf("%s is only accepted on client connections", cmd.operation)
+	case Cmd_UNSUBSCRIBE:
+		return "", fmt.Errorf("not subscribed")
+	case Cmd_INFO:
+		return s.info(cmd.option)
+	case Cmd_CLIENT:
+		if cmd.sub == Cmd_LIST {
+			return s.clients.list(), nil
+		}
+		if err := s.clients.kill(cmd.target); err != nil {
+			return "", err
+		}
+		return "OK", nil
+	case Cmd_CONFIG:
+		if cmd.mapTitle == "" {
+			return s.config(cmd)
+		}
+	}
+	if cmd.writes() && s.repl.following.Load() {
+		return "", ErrReplicaReadOnly
+	}
+	return Execute(s.mgr, cmd)
+}
+
+func (s *Server[U, K, V]) info(section string) (string, error) {
+	switch strings.ToLower(section) {
+	case "", "all":
+		return infoMemory(s.mgr) + "\n\n" + infoCaches(s.mgr) + "\n\n" + s.repl.info() + "\n\n" + s.limits.info(), nil
+	case "replication":
+		return s.repl.info(), nil
+	case "limits":
+		return s.limits.info(), nil
+	}
+	return infoSections(s.mgr, section)
+}
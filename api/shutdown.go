@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultDrainTimeout bounds how long Shutdown waits for in-flight commands
+// unless the server is given another with SetDrainTimeout
+const defaultDrainTimeout = 10 * time.Second
+
+// drain closes the listeners, interrupts connections waiting for a command
+// and closes streaming ones, then waits for the rest and for HTTP requests in
+// flight until ctx is done, when they are closed too
+func (c *tcpClients) drain(ctx context.Context) error {
+	c.mutex.Lock()
+	c.draining.Store(true)
+	for listener := range c.listeners {
+		listener.Close()
+	}
+	if len(c.conns) > 0 {
+		fmt.Printf("Draining %d connections\n", len(c.conns))
+	}
+	for _, client := range c.conns {
+		if client.streaming.Load() {
+			client.conn.Close()
+		} else {
+			// Fails the pending read; commands already running finish first
+			client.conn.SetReadDeadline(time.Now())
+		}
+	}
+	var servers sync.WaitGroup
+	for server := range c.httpServers {
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			// Lets requests in flight finish, closing the server when ctx is done
+			if server.Shutdown(ctx) != nil {
+				server.Close()
+			}
+		}()
+	}
+	c.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.active.Wait()
+		servers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, client := range c.conns {
+		client.conn.Close()
+	}
+	return ctx.Err()
+}
+
+// SetDrainTimeout sets how long ListenAndServe lets in-flight commands finish once
+// its context is done
+func (s *Server[U, K, V]) SetDrainTimeout(d time.Duration) {
+	s.drainTimeout = d
+}
+
+// OnShutdown registers fn to run at the end of Shutdown, once no client is
+// connected anymore, e.g. to persist or flush the caches. Hooks run in the
+// order they were registered and must be registered before serving.
+func (s *Server[U, K, V]) OnShutdown(fn func()) {
+	s.hooks = append(s.hooks, fn)
+}
+
+// Shutdown stops the TCP and HTTP listeners, tells idle clients the server is shutting
+// down and lets in-flight commands finish until ctx is done, when the
+// remaining connections are closed. It then closes the server and runs the
+// OnShutdown hooks. Later calls wait for the first one and return its result.
+func (s *Server[U, K, V]) Shutdown(ctx context.Context) error {
+	s.shutdown.Do(func() {
+		// Blocked WAITGETs would otherwise hold the drain until the timeout
+		s.cancel()
+		s.shutdownErr = s.clients.drain(ctx)
+		s.Close()
+		for _, hook := range s.hooks {
+			hook()
+		}
+	})
+	return s.shutdownErr
+}
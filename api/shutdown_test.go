@@ -0,0 +1,142 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"lrue/src"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	srv, addr := startServer(t)
+	run(t, srv, "CREATE users 10")
+	flushed := false
+	srv.OnShutdown(func() { flushed = srv.mgr.GetCache("users") != nil })
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		return conn, reader
+	}
+	expect := func(reader *bufio.Reader, want string) {
+		t.Helper()
+		if line, err := reader.ReadString('\n'); err != nil || line != want+"\r\n" {
+			t.Errorf("Expected %q, got %q, %v", want, line, err)
+		}
+	}
+
+	_, idle := dial()
+	waiting, waitReader := dial()
+	waiting.Write([]byte("WAITGET users alice 0\r\n"))
+	subscriber, subReader := dial()
+	subscriber.Write([]byte("SUBSCRIBE users\r\n"))
+	expect(subReader, "SUBSCRIBED users set,del,expire,evict,clear")
+	waitFor(t, "clients to connect", func() bool {
+		srv.clients.mutex.Lock()
+		defer srv.clients.mutex.Unlock()
+		return len(srv.clients.conns) == 3
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	expect(idle, "ERR server is shutting down")
+	expect(waitReader, "ERR server is shutting down")
+	if _, err := subReader.ReadString('\n'); err != io.EOF {
+		t.Errorf("Expected the subscriber to be disconnected, got %v", err)
+	}
+	if !flushed {
+		t.Errorf("Expected the shutdown hook to run with the caches in place")
+	}
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("Expected the listener to be closed")
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Second Shutdown() error = %v", err)
+	}
+}
+
+func TestShutdownRESPMemcached(t *testing.T) {
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	run(t, srv, "CREATE users 10")
+	var addrs []string
+	serve := func(accept func(net.Listener)) (net.Conn, *bufio.Reader) {
+		t.Helper()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen() error = %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go accept(listener)
+		addrs = append(addrs, listener.Addr().String())
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	waiting, respReader := serve(func(l net.Listener) { ServeRESP(l, srv) })
+	_, mcReader := serve(func(l net.Listener) { ServeMemcached(l, srv, "users") })
+	drained := false
+	srv.OnShutdown(func() {
+		srv.clients.mutex.Lock()
+		defer srv.clients.mutex.Unlock()
+		drained = len(srv.clients.conns) == 0
+	})
+
+	waiting.Write([]byte("WAITGET users alice 5\r\n"))
+	waitFor(t, "the RESP command to start", func() bool {
+		srv.clients.mutex.Lock()
+		defer srv.clients.mutex.Unlock()
+		waits := false
+		for _, client := range srv.clients.conns {
+			if op := client.lastCmd.Load(); op != nil && *op == Cmd_WAITGET {
+				waits = true
+			}
+		}
+		return waits && len(srv.clients.conns) == 2
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	for _, want := range []string{"-ERR server is shutting down", "-ERR server is shutting down"} {
+		if line, err := respReader.ReadString('\n'); err != nil || line != want+"\r\n" {
+			t.Errorf("Expected %q over RESP, got %q, %v", want, line, err)
+		}
+	}
+	if line, err := mcReader.ReadString('\n'); err != nil || line != "SERVER_ERROR server is shutting down\r\n" {
+		t.Errorf("Expected the memcached client to be told of the shutdown, got %q, %v", line, err)
+	}
+	for _, reader := range []*bufio.Reader{respReader, mcReader} {
+		if _, err := reader.ReadString('\n'); err != io.EOF {
+			t.Errorf("Expected the connection to be closed, got %v", err)
+		}
+	}
+	if !drained {
+		t.Errorf("Expected the shutdown hook to run once RESP and memcached were drained")
+	}
+	for _, addr := range addrs {
+		if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			conn.Close()
+			t.Errorf("Expected the listener on %s to be closed", addr)
+		}
+	}
+}
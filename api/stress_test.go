@@ -0,0 +1,130 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"lrue/src"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pipeClient drives handleConnection the way a TCP client would
+type pipeClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialPipe(t *testing.T, srv *Server[uint8, uint64, []byte]) *pipeClient {
+	t.Helper()
+	server, client := net.Pipe()
+	accepted, err := srv.clients.add(server)
+	if err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	go handleConnection(accepted, 256, srv)
+	c := &pipeClient{conn: client, reader: bufio.NewReader(client)}
+	if _, err := c.reader.ReadString('\n'); err != nil {
+		t.Fatalf("reading greeting: %v", err)
+	}
+	return c
+}
+
+func (c *pipeClient) do(line string) (string, error) {
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		return "", err
+	}
+	// Replies end in \r\n, while multi-line results such as PRINT use bare \n
+	var reply strings.Builder
+	for !strings.HasSuffix(reply.String(), "\r\n") {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		reply.WriteString(line)
+	}
+	return strings.TrimRight(reply.String(), "\r\n"), nil
+}
+
+func TestStressManager(t *testing.T) {
+	mgr := src.NewCacheManager[uint8, uint64, []byte]()
+	srv := NewServer(mgr)
+	defer srv.Close()
+	caches := []string{"alpha", "beta", "gamma", "delta"}
+	const rounds = 300
+
+	clients := make([]*pipeClient, 4)
+	for i := range clients {
+		clients[i] = dialPipe(t, srv)
+	}
+
+	var wg sync.WaitGroup
+
+	// CLI-like caller: creates, lists and destroys caches through Execute
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range rounds {
+			name := caches[i%len(caches)]
+			for _, line := range []string{
+				fmt.Sprintf("CREATE %s 8 IFNOTEXISTS", name),
+				"LIST",
+				fmt.Sprintf("SET %s k%d v%d", name, i, i),
+			} {
+				cmd, err := Parse[uint64, []byte]([]byte(line))
+				if err != nil {
+					t.Errorf("Parse(%q) error = %v", line, err)
+					return
+				}
+				Execute(mgr, cmd)
+			}
+			if i%5 == 0 {
+				cmd, _ := Parse[uint64, []byte]([]byte("DESTROY " + name))
+				Execute(mgr, cmd)
+			}
+		}
+	}()
+
+	// TCP-like callers: one goroutine per connection issuing key commands
+	for id, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.conn.Close()
+			for i := range rounds {
+				name := caches[(i+id)%len(caches)]
+				for _, line := range []string{
+					fmt.Sprintf("SET %s k%d v%d", name, i, id),
+					fmt.Sprintf("GET %s k%d", name, i),
+					fmt.Sprintf("DEL %s k%d", name, i-1),
+					fmt.Sprintf("PRINT %s", name),
+				} {
+					if _, err := c.do(line); err != nil {
+						t.Errorf("client %d: %q: %v", id, line, err)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	// Readers holding handles across destroys must keep working
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range rounds {
+			name := caches[i%len(caches)]
+			cache, _, _ := mgr.CreateIfAbsent(name, 8, src.CacheOptions{})
+			cache.Put(uint64(i), []byte("held"))
+			cache.Get(uint64(i))
+			cache.Release()
+		}
+	}()
+
+	wg.Wait()
+	mgr.ClearAllCaches()
+	if names := mgr.ListCaches(); len(names) != 0 {
+		t.Errorf("Expected no caches after ClearAllCaches, got %v", names)
+	}
+}
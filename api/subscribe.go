@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"lrue/src"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before it is dropped
+const subscriberBuffer = 1024
+
+// subscribeKinds are the events SUBSCRIBE can ask for, and the default set
+var subscribeKinds = []src.EventKind{src.EventSet, src.EventDel, src.EventExpire, src.EventEvict, src.EventClear}
+
+// parseEventKinds reads a comma separated list of event names
+func parseEventKinds(list string) ([]src.EventKind, error) {
+	var kinds []src.EventKind
+	for name := range strings.SplitSeq(strings.ToLower(list), ",") {
+		i := slices.IndexFunc(subscribeKinds, func(k src.EventKind) bool { return k.String() == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown event: %s (expected set, del, expire, evict or clear)", name)
+		}
+		if !slices.Contains(kinds, subscribeKinds[i]) {
+			kinds = append(kinds, subscribeKinds[i])
+		}
+	}
+	return kinds, nil
+}
+
+// subscriber buffers the formatted events of one SUBSCRIBE connection. The
+// observer never blocks: when the buffer is full the subscriber is dropped.
+type subscriber struct {
+	lines    chan string
+	dropped  chan struct{}
+	dropOnce sync.Once
+	cancel   func()
+}
+
+// subscribe starts buffering events of the given kinds on cache
+func subscribe[U, K src.Uints, V ~[]byte](mgr *src.CacheManager[U, K, V], cache string, kinds []src.EventKind) *subscriber {
+	sub := &subscriber{
+		lines:   make(chan string, subscriberBuffer),
+		dropped: make(chan struct{}),
+	}
+	sub.cancel = mgr.Observe(func(ev src.Event[U, K, V]) {
+		if ev.Cache != cache || !slices.Contains(kinds, ev.Kind) {
+			return
+		}
+		select {
+		case sub.lines <- formatEvent(ev):
+		default:
+			sub.dropOnce.Do(func() { close(sub.dropped) })
+		}
+	})
+	return sub
+}
+
+// formatEvent renders an event as "EVENT <kind> <cache> [<hashed_key> [<base64_value|->]]"
+func formatEvent[U, K src.Uints, V ~[]byte](ev src.Event[U, K, V]) string {
+	switch ev.Kind {
+	case src.EventClear:
+		return fmt.Sprintf("EVENT %s %s", ev.Kind, ev.Cache)
+	case src.EventSet:
+		value := "-"
+		if len(ev.Value) > 0 {
+			value = base64.StdEncoding.EncodeToString(ev.Value)
+		}
+		return fmt.Sprintf("EVENT %s %s %d %s", ev.Kind, ev.Cache, ev.Key, value)
+	}
+	return fmt.Sprintf("EVENT %s %s %d", ev.Kind, ev.Cache, ev.Key)
+}
+
+// serveSubscriber streams events to conn until the client sends UNSUBSCRIBE,
+// disconnects or falls too far behind. It reports whether the connection can
+// go back to handling commands.
+func serveSubscriber[U, K src.Uints, V ~[]byte](conn *bufferedConn, srv *Server[U, K, V], cmd *Command[K, V]) bool {
+	names := make([]string, len(cmd.events))
+	for i, kind := range cmd.events {
+		names[i] = kind.String()
+	}
+	sub := subscribe(srv.mgr, cmd.mapTitle, cmd.events)
+	defer sub.cancel()
+	if _, err := fmt.Fprintf(conn, "SUBSCRIBED %s %s\r\n", cmd.mapTitle, strings.Join(names, ",")); err != nil {
+		return false
+	}
+
+	// Only UNSUBSCRIBE is accepted while subscribed; the reader stops after it
+	// so the command loop can reuse the connection
+	unsubscribed, closed := make(chan struct{}), make(chan struct{})
+	go func() {
+		for {
+			line, err := readCommand(conn.reader, int(srv.maxCommand.Load()))
+			if errors.Is(err, errCommandTooLarge) {
+				continue
+			}
+			if err != nil {
+				close(closed)
+				return
+			}
+			if next, err := Parse[K, V](line); err == nil && next.operation == Cmd_UNSUBSCRIBE {
+				close(unsubscribed)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case line := <-sub.lines:
+			if _, err := fmt.Fprintf(conn, "%s\r\n", line); err != nil {
+				return false
+			}
+		case <-sub.dropped:
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			fmt.Fprintf(conn, "ERR subscriber dropped: more than %d events behind\r\n", subscriberBuffer)
+			return false
+		case <-unsubscribed:
+			sub.cancel()
+			_, err := conn.Write([]byte("UNSUBSCRIBED\r\n"))
+			return err == nil
+		case <-closed:
+			return false
+		}
+	}
+}
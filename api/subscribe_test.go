@@ -0,0 +1,83 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"lrue/src"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	srv, addr := startServer(t)
+	run(t, srv, "CREATE users 1")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	expect := func(want string) {
+		t.Helper()
+		line, err := reader.ReadString('\n')
+		if err != nil || line != want+"\r\n" {
+			t.Fatalf("Expected %q, got %q, %v", want, line, err)
+		}
+	}
+	expect("Connected to lru engine")
+
+	conn.Write([]byte("SUBSCRIBE users set,evict\r\n"))
+	expect("SUBSCRIBED users set,evict")
+
+	run(t, srv, "SET users a 1")
+	run(t, srv, "SET users b 2")
+	run(t, srv, "DEL users b")
+	run(t, srv, "SET users c 3")
+	a, b, c := Hash[uint64]([]byte("a")), Hash[uint64]([]byte("b")), Hash[uint64]([]byte("c"))
+	expect(fmt.Sprintf("EVENT set users %d MQ==", a))
+	expect(fmt.Sprintf("EVENT evict users %d", a))
+	expect(fmt.Sprintf("EVENT set users %d Mg==", b))
+	expect(fmt.Sprintf("EVENT set users %d Mw==", c))
+
+	conn.Write([]byte("UNSUBSCRIBE\r\n"))
+	expect("UNSUBSCRIBED")
+	conn.Write([]byte("GET users c\r\n"))
+	expect("3")
+
+	if _, err := Parse[uint64, []byte]([]byte("SUBSCRIBE users set,nope")); err == nil {
+		t.Errorf("Expected unknown event names to be rejected")
+	}
+}
+
+func TestSubscribeSlowConsumer(t *testing.T) {
+	mgr := src.NewCacheManager[uint16, uint64, []byte]()
+	mgr.CreateCache("users", 100, src.CacheOptions{})
+	cache := mgr.GetCache("users")
+	sub := subscribe(mgr, "users", subscribeKinds)
+	defer sub.cancel()
+
+	// Nobody drains the subscriber, yet writers never block
+	done := make(chan struct{})
+	go func() {
+		for i := range subscriberBuffer + 10 {
+			cache.Put(uint64(i), []byte("v"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Writers blocked on a slow subscriber")
+	}
+	select {
+	case <-sub.dropped:
+	default:
+		t.Errorf("Expected the slow subscriber to be dropped")
+	}
+	if n := len(sub.lines); n != subscriberBuffer {
+		t.Errorf("Expected a full buffer of %d events, got %d", subscriberBuffer, n)
+	}
+}
@@ -1,81 +1,205 @@
 package api
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"lrue/src"
 	"net"
-	"sync"
-	"sync/atomic"
+	"slices"
+	"strconv"
+	"time"
 )
 
-const maxConnections = 256
+// defaultMaxCommand is the longest command line accepted unless the server
+// is given another limit with SetMaxCommandSize
+const defaultMaxCommand = 1 << 20
 
-var bufferPool sync.Pool
+// errCommandTooLarge is answered for a command line above the size limit; the
+// line is skipped and the connection stays usable
+var errCommandTooLarge = errors.New("command too large")
 
-func handleConnection[U, K src.Uints, V ~[]byte](conn net.Conn, bufferSize uint16, mgr *src.CacheManager[U, K, V]) {
-	if bufferPool.New == nil {
-		bufferPool.New = func() any {
-			b := make([]byte, bufferSize)
-			return &b
-		}
-	}
-	buf := bufferPool.Get().(*[]byte)
-	defer func() {
-		conn.Close()
-		bufferPool.Put(buf)
-	}()
+// bufferedConn lets the handlers that take over a connection read through the
+// command reader, so bytes it already buffered are not lost
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
 
-	conn.Write([]byte("Connected to lru engine\r\n"))
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// readCommand reads one command line terminated by \n and strips the line
+// ending. A line longer than limit is consumed and reported as
+// errCommandTooLarge.
+func readCommand(reader *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
 	for {
-		input := *buf
-		n, err := conn.Read(input)
-		if err != nil {
-			fmt.Printf("Connection closed by client\n")
-			break
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > limit+2 {
+			for errors.Is(err, bufio.ErrBufferFull) {
+				_, err = reader.ReadSlice('\n')
+			}
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%w: more than %d bytes", errCommandTooLarge, limit)
 		}
-
-		cmd, err := Parse[K, V](input[:n])
-		if err != nil {
-			conn.Write(fmt.Appendf(nil, "ERR %s\r\n", err))
+		line = append(line, chunk...)
+		if errors.Is(err, bufio.ErrBufferFull) {
 			continue
 		}
-
-		result, err := Execute(mgr, cmd)
 		if err != nil {
-			conn.Write(fmt.Appendf(nil, "ERR %s\r\n", err))
-		} else {
-			conn.Write(fmt.Appendf(nil, "%s\r\n", result))
+			return nil, err
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+}
+
+// readChunk bounds the buffer readFull allocates before data arrives
+const readChunk = 64 << 10
+
+// readFull reads exactly n bytes from r. The buffer grows as the bytes
+// arrive, so a length announced by a client costs no memory until it is sent.
+func readFull(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, 0, min(n, readChunk))
+	for len(buf) < n {
+		step := min(n-len(buf), max(len(buf), readChunk))
+		buf = slices.Grow(buf, step)
+		if _, err := io.ReadFull(r, buf[len(buf):len(buf)+step]); err != nil {
+			return nil, err
 		}
+		buf = buf[:len(buf)+step]
 	}
+	return buf, nil
 }
 
-func ServerTCP[U, K src.Uints, V ~[]byte](
-	port string,
-	bufferSize uint16,
-	mgr *src.CacheManager[U, K, V],
-) {
-	var activeConnections int32 = 0
-	listener, err := net.Listen("tcp", ":"+port)
-	if err != nil {
-		src.FatalError("Failed to start TCP server", err)
+// handleConnection answers the commands of one client in order, then releases
+// its connection slot. Commands are separated by \n and may be pipelined;
+// replies to pipelined commands are written together once the input is drained.
+func handleConnection[U, K src.Uints, V ~[]byte](client *tcpClient, bufferSize uint16, srv *Server[U, K, V]) {
+	conn := client.conn
+	defer srv.clients.remove(client)
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, int(bufferSize))
+	writer := bufio.NewWriterSize(conn, int(bufferSize))
+	stream := &bufferedConn{Conn: conn, reader: reader}
+	readTimeout, idleTimeout := srv.clients.readTimeout, srv.clients.idleTimeout
+	timeouts := readTimeout > 0 || idleTimeout > 0
+
+	sess := srv.newSession()
+	defer sess.close()
+	if !sess.handshake(client) {
+		return
 	}
-	defer listener.Close()
 
-	fmt.Printf("Server started on port %s\n", port)
+	conn.Write([]byte("Connected to lru engine\r\n"))
 	for {
-		if atomic.LoadInt32(&activeConnections) >= maxConnections {
-			continue
+		if timeouts {
+			conn.SetReadDeadline(readDeadline(idleTimeout))
 		}
-		conn, err := listener.Accept()
-		if err != nil {
-			src.LogError(err)
+		// Shutdown interrupts the read, so it is checked after setting the
+		// deadline; replies to earlier commands still go out
+		if srv.clients.draining.Load() {
+			fmt.Fprintf(writer, "ERR %s\r\n", ErrServerClosed)
+			writer.Flush()
+			return
+		}
+		_, err := reader.Peek(1)
+		reason := "idle timeout"
+		var line []byte
+		if err == nil {
+			if timeouts {
+				// The command has started and must now arrive within the read timeout
+				conn.SetReadDeadline(readDeadline(readTimeout))
+			}
+			reason = "read timeout"
+			line, err = readCommand(reader, int(srv.maxCommand.Load()))
+		}
+		if err != nil && !errors.Is(err, errCommandTooLarge) {
+			var netErr net.Error
+			switch {
+			case srv.clients.draining.Load():
+				continue
+			case errors.As(err, &netErr) && netErr.Timeout():
+				fmt.Fprintf(writer, "ERR %s\r\n", reason)
+				writer.Flush()
+			default:
+				fmt.Printf("Connection closed by client\n")
+			}
+			return
+		}
+
+		var cmd *Command[K, V]
+		if err == nil {
+			cmd, err = Parse[K, V](line)
+		}
+		switch {
+		case err != nil:
+			fmt.Fprintf(writer, "ERR %s\r\n", err)
+		case cmd.operation == Cmd_REPLSYNC, cmd.operation == Cmd_SUBSCRIBE, cmd.operation == Cmd_BINARY,
+			cmd.operation == Cmd_CLUSTER && cmd.sub == Cmd_GOSSIP:
+			// These take over the connection; earlier replies go out first
+			if err := sess.authorize(cmd); err != nil {
+				fmt.Fprintf(writer, "ERR %s\r\n", err)
+				break
+			}
+			if timeouts {
+				// Streams have no commands to time out
+				conn.SetReadDeadline(time.Time{})
+			}
+			client.observe(cmd.operation)
+			if writer.Flush() != nil || !srv.clients.stream(client) || !serveStream(stream, srv, sess, cmd) {
+				return
+			}
+			client.streaming.Store(false)
 			continue
+		default:
+			client.observe(cmd.operation)
+			result, err := sess.Execute(cmd)
+			client.user.Store(sess.user)
+			if err != nil {
+				fmt.Fprintf(writer, "ERR %s\r\n", err)
+			} else {
+				fmt.Fprintf(writer, "%s\r\n", result)
+			}
 		}
-		atomic.AddInt32(&activeConnections, 1)
-		fmt.Printf("New client connected (active: %d)\n", atomic.LoadInt32(&activeConnections))
-		go func() {
-			handleConnection(conn, bufferSize, mgr)
-			atomic.AddInt32(&activeConnections, -1)
-		}()
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveStream hands the connection to the protocol cmd switches to, and
+// reports whether it returned to normal commands afterwards
+func serveStream[U, K src.Uints, V ~[]byte](conn *bufferedConn, srv *Server[U, K, V], sess *session[U, K, V], cmd *Command[K, V]) bool {
+	switch cmd.operation {
+	case Cmd_REPLSYNC:
+		offset, _ := strconv.ParseUint(string(cmd.value), 10, 64)
+		srv.repl.serveReplica(conn, cmd.option, offset)
+	case Cmd_SUBSCRIBE:
+		return serveSubscriber(conn, srv, cmd)
+	case Cmd_BINARY:
+		serveBinary(conn, srv, sess)
+	default:
+		srv.gossip.serve(conn)
+	}
+	return false
+}
+
+// Serve accepts connections on listener until it is closed or the server shuts
+// down. Connections above the server's limit are refused with an error.
+func Serve[U, K src.Uints, V ~[]byte](listener net.Listener, bufferSize uint16, srv *Server[U, K, V]) {
+	if listener.Addr().Network() == "tcp" {
+		srv.gossip.announce(listener.Addr().String())
 	}
+	srv.clients.serve(srv.tlsListener(listener), "ERR %s\r\n", func(client *tcpClient) {
+		fmt.Printf("New client connected (active: %d)\n", len(srv.clients.slots))
+		handleConnection(client, bufferSize, srv)
+	})
 }
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPipelining(t *testing.T) {
+	srv, addr := startServer(t)
+	srv.SetMaxCommandSize(64)
+	run(t, srv, "CREATE users 10")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	expect := func(want string) {
+		t.Helper()
+		line, err := reader.ReadString('\n')
+		if err != nil || line != want+"\r\n" {
+			t.Fatalf("Expected %q, got %q, %v", want, line, err)
+		}
+	}
+	expect("Connected to lru engine")
+
+	// Several commands in one write are answered in order
+	conn.Write([]byte("SET users a 1\r\nSET users b 2\nGET users a\r\nGET users b\r\n"))
+	expect("OK")
+	expect("OK")
+	expect("1")
+	expect("2")
+
+	// A command split over several writes is read whole
+	conn.Write([]byte("SET users c "))
+	time.Sleep(10 * time.Millisecond)
+	conn.Write([]byte("3\r\nGET users c\r\n"))
+	expect("OK")
+	expect("3")
+
+	// An oversized command is refused without breaking the commands around it
+	conn.Write([]byte("SET users d " + strings.Repeat("x", 100) + "\r\nGET users d\r\nGET users a\r\n"))
+	expect("ERR command too large: more than 64 bytes")
+	expect("ERR " + "key not found")
+	expect("1")
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"lrue/src"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for changes
+var tlsReloadInterval = time.Second
+
+// tlsHandshakeTimeout bounds the handshake of a new TLS connection
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSFiles names the PEM files the TCP listener serves TLS with. With a
+// ClientCA, clients must present a certificate signed by it. The files are
+// read again when they change, so certificates can be rotated without a
+// restart.
+type TLSFiles struct {
+	Cert     string
+	Key      string
+	ClientCA string
+}
+
+// certStore holds the certificate and client CAs loaded from TLSFiles
+type certStore struct {
+	files     TLSFiles
+	mutex     sync.Mutex
+	checked   time.Time
+	stamp     string // modification times of the loaded files
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newCertStore(files TLSFiles) (*certStore, error) {
+	s := &certStore{files: files}
+	stamp, err := s.modified()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.load(stamp); err != nil {
+		return nil, err
+	}
+	s.checked = time.Now()
+	return s, nil
+}
+
+// modified returns the modification times of the files as one string
+func (s *certStore) modified() (string, error) {
+	var stamp string
+	for _, name := range []string{s.files.Cert, s.files.Key, s.files.ClientCA} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d/%d ", info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp, nil
+}
+
+func (s *certStore) load(stamp string) error {
+	cert, err := tls.LoadX509KeyPair(s.files.Cert, s.files.Key)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if s.files.ClientCA != "" {
+		pem, err := os.ReadFile(s.files.ClientCA)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", s.files.ClientCA)
+		}
+	}
+	s.cert, s.clientCAs, s.stamp = &cert, clientCAs, stamp
+	return nil
+}
+
+// current returns the certificate and client CAs, reloading them when the
+// files changed. A reload that fails keeps serving the previous ones.
+func (s *certStore) current() (*tls.Certificate, *x509.CertPool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if time.Since(s.checked) >= tlsReloadInterval {
+		s.checked = time.Now()
+		if stamp, err := s.modified(); err != nil {
+			src.LogError(err)
+		} else if stamp != s.stamp {
+			if err := s.load(stamp); err != nil {
+				src.LogError(fmt.Errorf("reloading TLS certificates: %w", err))
+			}
+		}
+	}
+	return s.cert, s.clientCAs
+}
+
+// serverConfig returns the listener configuration; every handshake picks up
+// the current certificates
+func (s *certStore) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs := s.current()
+			config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{*cert}}
+			if clientCAs != nil {
+				config.ClientCAs = clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+// clientConfig returns the configuration for connecting to another node at
+// host. Nodes present their own certificate and trust the client CA, so a
+// cluster shares one CA.
+func (s *certStore) clientConfig(host string) *tls.Config {
+	cert, clientCAs := s.current()
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		ServerName:   host,
+		RootCAs:      clientCAs,
+		Certificates: []tls.Certificate{*cert},
+	}
+}
+
+// peerDialer connects to other nodes for replication and gossip, over TLS
+// once the server has it enabled, and logs in with the peer credentials when
+// they are set
+type peerDialer struct {
+	certs atomic.Pointer[certStore]
+	auth  atomic.Pointer[peerAuth]
+}
+
+// peerAuth is the ACL user a node logs in to other nodes as
+type peerAuth struct {
+	user, password string
+}
+
+func (d *peerDialer) dial(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	certs := d.certs.Load()
+	if certs == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsDialer := tls.Dialer{NetDialer: &dialer, Config: certs.clientConfig(host)}
+	return tlsDialer.DialContext(ctx, "tcp", addr)
+}
+
+// greet reads the greeting of a node dialed by dial and sends AUTH when peer
+// credentials are set
+func (d *peerDialer) greet(conn net.Conn, reader *bufio.Reader) error {
+	if _, err := reader.ReadString('\n'); err != nil {
+		return err
+	}
+	auth := d.auth.Load()
+	if auth == nil {
+		return nil
+	}
+	if _, err := fmt.Fprintf(conn, "%s %s %s\r\n", Cmd_AUTH, auth.user, auth.password); err != nil {
+		return err
+	}
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if reply = strings.TrimSpace(reply); reply != "OK" {
+		return fmt.Errorf("peer AUTH as %s: %s", auth.user, reply)
+	}
+	return nil
+}
+
+// SetTLS makes Serve, ServeHTTP, ServeRESP and ServeMemcached accept TLS
+// connections only, and makes replication and gossip connect to other nodes
+// over TLS. It must be called before serving.
+func (s *Server[U, K, V]) SetTLS(files TLSFiles) error {
+	if files.Cert == "" || files.Key == "" {
+		return errors.New("TLS needs a certificate and a key")
+	}
+	certs, err := newCertStore(files)
+	if err != nil {
+		return err
+	}
+	s.peers.certs.Store(certs)
+	return nil
+}
+
+// tlsListener wraps listener in TLS when it is enabled. ServeHTTP wraps its
+// connections with tlsConfig itself, so no listener stays plaintext.
+func (s *Server[U, K, V]) tlsListener(listener net.Listener) net.Listener {
+	if config := s.tlsConfig(); config != nil {
+		return tls.NewListener(listener, config)
+	}
+	return listener
+}
+
+// tlsConfig returns the configuration of TLS listeners, or nil without TLS
+func (s *Server[U, K, V]) tlsConfig() *tls.Config {
+	if certs := s.peers.certs.Load(); certs != nil {
+		return certs.serverConfig()
+	}
+	return nil
+}
+
+// handshake completes the TLS handshake of a client of a TLS listener and
+// authenticates it by its certificate, reporting whether the client may go on
+func (s *session[U, K, V]) handshake(client *tcpClient) bool {
+	tlsConn, ok := client.conn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	identity, err := certIdentity(tlsConn)
+	if err != nil {
+		fmt.Printf("TLS handshake failed: %v\n", err)
+		return false
+	}
+	s.setIdentity(identity)
+	client.user.Store(s.user)
+	return true
+}
+
+// certIdentity names the client a verified certificate belongs to: its
+// common name, or the whole subject when that is empty
+func certIdentity(conn *tls.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+	state := conn.ConnectionState()
+	return stateIdentity(&state), nil
+}
+
+// stateIdentity names the client of a completed handshake as certIdentity
+// does, or returns "" when it sent no certificate
+func stateIdentity(state *tls.ConnectionState) string {
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	if name := certs[0].Subject.CommonName; name != "" {
+		return name
+	}
+	return certs[0].Subject.String()
+}
@@ -0,0 +1,244 @@
+package api
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"lrue/src"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for loopback servers and clients
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for 127.0.0.1 usable by servers and clients
+func (ca *testCA) issue(t *testing.T, name string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) clientConfig(t *testing.T, name string) *tls.Config {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: pool}
+	if name != "" {
+		cert, err := tls.X509KeyPair(ca.issue(t, name))
+		if err != nil {
+			t.Fatalf("X509KeyPair() error = %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config
+}
+
+// writeTLSFiles writes a server certificate signed by ca and the CA itself
+func writeTLSFiles(t *testing.T, dir string, ca *testCA, name string) TLSFiles {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, name)
+	files := TLSFiles{
+		Cert:     filepath.Join(dir, "server.pem"),
+		Key:      filepath.Join(dir, "server-key.pem"),
+		ClientCA: filepath.Join(dir, "ca.pem"),
+	}
+	for path, data := range map[string][]byte{files.Cert: certPEM, files.Key: keyPEM, files.ClientCA: ca.pem} {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+	return files
+}
+
+func startTLSServer(t *testing.T, files TLSFiles) (*testServer, string) {
+	t.Helper()
+	srv := NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	if err := srv.SetTLS(files); err != nil {
+		t.Fatalf("SetTLS() error = %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go Serve(listener, 256, srv)
+	t.Cleanup(func() {
+		listener.Close()
+		srv.Close()
+	})
+	return srv, listener.Addr().String()
+}
+
+// greeting dials addr over TLS and returns the server's first line
+func greeting(addr string, config *tls.Config) (string, *tls.Conn, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return "", nil, err
+	}
+	return line, conn, nil
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	files := writeTLSFiles(t, t.TempDir(), ca, "first")
+	_, addr := startTLSServer(t, files)
+
+	if line, conn, err := greeting(addr, ca.clientConfig(t, "alice")); err != nil || line != "Connected to lru engine\r\n" {
+		t.Fatalf("Expected a greeting over mutual TLS, got %q, %v", line, err)
+	} else {
+		if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != "first" {
+			t.Errorf("Expected the first certificate, got %q", name)
+		}
+		conn.Close()
+	}
+	if _, _, err := greeting(addr, ca.clientConfig(t, "")); err == nil {
+		t.Errorf("Expected a client without a certificate to be refused")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte("LIST\r\n"))
+		if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "" {
+			t.Errorf("Expected no plaintext reply, got %q", line)
+		}
+		conn.Close()
+	}
+
+	// Replaced certificate files are served without a restart
+	tlsReloadInterval = 0
+	defer func() { tlsReloadInterval = time.Second }()
+	certPEM, keyPEM := ca.issue(t, "second")
+	os.WriteFile(files.Cert, certPEM, 0o600)
+	os.WriteFile(files.Key, keyPEM, 0o600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(files.Cert, future, future)
+	os.Chtimes(files.Key, future, future)
+	_, conn, err := greeting(addr, ca.clientConfig(t, "alice"))
+	if err != nil {
+		t.Fatalf("greeting after reload: %v", err)
+	}
+	defer conn.Close()
+	if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != "second" {
+		t.Errorf("Expected the reloaded certificate, got %q", name)
+	}
+}
+
+func TestTLSReplication(t *testing.T) {
+	ca := newTestCA(t)
+	primary, addr := startTLSServer(t, writeTLSFiles(t, t.TempDir(), ca, "primary"))
+	replica, _ := startTLSServer(t, writeTLSFiles(t, t.TempDir(), ca, "replica"))
+
+	run(t, primary, "CREATE users 10")
+	run(t, primary, "SET users alice 1")
+	replica.ReplicaOf(addr)
+	waitFor(t, "replica to sync over TLS", inSync(primary, replica))
+	if value, err := run(t, replica, "GET users alice"); err != nil || value != "1" {
+		t.Errorf("Expected the replica to hold alice, got %q, %v", value, err)
+	}
+}
+
+func TestTLSProtocols(t *testing.T) {
+	ca := newTestCA(t)
+	srv, _ := startTLSServer(t, writeTLSFiles(t, t.TempDir(), ca, "server"))
+	srv.SetACL(testACL(t))
+	run(t, srv, "CREATE users 8")
+	run(t, srv, "CREATE sessions 8")
+	serve := map[string]func(net.Listener){
+		"resp":      func(l net.Listener) { ServeRESP(l, srv) },
+		"memcached": func(l net.Listener) { ServeMemcached(l, srv, "sessions") },
+		"http":      func(l net.Listener) { ServeHTTP(l, srv) },
+	}
+	addrs := make(map[string]string)
+	for name, serve := range serve {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen() error = %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go serve(listener)
+		addrs[name] = listener.Addr().String()
+	}
+
+	// Every protocol is served over TLS, and the client certificate logs in
+	for name, step := range map[string]struct{ request, reply string }{
+		"resp":      {respArray("SET", "users:a", "1"), "+OK\r\n"},
+		"memcached": {"set a 0 0 1\r\nx\r\n", "STORED\r\n"},
+		"http":      {"PUT /caches/users/keys/b HTTP/1.1\r\nHost: lrue\r\nContent-Length: 1\r\n\r\nx", "HTTP/1.1 204 No Content\r\n"},
+	} {
+		conn, err := tls.Dial("tcp", addrs[name], ca.clientConfig(t, "alice"))
+		if err != nil {
+			t.Fatalf("%s: Dial() error = %v", name, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(step.request))
+		if line, err := bufio.NewReader(conn).ReadString('\n'); line != step.reply {
+			t.Errorf("%s: expected %q over TLS, got %q, %v", name, step.reply, line, err)
+		}
+		conn.Close()
+
+		plain, err := net.Dial("tcp", addrs[name])
+		if err != nil {
+			t.Fatalf("%s: Dial() error = %v", name, err)
+		}
+		plain.SetDeadline(time.Now().Add(time.Second))
+		plain.Write([]byte(step.request))
+		if line, _ := bufio.NewReader(plain).ReadString('\n'); line == step.reply {
+			t.Errorf("%s: expected a plaintext client to be refused", name)
+		}
+		plain.Close()
+	}
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lrue/src"
+)
+
+var (
+	// ErrWaitTimeout is returned when WAITGET times out before the key is set
+	ErrWaitTimeout = errors.New("timeout waiting for key")
+	// ErrServerClosed is returned to commands interrupted by server shutdown
+	ErrServerClosed = errors.New("server is shutting down")
+)
+
+// waitGet runs WAITGET: it parks until the key is set, the timeout passes
+// (zero waits forever) or ctx is done
+func waitGet[U, K src.Uints, V ~[]byte](ctx context.Context, cm *src.CacheManager[U, K, V], cmd *Command[K, V]) (string, error) {
+	cache := cm.GetCache(cmd.mapTitle)
+	if cache == nil {
+		return "", fmt.Errorf("%w: %s", src.ErrCacheNotFound, cmd.mapTitle)
+	}
+	defer cache.Release()
+
+	waitCtx, cancel := ctx, context.CancelFunc(func() {})
+	if cmd.timeout > 0 {
+		waitCtx, cancel = context.WithTimeout(ctx, cmd.timeout)
+	}
+	defer cancel()
+
+	value, err := cache.GetWait(waitCtx, cmd.key)
+	switch {
+	case err == nil:
+		return string(value), nil
+	case ctx.Err() != nil:
+		return "", ErrServerClosed
+	case errors.Is(err, context.DeadlineExceeded):
+		return "", ErrWaitTimeout
+	}
+	return "", fmt.Errorf("%w: %s", err, cmd.mapTitle)
+}
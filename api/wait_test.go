@@ -0,0 +1,64 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitGet(t *testing.T) {
+	srv, _ := startServer(t)
+	run(t, srv, "CREATE jobs 8")
+
+	waitGet := func(line string) chan string {
+		done := make(chan string, 1)
+		go func() {
+			result, err := run(t, srv, line)
+			if err != nil {
+				result = "ERR " + err.Error()
+			}
+			done <- result
+		}()
+		return done
+	}
+	result := func(done chan string) string {
+		select {
+		case got := <-done:
+			return got
+		case <-time.After(5 * time.Second):
+			t.Fatal("WAITGET was not released")
+			return ""
+		}
+	}
+
+	done := waitGet("WAITGET jobs a 5")
+	time.Sleep(20 * time.Millisecond)
+	run(t, srv, "SET jobs a 1")
+	if got := result(done); got != "1" {
+		t.Errorf("Expected WAITGET to return the new value, got %q", got)
+	}
+
+	if _, err := run(t, srv, "WAITGET jobs b 0.02"); !errors.Is(err, ErrWaitTimeout) {
+		t.Errorf("Expected ErrWaitTimeout, got %v", err)
+	}
+
+	done = waitGet("WAITGET jobs c 0")
+	time.Sleep(20 * time.Millisecond)
+	run(t, srv, "DESTROY jobs")
+	if got := result(done); !strings.Contains(got, "destroyed") {
+		t.Errorf("Expected DESTROY to release the waiter, got %q", got)
+	}
+
+	run(t, srv, "CREATE jobs 8")
+	done = waitGet("WAITGET jobs d 0")
+	time.Sleep(20 * time.Millisecond)
+	srv.Close()
+	if got := result(done); got != "ERR "+ErrServerClosed.Error() {
+		t.Errorf("Expected shutdown to release the waiter, got %q", got)
+	}
+
+	if _, err := Parse[uint64, []byte]([]byte("WAITGET jobs a soon")); err == nil {
+		t.Errorf("Expected an invalid timeout to be rejected")
+	}
+}
@@ -0,0 +1,107 @@
+// Package client talks to an lrue TCP server
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerError is an ERR reply from the server
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+// Conn is a connection to one lrue server. It is safe for concurrent use;
+// commands are sent one at a time.
+type Conn struct {
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex
+}
+
+// Dial connects to the server at addr and reads its greeting
+func Dial(addr string) (*Conn, error) {
+	return DialTLS(addr, nil)
+}
+
+// DialTLS connects like Dial, over TLS with config unless it is nil
+func DialTLS(addr string, config *tls.Config) (*Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialContext(ctx, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{addr: addr, conn: conn, reader: bufio.NewReader(conn)}
+	if _, err := c.readReply(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialContext opens a TCP connection to addr, over TLS when config is set
+func dialContext(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	dialer := tls.Dialer{Config: config}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// Addr returns the address the connection was dialed with
+func (c *Conn) Addr() string {
+	return c.addr
+}
+
+// Do sends one command and returns its reply, or a *ServerError for ERR replies.
+// The command is terminated with \r\n unless it already ends in a newline.
+func (c *Conn) Do(command string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !strings.HasSuffix(command, "\n") {
+		command += "\r\n"
+	}
+	if _, err := c.conn.Write([]byte(command)); err != nil {
+		return "", err
+	}
+	reply, err := c.readReply()
+	if err != nil {
+		return "", err
+	}
+	if msg, ok := strings.CutPrefix(reply, "ERR "); ok {
+		return "", &ServerError{Message: msg}
+	}
+	return reply, nil
+}
+
+// readReply reads up to the \r\n ending a reply; multi-line replies such as
+// LIST and PRINT separate their lines with a bare \n
+func (c *Conn) readReply() (string, error) {
+	var reply strings.Builder
+	for !strings.HasSuffix(reply.String(), "\r\n") {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		reply.WriteString(line)
+	}
+	return strings.TrimSuffix(reply.String(), "\r\n"), nil
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
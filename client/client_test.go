@@ -0,0 +1,39 @@
+package client
+
+import (
+	"errors"
+	"lrue/api"
+	"lrue/src"
+	"net"
+	"testing"
+)
+
+func TestConn(t *testing.T) {
+	srv := api.NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	defer srv.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer listener.Close()
+	go api.Serve(listener, 256, srv)
+
+	conn, err := Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	for _, line := range []string{"CREATE a 4", "SET a k1 v1", "SET a k2 v2"} {
+		if reply, err := conn.Do(line); err != nil || reply != "OK" {
+			t.Fatalf("%q = %q, %v", line, reply, err)
+		}
+	}
+	if reply, err := conn.Do("PRINT a"); err != nil || reply != "Index: 0, Value: [118 50]\nIndex: 1, Value: [118 49]\n" {
+		t.Errorf("Expected a multi-line PRINT reply, got %q, %v", reply, err)
+	}
+	var serverErr *ServerError
+	if _, err := conn.Do("GET a missing"); !errors.As(err, &serverErr) || serverErr.Message != src.ErrKeyNotFound.Error() {
+		t.Errorf("Expected a ServerError for a missing key, got %v", err)
+	}
+}
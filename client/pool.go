@@ -0,0 +1,457 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"lrue/api"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned for calls on a closed Client
+var ErrClosed = errors.New("client is closed")
+
+// Options configures a Client; zero fields take the defaults noted on them
+type Options struct {
+	// MaxOpen caps the connections open at once; calls wait for a free one (16)
+	MaxOpen int
+	// MaxIdle is how many unused connections are kept for reuse (4)
+	MaxIdle int
+	// DialTimeout bounds connecting and switching a new connection to binary frames (5s)
+	DialTimeout time.Duration
+	// HealthCheck is how long a connection may sit idle before it is checked
+	// with a no-op frame on reuse (30s)
+	HealthCheck time.Duration
+	// Retries is how many more attempts idempotent calls get after a
+	// connection failure (2, or none when negative)
+	Retries int
+	// RetryBackoff is the wait before the first retry; it doubles with every attempt (50ms)
+	RetryBackoff time.Duration
+	// TLS connects over TLS with this configuration when set; add a client
+	// certificate for servers that require one
+	TLS *tls.Config
+	// User and Password authenticate every new connection when User is set
+	User     string
+	Password string
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxOpen <= 0 {
+		o.MaxOpen = 16
+	}
+	if o.MaxIdle <= 0 {
+		o.MaxIdle = 4
+	}
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = 5 * time.Second
+	}
+	if o.HealthCheck <= 0 {
+		o.HealthCheck = 30 * time.Second
+	}
+	if o.Retries < 0 {
+		o.Retries = 0
+	} else if o.Retries == 0 {
+		o.Retries = 2
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = 50 * time.Millisecond
+	}
+	return o
+}
+
+// CacheStats describes one cache on the server
+type CacheStats struct {
+	Name     string
+	Capacity uint64
+	Length   uint64
+	Bytes    uint64
+}
+
+// Client is a pool of connections to one lrue server with a typed API. The
+// connections use binary frames, so keys and values may hold any bytes. It is
+// safe for concurrent use.
+type Client struct {
+	addr  string
+	opts  Options
+	slots chan struct{} // holds a token for every connection in use
+	mutex sync.Mutex
+	idle  []*frameConn
+	done  bool
+}
+
+// frameConn is one pooled connection switched to binary frames
+type frameConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	nextID uint32
+	used   time.Time
+}
+
+// New returns a Client for the server at addr, after checking that it can be reached
+func New(addr string, opts Options) (*Client, error) {
+	opts = opts.withDefaults()
+	c := &Client{addr: addr, opts: opts, slots: make(chan struct{}, opts.MaxOpen)}
+	if err := c.Ping(context.Background()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the idle connections; connections in use are closed when their call returns
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.done = true
+	for _, fc := range c.idle {
+		fc.conn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (c *Client) dial(ctx context.Context) (*frameConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.DialTimeout)
+	defer cancel()
+	conn, err := dialContext(ctx, c.addr, c.opts.TLS)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	fc := &frameConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+	if _, err := fc.reader.ReadString('\n'); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write([]byte("BINARY\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply, err := fc.reader.ReadString('\n'); err != nil || !strings.HasPrefix(reply, "OK BINARY") {
+		conn.Close()
+		if err == nil {
+			err = fmt.Errorf("server refused binary frames: %s", strings.TrimSpace(reply))
+		}
+		return nil, err
+	}
+	if c.opts.User != "" {
+		auth := api.Frame{Op: api.OpText, Value: []byte("AUTH " + c.opts.User + " " + c.opts.Password)}
+		responses, err := fc.exchange([]api.Frame{auth})
+		if err == nil {
+			err = responseError(responses[0])
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return fc, nil
+}
+
+// get takes an idle connection, or dials one once fewer than MaxOpen are in use
+func (c *Client) get(ctx context.Context) (*frameConn, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	for {
+		c.mutex.Lock()
+		if c.done {
+			c.mutex.Unlock()
+			<-c.slots
+			return nil, ErrClosed
+		}
+		n := len(c.idle)
+		if n == 0 {
+			c.mutex.Unlock()
+			break
+		}
+		fc := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mutex.Unlock()
+		if time.Since(fc.used) < c.opts.HealthCheck {
+			return fc, nil
+		}
+		if _, err := fc.roundTrip(ctx, []api.Frame{{Op: api.OpNoop}}); err == nil {
+			return fc, nil
+		}
+		fc.conn.Close()
+	}
+	fc, err := c.dial(ctx)
+	if err != nil {
+		<-c.slots
+		return nil, err
+	}
+	return fc, nil
+}
+
+// put returns a connection to the pool, or closes it if it failed or is not needed
+func (c *Client) put(fc *frameConn, healthy bool) {
+	c.mutex.Lock()
+	if healthy && !c.done && len(c.idle) < c.opts.MaxIdle {
+		fc.used = time.Now()
+		c.idle = append(c.idle, fc)
+	} else {
+		fc.conn.Close()
+	}
+	c.mutex.Unlock()
+	<-c.slots
+}
+
+// roundTrip sends frames as one pipelined batch and reads their responses,
+// bounded by the deadline and cancellation of ctx
+func (fc *frameConn) roundTrip(ctx context.Context, frames []api.Frame) ([]api.Frame, error) {
+	deadline, _ := ctx.Deadline()
+	fc.conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { fc.conn.SetDeadline(time.Now()) })
+
+	responses, err := fc.exchange(frames)
+	// A cancellation that fired may still reset the deadline, so the
+	// connection is not reused after it
+	if !stop() || (err != nil && ctx.Err() != nil) {
+		return nil, ctx.Err()
+	}
+	// The connection deadline can expire just before the context notices
+	if err != nil && !deadline.IsZero() && !time.Now().Before(deadline) {
+		return nil, context.DeadlineExceeded
+	}
+	return responses, err
+}
+
+func (fc *frameConn) exchange(frames []api.Frame) ([]api.Frame, error) {
+	ids := make([]uint32, len(frames))
+	for i, frame := range frames {
+		fc.nextID++
+		frame.RequestID, ids[i] = fc.nextID, fc.nextID
+		if err := api.WriteFrame(fc.writer, frame); err != nil {
+			return nil, err
+		}
+	}
+	if err := fc.writer.Flush(); err != nil {
+		return nil, err
+	}
+	responses := make([]api.Frame, len(frames))
+	for i := range responses {
+		resp, err := api.ReadFrame(fc.reader)
+		if err != nil {
+			return nil, err
+		}
+		if resp.RequestID != ids[i] {
+			return nil, fmt.Errorf("response to request %d received for request %d", resp.RequestID, ids[i])
+		}
+		responses[i] = resp
+	}
+	return responses, nil
+}
+
+// do runs frames on one connection. Connection failures are retried when every
+// frame is idempotent, or when nothing was sent yet.
+func (c *Client) do(ctx context.Context, frames []api.Frame, idempotent bool) ([]api.Frame, error) {
+	backoff := c.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		fc, err := c.get(ctx)
+		sent := false
+		if err == nil {
+			var responses []api.Frame
+			responses, err = fc.roundTrip(ctx, frames)
+			c.put(fc, err == nil)
+			if err == nil {
+				return responses, nil
+			}
+			sent = true
+		}
+		var serverErr *ServerError
+		if (sent && !idempotent) || attempt >= c.opts.Retries || ctx.Err() != nil ||
+			errors.Is(err, ErrClosed) || errors.As(err, &serverErr) {
+			return nil, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// one runs a single frame and turns an error status into a *ServerError
+func (c *Client) one(ctx context.Context, frame api.Frame, idempotent bool) (api.Frame, error) {
+	responses, err := c.do(ctx, []api.Frame{frame}, idempotent)
+	if err != nil {
+		return api.Frame{}, err
+	}
+	return responses[0], responseError(responses[0])
+}
+
+func responseError(resp api.Frame) error {
+	if resp.Status == api.StatusError {
+		return &ServerError{Message: string(resp.Value)}
+	}
+	return nil
+}
+
+// Ping checks that the server answers
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.one(ctx, api.Frame{Op: api.OpNoop}, true)
+	return err
+}
+
+// Create creates a cache; options are CREATE arguments such as "ttl=1h" or "IFNOTEXISTS"
+func (c *Client) Create(ctx context.Context, name string, capacity uint64, options ...string) error {
+	command := strings.Join(append([]string{"CREATE", name, strconv.FormatUint(capacity, 10)}, options...), " ")
+	_, err := c.Do(ctx, command)
+	return err
+}
+
+// Set stores value under key in cache
+func (c *Client) Set(ctx context.Context, cache, key string, value []byte) error {
+	_, err := c.one(ctx, api.Frame{Op: api.OpSet, Cache: []byte(cache), Key: []byte(key), Value: value}, true)
+	return err
+}
+
+// Get returns the value of key in cache, and whether it was found
+func (c *Client) Get(ctx context.Context, cache, key string) ([]byte, bool, error) {
+	resp, err := c.one(ctx, api.Frame{Op: api.OpGet, Cache: []byte(cache), Key: []byte(key)}, true)
+	if err != nil || resp.Status == api.StatusNotFound {
+		return nil, false, err
+	}
+	return resp.Value, true, nil
+}
+
+// Del removes key from cache
+func (c *Client) Del(ctx context.Context, cache, key string) error {
+	_, err := c.one(ctx, api.Frame{Op: api.OpDel, Cache: []byte(cache), Key: []byte(key)}, true)
+	return err
+}
+
+// Stats describes every cache on the server, sorted by name
+func (c *Client) Stats(ctx context.Context) ([]CacheStats, error) {
+	resp, err := c.one(ctx, api.Frame{Op: api.OpText, Value: []byte("INFO caches")}, true)
+	if err != nil {
+		return nil, err
+	}
+	var stats []CacheStats
+	for line := range strings.SplitSeq(string(resp.Value), "\n") {
+		rest, ok := strings.CutPrefix(line, "cache:")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		s := CacheStats{Name: fields[0]}
+		for _, field := range fields[1:] {
+			name, value, _ := strings.Cut(field, "=")
+			n, _ := strconv.ParseUint(value, 10, 64)
+			switch name {
+			case "capacity":
+				s.Capacity = n
+			case "length":
+				s.Length = n
+			case "bytes":
+				s.Bytes = n
+			}
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// List returns the names of the caches on the server
+func (c *Client) List(ctx context.Context) ([]string, error) {
+	stats, err := c.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(stats))
+	for i, s := range stats {
+		names[i] = s.Name
+	}
+	return names, nil
+}
+
+// Do runs any text command and returns its reply. It is not retried, since
+// the command may not be safe to run twice.
+func (c *Client) Do(ctx context.Context, command string) (string, error) {
+	resp, err := c.one(ctx, api.Frame{Op: api.OpText, Value: []byte(command)}, false)
+	if err != nil {
+		return "", err
+	}
+	return string(resp.Value), nil
+}
+
+// Result is the outcome of one call in a Batch. Found is false for a Get of
+// a missing key.
+type Result struct {
+	Value []byte
+	Found bool
+	Err   error
+}
+
+// Batch collects calls that are sent together on one connection
+type Batch struct {
+	client     *Client
+	frames     []api.Frame
+	idempotent bool
+}
+
+// Batch starts an empty batch
+func (c *Client) Batch() *Batch {
+	return &Batch{client: c, idempotent: true}
+}
+
+// Get queues a read of key in cache
+func (b *Batch) Get(cache, key string) *Batch {
+	b.frames = append(b.frames, api.Frame{Op: api.OpGet, Cache: []byte(cache), Key: []byte(key)})
+	return b
+}
+
+// Set queues a write of value under key in cache
+func (b *Batch) Set(cache, key string, value []byte) *Batch {
+	b.frames = append(b.frames, api.Frame{Op: api.OpSet, Cache: []byte(cache), Key: []byte(key), Value: value})
+	return b
+}
+
+// Del queues the removal of key from cache
+func (b *Batch) Del(cache, key string) *Batch {
+	b.frames = append(b.frames, api.Frame{Op: api.OpDel, Cache: []byte(cache), Key: []byte(key)})
+	return b
+}
+
+// Do queues a text command; a batch holding one is not retried
+func (b *Batch) Do(command string) *Batch {
+	b.frames = append(b.frames, api.Frame{Op: api.OpText, Value: []byte(command)})
+	b.idempotent = false
+	return b
+}
+
+// Exec sends the queued calls pipelined and returns one Result per call, in
+// order. The error reports a failure of the batch as a whole; the failure of
+// a single call is in its Result.
+func (b *Batch) Exec(ctx context.Context) ([]Result, error) {
+	if len(b.frames) == 0 {
+		return nil, nil
+	}
+	responses, err := b.client.do(ctx, b.frames, b.idempotent)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, len(responses))
+	for i, resp := range responses {
+		if err := responseError(resp); err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i] = Result{Value: resp.Value, Found: resp.Status == api.StatusOK}
+	}
+	return results, nil
+}
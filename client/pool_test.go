@@ -0,0 +1,155 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"lrue/api"
+	"lrue/src"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// trackingListener remembers accepted connections so a test can drop them
+type trackingListener struct {
+	net.Listener
+	mutex sync.Mutex
+	conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mutex.Lock()
+		l.conns = append(l.conns, conn)
+		l.mutex.Unlock()
+	}
+	return conn, err
+}
+
+func (l *trackingListener) dropAll() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+func startServer(t *testing.T) *trackingListener {
+	t.Helper()
+	srv := api.NewServer(src.NewCacheManager[uint8, uint64, []byte]())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	tracking := &trackingListener{Listener: listener}
+	go api.Serve(tracking, 256, srv)
+	t.Cleanup(func() {
+		listener.Close()
+		srv.Close()
+	})
+	return tracking
+}
+
+func TestClient(t *testing.T) {
+	listener := startServer(t)
+	ctx := context.Background()
+	c, err := New(listener.Addr().String(), Options{MaxOpen: 4})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Create(ctx, "users", 100); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	var serverErr *ServerError
+	if err := c.Create(ctx, "users", 100); !errors.As(err, &serverErr) {
+		t.Errorf("Expected a ServerError creating an existing cache, got %v", err)
+	}
+
+	value := []byte("spaces  and\r\nnewlines")
+	if err := c.Set(ctx, "users", "alice", value); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if got, found, err := c.Get(ctx, "users", "alice"); err != nil || !found || !bytes.Equal(got, value) {
+		t.Errorf("Get() = %q, %v, %v", got, found, err)
+	}
+	if _, found, err := c.Get(ctx, "users", "bob"); err != nil || found {
+		t.Errorf("Get() of a missing key = %v, %v", found, err)
+	}
+	if err := c.Del(ctx, "users", "alice"); err != nil {
+		t.Errorf("Del() error = %v", err)
+	}
+	if _, found, _ := c.Get(ctx, "users", "alice"); found {
+		t.Errorf("Expected alice to be deleted")
+	}
+
+	// Concurrent calls share at most MaxOpen connections
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := fmt.Sprintf("k%d", i)
+			if err := c.Set(ctx, "users", key, []byte(key)); err != nil {
+				t.Errorf("Set(%s) error = %v", key, err)
+			}
+		}()
+	}
+	wg.Wait()
+	stats, err := c.Stats(ctx)
+	if err != nil || len(stats) != 1 || stats[0].Name != "users" || stats[0].Length != 20 || stats[0].Capacity != 100 {
+		t.Errorf("Stats() = %+v, %v", stats, err)
+	}
+	if names, err := c.List(ctx); err != nil || !slices.Equal(names, []string{"users"}) {
+		t.Errorf("List() = %v, %v", names, err)
+	}
+
+	results, err := c.Batch().Set("users", "x", []byte("1")).Get("users", "x").Get("users", "y").Get("nope", "x").Exec(ctx)
+	if err != nil || len(results) != 4 {
+		t.Fatalf("Exec() = %v, %v", results, err)
+	}
+	if string(results[1].Value) != "1" || !results[1].Found || results[2].Found || results[2].Err != nil || results[3].Err == nil {
+		t.Errorf("Exec() = %+v", results)
+	}
+}
+
+func TestClientRecovers(t *testing.T) {
+	listener := startServer(t)
+	ctx := context.Background()
+	c, err := New(listener.Addr().String(), Options{})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.Create(ctx, "a", 10); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	// Idempotent calls are retried on a new connection when the pooled one died
+	listener.dropAll()
+	if err := c.Set(ctx, "a", "k", []byte("v")); err != nil {
+		t.Errorf("Set() after the connection dropped: %v", err)
+	}
+
+	// Per-call deadlines interrupt calls that wait on the server
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Do(short, "WAITGET a missing 0"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to end WAITGET, got %v", err)
+	}
+	if err := c.Ping(ctx); err != nil {
+		t.Errorf("Ping() after a cancelled call: %v", err)
+	}
+
+	c.Close()
+	if err := c.Ping(ctx); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+}
@@ -0,0 +1,358 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"lrue/client"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrUnsupported is returned for commands that only make sense on a single server
+var ErrUnsupported = errors.New("command is not supported by the cluster client")
+
+// Cluster routes commands to a set of lrue servers. Every cache exists on
+// every server, so a cache's total capacity is its capacity times the number
+// of servers; each key lives on the one server the ring assigns it to.
+// Servers are assumed to run with 64-bit keys, as the lrue binary does.
+type Cluster struct {
+	virtualNodes int
+	mutex        sync.RWMutex
+	ring         *Ring
+	conns        map[string]*client.Conn
+}
+
+// Dial connects to every server in addrs
+func Dial(addrs ...string) (*Cluster, error) {
+	c := &Cluster{
+		virtualNodes: DefaultVirtualNodes,
+		ring:         NewRing(DefaultVirtualNodes),
+		conns:        make(map[string]*client.Conn),
+	}
+	if err := c.SetServers(addrs...); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Discover asks the server at seed for the cluster topology and returns the
+// addresses of the primaries that are not marked failed, ready for Dial or
+// SetServers
+func Discover(seed string) ([]string, error) {
+	conn, err := client.Dial(seed)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	nodes, err := conn.Do("CLUSTER NODES")
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, line := range strings.Split(nodes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		flags := strings.Split(fields[2], ",")
+		if slices.Contains(flags, "primary") && !slices.Contains(flags, "fail") {
+			addrs = append(addrs, fields[1])
+		}
+	}
+	slices.Sort(addrs)
+	return addrs, nil
+}
+
+// Nodes returns the servers commands are routed to
+func (c *Cluster) Nodes() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.ring.Nodes()
+}
+
+// Owner returns the server a key is routed to
+func (c *Cluster) Owner(key string) string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.ring.LocateKey(key)
+}
+
+// Do routes a command: key commands go to the key's owner, cache and
+// manager commands go to every server and their replies are merged
+func (c *Cluster) Do(command string) (string, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	fields := strings.Fields(command)
+	if len(fields) == 0 || len(c.conns) == 0 {
+		return c.any(command)
+	}
+	switch op := strings.ToUpper(fields[0]); op {
+	case "SET", "GET", "DEL":
+		if len(fields) >= 3 {
+			return c.conns[c.ring.LocateKey(fields[2])].Do(command)
+		}
+	case "MOVE":
+		if len(fields) == 4 {
+			return c.conns[c.ring.LocateKey(fields[3])].Do(command)
+		}
+	case "RESTORE", "DELRAW":
+		if len(fields) >= 3 {
+			if key, err := strconv.ParseUint(fields[2], 10, 64); err == nil {
+				return c.conns[c.ring.Locate(key)].Do(command)
+			}
+		}
+	case "CONFIG":
+		if len(fields) >= 2 && strings.EqualFold(fields[1], "GET") {
+			return c.any(command)
+		}
+		return c.all(command, firstReply)
+	case "CREATE", "DESTROY", "CLEAR", "CLEAR_ALL", "RENAME", "COPY":
+		return c.all(command, firstReply)
+	case "INVALIDATE":
+		return c.all(command, sumReplies)
+	case "LIST":
+		return c.all(command, mergeLists)
+	case "PRINT":
+		return c.all(command, func(_ []string, replies []string) string { return strings.Join(replies, "") })
+	case "DUMP":
+		return c.all(command, mergeDumps)
+	case "INFO":
+		return c.all(command, func(nodes, replies []string) string {
+			for i := range replies {
+				replies[i] = "# Node " + nodes[i] + "\n" + replies[i]
+			}
+			return strings.Join(replies, "\n\n")
+		})
+	case "REPLICAOF", "REPLSYNC":
+		return "", fmt.Errorf("%w: %s", ErrUnsupported, op)
+	}
+	return c.any(command)
+}
+
+// any sends a command to the first server, for commands whose reply is the same everywhere
+func (c *Cluster) any(command string) (string, error) {
+	nodes := c.ring.Nodes()
+	if len(nodes) == 0 {
+		return "", errors.New("cluster has no servers")
+	}
+	return c.conns[nodes[0]].Do(command)
+}
+
+// all sends a command to every server in parallel and merges the replies,
+// failing with the first server error
+func (c *Cluster) all(command string, merge func(nodes, replies []string) string) (string, error) {
+	nodes := c.ring.Nodes()
+	replies := make([]string, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replies[i], errs[i] = c.conns[node].Do(command)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", nodes[i], err)
+		}
+	}
+	return merge(nodes, replies), nil
+}
+
+func firstReply(_ []string, replies []string) string {
+	return replies[0]
+}
+
+func sumReplies(_ []string, replies []string) string {
+	total := 0
+	for _, reply := range replies {
+		n, _ := strconv.Atoi(reply)
+		total += n
+	}
+	return strconv.Itoa(total)
+}
+
+// mergeLists combines LIST replies, listing each cache once with the keys of every server
+func mergeLists(_ []string, replies []string) string {
+	var order []string
+	keys := make(map[string][]string)
+	for _, reply := range replies {
+		var header string
+		for _, line := range strings.Split(reply, "\n") {
+			switch {
+			case line == "" || line == "No caches":
+			case strings.HasPrefix(line, "Key: "):
+				keys[header] = append(keys[header], line)
+			default:
+				header = line
+				if _, seen := keys[header]; !seen {
+					order = append(order, header)
+					keys[header] = nil
+				}
+			}
+		}
+	}
+	if len(order) == 0 {
+		return "No caches"
+	}
+	lines := make([]string, 0, len(order))
+	for _, header := range order {
+		lines = append(lines, header)
+		lines = append(lines, keys[header]...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// mergeDumps keeps the first server's header line and every server's entries
+func mergeDumps(_ []string, replies []string) string {
+	lines := []string{}
+	for i, reply := range replies {
+		entries := strings.Split(reply, "\n")
+		if i > 0 {
+			entries = entries[1:]
+		}
+		lines = append(lines, entries...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// SetServers changes the server list, connecting to new servers and moving
+// the keys whose owner changed. Only those keys move: with consistent hashing
+// that is roughly the share of the ring gained or lost. If moving fails the
+// new server list is kept and the error is returned.
+func (c *Cluster) SetServers(addrs ...string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	conns := make(map[string]*client.Conn, len(addrs))
+	for _, addr := range addrs {
+		if conn, ok := c.conns[addr]; ok {
+			conns[addr] = conn
+			continue
+		}
+		conn, err := client.Dial(addr)
+		if err != nil {
+			for addr, conn := range conns {
+				if _, old := c.conns[addr]; !old {
+					conn.Close()
+				}
+			}
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+		conns[addr] = conn
+	}
+	for addr, conn := range c.conns {
+		if _, ok := conns[addr]; !ok {
+			conns[addr] = conn // still needed as a migration source
+		}
+	}
+
+	oldRing, newRing := c.ring, NewRing(c.virtualNodes, addrs...)
+	err := rebalance(oldRing, newRing, conns)
+
+	for addr, conn := range conns {
+		if !slices.Contains(newRing.nodes, addr) {
+			conn.Close()
+			delete(conns, addr)
+		}
+	}
+	c.ring, c.conns = newRing, conns
+	return err
+}
+
+// rebalance moves every entry whose owner differs between the rings and
+// creates each cache on servers that do not have it yet
+func rebalance(oldRing, newRing *Ring, conns map[string]*client.Conn) error {
+	headers := make(map[string]string)
+	created := make(map[[2]string]bool)
+	ensure := func(node, title string) error {
+		if created[[2]string{node, title}] {
+			return nil
+		}
+		capacity, opts, _ := strings.Cut(headers[title], " ")
+		// The description is free text and the last option, so it cannot be
+		// a CREATE argument; CONFIG SET takes the rest of the line
+		opts, description, _ := strings.Cut(opts, " description=")
+		if _, err := conns[node].Do(fmt.Sprintf("CREATE %s %s IFNOTEXISTS %s", title, capacity, opts)); err != nil {
+			return fmt.Errorf("%s: %w", node, err)
+		}
+		if description != "" {
+			if _, err := conns[node].Do(fmt.Sprintf("CONFIG SET %s description %s", title, description)); err != nil {
+				return fmt.Errorf("%s: %w", node, err)
+			}
+		}
+		created[[2]string{node, title}] = true
+		return nil
+	}
+
+	for _, node := range oldRing.Nodes() {
+		source := conns[node]
+		list, err := source.Do("LIST")
+		if err != nil {
+			return fmt.Errorf("%s: %w", node, err)
+		}
+		for _, line := range strings.Split(list, "\n") {
+			if line == "No caches" || strings.HasPrefix(line, "Key: ") {
+				continue
+			}
+			title, _, _ := strings.Cut(line, " ")
+			dump, err := source.Do("DUMP " + title)
+			if err != nil {
+				return fmt.Errorf("%s: %w", node, err)
+			}
+			entries := strings.Split(dump, "\n")
+			if _, ok := headers[title]; !ok {
+				headers[title] = entries[0]
+			}
+			created[[2]string{node, title}] = true
+
+			for _, entry := range entries[1:] {
+				hashed, _, _ := strings.Cut(entry, " ")
+				key, err := strconv.ParseUint(hashed, 10, 64)
+				if err != nil {
+					return fmt.Errorf("%s: unexpected DUMP line %q", node, entry)
+				}
+				owner := newRing.Locate(key)
+				if owner == node {
+					continue
+				}
+				if err := ensure(owner, title); err != nil {
+					return err
+				}
+				if _, err := conns[owner].Do("RESTORE " + title + " " + entry); err != nil {
+					return fmt.Errorf("%s: %w", owner, err)
+				}
+				if _, err := source.Do("DELRAW " + title + " " + hashed); err != nil {
+					return fmt.Errorf("%s: %w", node, err)
+				}
+			}
+		}
+	}
+
+	for title := range headers {
+		for _, node := range newRing.Nodes() {
+			if err := ensure(node, title); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes every server connection
+func (c *Cluster) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var errs []error
+	for addr, conn := range c.conns {
+		errs = append(errs, conn.Close())
+		delete(c.conns, addr)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,208 @@
+package cluster
+
+import (
+	"fmt"
+	"lrue/api"
+	"lrue/client"
+	"lrue/src"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServers(t *testing.T, n int) []string {
+	t.Helper()
+	addrs := make([]string, n)
+	for i := range addrs {
+		srv := api.NewServer(src.NewCacheManager[uint16, uint64, []byte]())
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen() error = %v", err)
+		}
+		go api.Serve(listener, 512, srv)
+		t.Cleanup(func() {
+			listener.Close()
+			srv.Close()
+		})
+		addrs[i] = listener.Addr().String()
+	}
+	return addrs
+}
+
+func TestRing(t *testing.T) {
+	nodes := []string{"a:1", "b:1", "c:1"}
+	before := NewRing(DefaultVirtualNodes, nodes...)
+	after := NewRing(DefaultVirtualNodes, append(nodes, "d:1")...)
+
+	const keys = 10000
+	counts := make(map[string]int)
+	moved := 0
+	for i := range keys {
+		key := fmt.Sprintf("key-%d", i)
+		owner, newOwner := before.LocateKey(key), after.LocateKey(key)
+		counts[owner]++
+		if owner != newOwner {
+			moved++
+			if newOwner != "d:1" {
+				t.Fatalf("Key %s moved from %s to %s instead of the new node", key, owner, newOwner)
+			}
+		}
+	}
+	for _, node := range nodes {
+		if share := float64(counts[node]) / keys; share < 0.25 || share > 0.42 {
+			t.Errorf("Expected roughly a third of the keys on %s, got %.2f", node, share)
+		}
+	}
+	if share := float64(moved) / keys; share < 0.15 || share > 0.35 {
+		t.Errorf("Expected roughly a quarter of the keys to move, got %.2f", share)
+	}
+	if got := NewRing(DefaultVirtualNodes).Locate(1); got != "" {
+		t.Errorf("Expected an empty ring to locate nothing, got %q", got)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	addrs := startServers(t, 4)
+	c, err := Dial(addrs[:3]...)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Do("CREATE users 1000 ttl=1h"); err != nil {
+		t.Fatalf("CREATE error = %v", err)
+	}
+	if _, err := c.Do("CONFIG SET users description signed in users"); err != nil {
+		t.Fatalf("CONFIG SET error = %v", err)
+	}
+	const keys = 300
+	for i := range keys {
+		if _, err := c.Do(fmt.Sprintf("SET users k%d v%d TAGS t%d", i, i, i%2)); err != nil {
+			t.Fatalf("SET error = %v", err)
+		}
+	}
+
+	// Keys are spread over the servers and each lives only on its owner
+	checkPlacement := func() {
+		t.Helper()
+		direct := make(map[string]*client.Conn)
+		for _, addr := range c.Nodes() {
+			conn, err := client.Dial(addr)
+			if err != nil {
+				t.Fatalf("client.Dial() error = %v", err)
+			}
+			defer conn.Close()
+			direct[addr] = conn
+		}
+		perNode := make(map[string]int)
+		for i := range keys {
+			key := fmt.Sprintf("k%d", i)
+			for addr, conn := range direct {
+				_, err := conn.Do("GET users " + key)
+				if found := err == nil; found != (addr == c.Owner(key)) {
+					t.Fatalf("Key %s found=%v on %s, owner is %s", key, found, addr, c.Owner(key))
+				}
+				if err == nil {
+					perNode[addr]++
+				}
+			}
+			if got, err := c.Do("GET users " + key); err != nil || got != fmt.Sprintf("v%d", i) {
+				t.Fatalf("GET %s = %q, %v", key, got, err)
+			}
+		}
+		if len(perNode) != len(direct) {
+			t.Errorf("Expected keys on all %d servers, got %v", len(direct), perNode)
+		}
+	}
+	checkPlacement()
+
+	list, err := c.Do("LIST")
+	if err != nil || strings.Count(list, "users capacity=1000") != 1 || strings.Count(list, "Key: ") != keys {
+		t.Errorf("Expected LIST to merge one cache with %d keys, got %v:\n%s", keys, err, list)
+	}
+
+	// Adding a server only moves keys onto it
+	before := make(map[string]string)
+	for i := range keys {
+		key := fmt.Sprintf("k%d", i)
+		before[key] = c.Owner(key)
+	}
+	if err := c.SetServers(addrs...); err != nil {
+		t.Fatalf("SetServers() error = %v", err)
+	}
+	moved := 0
+	for key, owner := range before {
+		if newOwner := c.Owner(key); newOwner != owner {
+			moved++
+			if newOwner != addrs[3] {
+				t.Errorf("Key %s moved between existing servers", key)
+			}
+		}
+	}
+	if moved == 0 || moved > keys/2 {
+		t.Errorf("Expected a minority of keys to move, moved %d of %d", moved, keys)
+	}
+	checkPlacement()
+	if ttl, err := c.Do("CONFIG GET users ttl"); err != nil || ttl != "1h0m0s" {
+		t.Errorf("Expected migrated cache to keep its options, got %q, %v", ttl, err)
+	}
+	for _, addr := range addrs {
+		conn, err := client.Dial(addr)
+		if err != nil {
+			t.Fatalf("client.Dial() error = %v", err)
+		}
+		description, err := conn.Do("CONFIG GET users description")
+		conn.Close()
+		if err != nil || description != "signed in users" {
+			t.Errorf("Expected %s to keep the description, got %q, %v", addr, description, err)
+		}
+	}
+
+	// Removing a server moves its keys back
+	if err := c.SetServers(addrs[1:]...); err != nil {
+		t.Fatalf("SetServers() error = %v", err)
+	}
+	checkPlacement()
+
+	if n, err := c.Do("INVALIDATE users t0"); err != nil || n != fmt.Sprint(keys/2) {
+		t.Errorf("Expected INVALIDATE to remove %d keys across servers, got %q, %v", keys/2, n, err)
+	}
+	if _, err := c.Do("CLEAR_ALL"); err != nil {
+		t.Fatalf("CLEAR_ALL error = %v", err)
+	}
+	if list, _ := c.Do("LIST"); list != "No caches" {
+		t.Errorf("Expected no caches after CLEAR_ALL, got %q", list)
+	}
+	if _, err := c.Do("REPLICAOF NO ONE"); err == nil {
+		t.Errorf("Expected REPLICAOF to be rejected by the cluster client")
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	addrs := startServers(t, 3)
+	seed, err := client.Dial(addrs[0])
+	if err != nil {
+		t.Fatalf("client.Dial() error = %v", err)
+	}
+	defer seed.Close()
+	for _, addr := range addrs[1:] {
+		host, port, _ := net.SplitHostPort(addr)
+		if _, err := seed.Do("CLUSTER MEET " + host + " " + port); err != nil {
+			t.Fatalf("CLUSTER MEET error = %v", err)
+		}
+	}
+	want := slices.Sorted(slices.Values(addrs))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := Discover(addrs[2])
+		if err == nil && slices.Equal(got, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Discover() = %v, %v, want %v", got, err, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
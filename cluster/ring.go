@@ -0,0 +1,75 @@
+// Package cluster spreads caches and keys over several lrue servers
+package cluster
+
+import (
+	"hash/fnv"
+	"lrue/api"
+	"slices"
+	"strconv"
+)
+
+// DefaultVirtualNodes is how many points each server gets on the ring
+const DefaultVirtualNodes = 160
+
+// Ring is a consistent hash ring. Each server owns the arcs ending at its
+// virtual nodes, so adding or removing a server only moves the keys on the
+// arcs it gains or loses.
+type Ring struct {
+	points []uint64
+	owners map[uint64]string
+	nodes  []string
+}
+
+// NewRing places virtualNodes points on the ring for every node
+func NewRing(virtualNodes int, nodes ...string) *Ring {
+	r := &Ring{owners: make(map[uint64]string, virtualNodes*len(nodes))}
+	for _, node := range slices.Compact(slices.Sorted(slices.Values(nodes))) {
+		r.nodes = append(r.nodes, node)
+		for i := range virtualNodes {
+			h := fnv.New64a()
+			h.Write([]byte(node + "#" + strconv.Itoa(i)))
+			point := mix(h.Sum64())
+			if _, taken := r.owners[point]; taken {
+				continue
+			}
+			r.owners[point] = node
+			r.points = append(r.points, point)
+		}
+	}
+	slices.Sort(r.points)
+	return r
+}
+
+// Nodes returns the servers on the ring in sorted order
+func (r *Ring) Nodes() []string {
+	return slices.Clone(r.nodes)
+}
+
+// Locate returns the server owning a key, given the hashed key a cache stores
+// it under (see api.Hash); it returns "" for an empty ring
+func (r *Ring) Locate(hashedKey uint64) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	point := mix(hashedKey)
+	i, _ := slices.BinarySearch(r.points, point)
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// LocateKey returns the server owning a key as typed in a command
+func (r *Ring) LocateKey(key string) string {
+	return r.Locate(api.Hash[uint64]([]byte(key)))
+}
+
+// mix spreads similar hashes over the whole ring (splitmix64 finalizer)
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
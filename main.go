@@ -1,66 +1,384 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
 	"lrue/api"
 	"lrue/src"
+	"net"
+	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 type Config struct {
-	port       string
-	bufferSize int
-	only       string
+	port           string
+	bufferSize     int
+	maxCommand     string
+	maxCommandSize int
+	only           string
+	maxMemory      string
+	maxMemoryLimit uint64
+	memoryPolicy   string
+	replicaOf      string
+	announce       string
+	respPort       string
+	mcPort         string
+	mcCache        string
+	httpPort       string
+	tlsCert        string
+	tlsKey         string
+	tlsClientCA    string
+	aclFile        string
+	peerUser       string
+	peerPassword   string
+	connLimits     string
+	userLimits     string
+	connLimit      api.Limits
+	userLimit      api.Limits
+	drainTimeout   time.Duration
+	maxConns       int
+	readTimeout    time.Duration
+	idleTimeout    time.Duration
+	keepAlive      time.Duration
+	listen         []string
+	listeners      []api.Listener
+	hashPassword   bool
+}
+
+// listFlag collects the values of a flag given several times
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *listFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
 func main() {
 	config := parseFlags()
-	if err := validateConfig(config); err != nil {
+	if config.hashPassword {
+		printPasswordHash()
+		return
+	}
+	if err := validateConfig(&config); err != nil {
 		src.FatalError("Invalid configuration", err)
 	}
 	mgr := src.NewCacheManager[uint8, uint64, []byte]()
+	strategy, _ := src.ParseMemoryStrategy(config.memoryPolicy)
+	mgr.SetMemoryLimit(config.maxMemoryLimit, strategy)
+	srv := api.NewServer(mgr)
+	if config.replicaOf != "" {
+		srv.ReplicaOf(config.replicaOf)
+	}
+	srv.Announce(config.announce)
+	srv.SetMaxCommandSize(config.maxCommandSize)
+	if config.tlsCert != "" {
+		files := api.TLSFiles{Cert: config.tlsCert, Key: config.tlsKey, ClientCA: config.tlsClientCA}
+		if err := srv.SetTLS(files); err != nil {
+			src.FatalError("Failed to load TLS certificates", err)
+		}
+	}
+	if config.aclFile != "" {
+		acl, err := api.LoadACL(config.aclFile)
+		if err != nil {
+			src.FatalError("Failed to load the ACL file", err)
+		}
+		srv.SetACL(acl)
+	}
+	srv.SetPeerAuth(config.peerUser, config.peerPassword)
+	srv.SetLimits(config.connLimit, config.userLimit)
+	srv.SetDrainTimeout(config.drainTimeout)
+	srv.SetMaxConnections(config.maxConns)
+	srv.SetTimeouts(config.readTimeout, config.idleTimeout)
+	srv.SetKeepAlive(config.keepAlive)
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	switch config.only {
-	case "tcp":
-		api.ServerTCP(config.port, uint16(config.bufferSize), mgr)
-	case "cli":
-		api.Cli(ctx, mgr)
-	default:
-		go api.ServerTCP(config.port, uint16(config.bufferSize), mgr)
-		api.Cli(ctx, mgr)
+	for _, listener := range config.listeners {
+		if listener.Protocol != api.ProtocolMemcached || config.only == "cli" {
+			continue
+		}
+		cache, _, err := mgr.CreateIfAbsent(listener.Cache, ^uint8(0), src.CacheOptions{})
+		if err != nil {
+			src.FatalError("Failed to create the memcached cache", err)
+		}
+		cache.Release()
+	}
+
+	// Caches are flushed once every client is gone
+	srv.OnShutdown(mgr.ClearAllCaches)
+	if config.only != "cli" {
+		go func() {
+			if err := api.ListenAndServe(ctx, config.listeners, uint16(config.bufferSize), srv); err != nil {
+				src.FatalError("Failed to start the server", err)
+			}
+		}()
+	}
+	if config.only != "tcp" {
+		go api.Cli(ctx, srv)
 	}
 
 	<-ctx.Done()
 	fmt.Println("Shutting down gracefully...")
-	mgr.ClearAllCaches()
+	drain, cancel := context.WithTimeout(context.Background(), config.drainTimeout)
+	defer cancel()
+	// Waits for ListenAndServe to finish draining, or shuts down a CLI only server
+	srv.Shutdown(drain)
 }
 
 func parseFlags() Config {
 	port := flag.String("port", "7333", "Port to run the server on")
 	bufferSize := flag.Int("buffer", 256, "Buffer size for TCP connections")
+	maxCommand := flag.String("max-command", "1mb", "Longest command line accepted on TCP connections")
 	only := flag.String("only", "", "Run only either TCP server or CLI")
+	maxMemory := flag.String("maxmemory", "0", "Memory budget shared by all caches, e.g. 64mb (0 for unlimited)")
+	memoryPolicy := flag.String("maxmemory-policy", "lru", "Cache to evict from when over budget: lru or largest")
+	replicaOf := flag.String("replicaof", "", "Replicate from the primary at host:port")
+	announce := flag.String("announce", "", "Address other cluster nodes reach this node at (default: the first TCP listener)")
+	respPort := flag.String("resp", "", "Port to serve the Redis (RESP) protocol on, disabled when empty")
+	mcPort := flag.String("memcached", "", "Port to serve the memcached text protocol on, disabled when empty")
+	mcCache := flag.String("memcached-cache", api.DefaultMemcachedCache, "Cache holding memcached items, created if missing")
+	httpPort := flag.String("http", "", "Port to serve the HTTP REST API on, disabled when empty")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate to serve every listener over TLS with")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM CA certificates that client certificates must be signed by")
+	aclFile := flag.String("acl-file", "", "File of users clients must authenticate as, see -hash-password")
+	peerUser := flag.String("peer-user", "", "ACL user replication and gossip log in to other nodes as")
+	peerPassword := flag.String("peer-password", "", "Password of -peer-user")
+	connLimits := flag.String("conn-limits", "", "Rate limits of each connection: commands=<n>,bytes=<n> per second and keys=<n> new keys per cache")
+	userLimits := flag.String("user-limits", "", "Rate limits of each ACL user across its connections, in the format of -conn-limits")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "How long in-flight commands may finish on shutdown before connections are closed")
+	maxConns := flag.Int("max-conns", 256, "Clients served at once on the TCP port; others are refused")
+	readTimeout := flag.Duration("read-timeout", 0, "How long a client may take to send a started command (0 for no limit)")
+	idleTimeout := flag.Duration("idle-timeout", 0, "How long a client may stay without sending a command (0 for no limit)")
+	keepAlive := flag.Duration("tcp-keepalive", 15*time.Second, "TCP keepalive period of client connections (0 disables keepalive)")
+	var listen listFlag
+	flag.Var(&listen, "listen", "Address to serve on instead of -port, repeatable: tcp://host:port, unix:///path?mode=0660, http://host:port, resp://host:port, memcached://host:port?cache=name, or http, resp and memcached with +unix:///path")
+	configFile := flag.String("config", "", "File of flags, one \"name value\" per line; command line flags take precedence")
+	hashPassword := flag.Bool("hash-password", false, "Read a password from stdin, print its hash for the ACL file and exit")
 	flag.Parse()
+	if *configFile != "" {
+		if err := loadConfigFile(*configFile); err != nil {
+			src.FatalError("Failed to read the config file", err)
+		}
+	}
 	return Config{
-		port:       *port,
-		bufferSize: *bufferSize,
-		only:       *only,
+		port:         *port,
+		bufferSize:   *bufferSize,
+		maxCommand:   *maxCommand,
+		only:         *only,
+		maxMemory:    *maxMemory,
+		memoryPolicy: *memoryPolicy,
+		replicaOf:    *replicaOf,
+		announce:     *announce,
+		respPort:     *respPort,
+		mcPort:       *mcPort,
+		mcCache:      *mcCache,
+		httpPort:     *httpPort,
+		tlsCert:      *tlsCert,
+		tlsKey:       *tlsKey,
+		tlsClientCA:  *tlsClientCA,
+		aclFile:      *aclFile,
+		peerUser:     *peerUser,
+		peerPassword: *peerPassword,
+		connLimits:   *connLimits,
+		userLimits:   *userLimits,
+		drainTimeout: *drainTimeout,
+		maxConns:     *maxConns,
+		readTimeout:  *readTimeout,
+		idleTimeout:  *idleTimeout,
+		keepAlive:    *keepAlive,
+		listen:       listen,
+		hashPassword: *hashPassword,
+	}
+}
+
+// loadConfigFile sets the flags listed in a file, one "name value" or
+// "name=value" per line, except those given on the command line. Repeatable
+// flags such as listen may appear on several lines. Empty lines and lines
+// starting with # are ignored.
+func loadConfigFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// The name ends at the first space or =, a name alone sets a boolean
+		key, value := line, "true"
+		if i := strings.IndexAny(line, " \t="); i >= 0 {
+			key, value = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		key = strings.TrimLeft(key, "-")
+		switch {
+		case key == "config" || key == "hash-password":
+			return fmt.Errorf("%s:%d: %s cannot be set in a config file", name, n, key)
+		case given[key]:
+			continue
+		}
+		if err := flag.Set(key, value); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, n, err)
+		}
 	}
+	return scanner.Err()
 }
 
-func validateConfig(config Config) error {
+func validateConfig(config *Config) error {
 	portNum, err := strconv.Atoi(config.port)
 	if err != nil || portNum < 1024 || portNum > int(^uint16(0)) {
 		return fmt.Errorf("port must be a number between 1024 and 65535")
 	}
+	used := map[string]string{config.port: "port"}
+	for _, listener := range []struct{ flag, port string }{
+		{"resp", config.respPort}, {"memcached", config.mcPort}, {"http", config.httpPort},
+	} {
+		if listener.port == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(listener.port); err != nil || n < 1024 || n > int(^uint16(0)) {
+			return fmt.Errorf("%s must be a port between 1024 and 65535", listener.flag)
+		}
+		if other, taken := used[listener.port]; taken {
+			return fmt.Errorf("%s uses the same port as %s", listener.flag, other)
+		}
+		used[listener.port] = listener.flag
+	}
 	if config.bufferSize <= 16 || config.bufferSize > 1024 {
 		return fmt.Errorf("buffer size must be between 16 and 1024 bytes")
 	}
+	maxCommand, err := api.ParseBytes(config.maxCommand)
+	if err != nil || maxCommand < uint64(config.bufferSize) || maxCommand > 512<<20 {
+		return fmt.Errorf("max-command must be a byte count between the buffer size and 512mb")
+	}
+	config.maxCommandSize = int(maxCommand)
+	if (config.tlsCert == "") != (config.tlsKey == "") {
+		return fmt.Errorf("tls-cert and tls-key must be given together")
+	}
+	if config.tlsClientCA != "" && config.tlsCert == "" {
+		return fmt.Errorf("tls-client-ca needs tls-cert and tls-key")
+	}
+	if (config.peerUser == "") != (config.peerPassword == "") {
+		return fmt.Errorf("peer-user and peer-password must be given together")
+	}
+	if strings.ContainsAny(config.peerUser+config.peerPassword, " \t\r\n") {
+		return fmt.Errorf("peer-user and peer-password cannot contain spaces")
+	}
+	if config.connLimit, err = api.ParseLimits(config.connLimits); err != nil {
+		return fmt.Errorf("conn-limits: %w", err)
+	}
+	if config.userLimit, err = api.ParseLimits(config.userLimits); err != nil {
+		return fmt.Errorf("user-limits: %w", err)
+	}
+	if config.drainTimeout <= 0 {
+		return fmt.Errorf("drain-timeout must be positive")
+	}
+	if config.maxConns < 1 {
+		return fmt.Errorf("max-conns must be at least 1")
+	}
+	if config.readTimeout < 0 || config.idleTimeout < 0 || config.keepAlive < 0 {
+		return fmt.Errorf("read-timeout, idle-timeout and tcp-keepalive cannot be negative")
+	}
+	limit, err := api.ParseBytes(config.maxMemory)
+	if err != nil {
+		return fmt.Errorf("maxmemory must be a byte count such as 1048576 or 64mb")
+	}
+	config.maxMemoryLimit = limit
+	if _, err := src.ParseMemoryStrategy(config.memoryPolicy); err != nil {
+		return fmt.Errorf("maxmemory-policy must be lru or largest")
+	}
+	if config.replicaOf != "" {
+		if _, _, err := net.SplitHostPort(config.replicaOf); err != nil {
+			return fmt.Errorf("replicaof must be host:port")
+		}
+	}
+	if err := buildListeners(config); err != nil {
+		return err
+	}
+	if config.announce == "" {
+		config.announce = defaultAnnounce(config)
+	} else if _, _, err := net.SplitHostPort(config.announce); err != nil {
+		return fmt.Errorf("announce must be host:port")
+	}
+	return nil
+}
+
+// buildListeners parses -listen, serving on -port on every address without it,
+// and adds the HTTP API of -http, RESP of -resp and memcached of -memcached.
+// Memcached listeners without a cache use -memcached-cache.
+func buildListeners(config *Config) error {
+	specs := config.listen
+	if len(specs) == 0 {
+		specs = []string{"tcp://:" + config.port}
+	}
+	if config.httpPort != "" {
+		specs = append(specs, "http://:"+config.httpPort)
+	}
+	if config.respPort != "" {
+		specs = append(specs, "resp://:"+config.respPort)
+	}
+	if config.mcPort != "" {
+		specs = append(specs, "memcached://:"+config.mcPort)
+	}
+	used := make(map[string]bool)
+	for _, spec := range specs {
+		listener, err := api.ParseListener(spec)
+		if err != nil {
+			return fmt.Errorf("listen: %w", err)
+		}
+		if used[listener.Network+" "+listener.Address] {
+			return fmt.Errorf("listen: %s is used twice", listener.Address)
+		}
+		used[listener.Network+" "+listener.Address] = true
+		if listener.Protocol == api.ProtocolMemcached && listener.Cache == "" {
+			listener.Cache = config.mcCache
+		}
+		config.listeners = append(config.listeners, listener)
+	}
 	return nil
 }
+
+// defaultAnnounce is the address of the first TCP listener, on loopback when
+// it listens on every interface
+func defaultAnnounce(config *Config) string {
+	for _, listener := range config.listeners {
+		if listener.Protocol != api.ProtocolTCP || listener.Network != "tcp" {
+			continue
+		}
+		host, port, _ := net.SplitHostPort(listener.Address)
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			host = "127.0.0.1"
+		}
+		return net.JoinHostPort(host, port)
+	}
+	return net.JoinHostPort("127.0.0.1", config.port)
+}
+
+// printPasswordHash reads a password from stdin and prints its ACL file hash
+func printPasswordHash() {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		src.FatalError("Failed to read the password", err)
+	}
+	hash, err := api.HashPassword(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		src.FatalError("Failed to hash the password", err)
+	}
+	fmt.Println(hash)
+}
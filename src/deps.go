@@ -0,0 +1,293 @@
+package src
+
+import "errors"
+
+// ErrForeignCache is returned when a dependency spans caches that do not share a manager
+var ErrForeignCache = errors.New("caches do not share a dependency graph")
+
+func newDepGraph[U, K Uints, V any]() *depGraph[U, K, V] {
+	return &depGraph[U, K, V]{
+		parents:  make(map[depRef[U, K, V]]depSet[U, K, V]),
+		children: make(map[depRef[U, K, V]]depSet[U, K, V]),
+	}
+}
+
+func (g *depGraph[U, K, V]) empty() bool {
+	return g.edges.Load() == 0
+}
+
+func (g *depGraph[U, K, V]) link(child depRef[U, K, V], parents []depRef[U, K, V]) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, parent := range parents {
+		if parent == child {
+			continue
+		}
+		ps, ok := g.parents[child]
+		if !ok {
+			ps = make(depSet[U, K, V])
+			g.parents[child] = ps
+		}
+		if _, dup := ps[parent]; dup {
+			continue
+		}
+		ps[parent] = struct{}{}
+
+		cs, ok := g.children[parent]
+		if !ok {
+			cs = make(depSet[U, K, V])
+			g.children[parent] = cs
+		}
+		cs[child] = struct{}{}
+		g.edges.Add(1)
+	}
+}
+
+// detach drops every edge touching ref, in both directions
+func (g *depGraph[U, K, V]) detach(ref depRef[U, K, V]) {
+	for parent := range g.parents[ref] {
+		g.unlink(parent, ref)
+	}
+	for child := range g.children[ref] {
+		g.unlink(ref, child)
+	}
+}
+
+func (g *depGraph[U, K, V]) unlink(parent, child depRef[U, K, V]) {
+	cs := g.children[parent]
+	if _, ok := cs[child]; !ok {
+		return
+	}
+	delete(cs, child)
+	if len(cs) == 0 {
+		delete(g.children, parent)
+	}
+	ps := g.parents[child]
+	delete(ps, parent)
+	if len(ps) == 0 {
+		delete(g.parents, child)
+	}
+	g.edges.Add(-1)
+}
+
+// collect walks the graph from the changed refs and returns every transitive
+// dependent, detaching them (and any removed refs) on the way. Changed refs are
+// marked visited up front so a cycle can never eject the entry that triggered it.
+func (g *depGraph[U, K, V]) collect(changed []depRef[U, K, V], gone []bool) []depRef[U, K, V] {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	visited := make(map[depRef[U, K, V]]struct{}, len(changed))
+	queue := make([]depRef[U, K, V], 0, len(changed))
+	for _, ref := range changed {
+		if _, ok := visited[ref]; !ok {
+			visited[ref] = struct{}{}
+			queue = append(queue, ref)
+		}
+	}
+
+	var dependents []depRef[U, K, V]
+	for len(queue) > 0 {
+		ref := queue[0]
+		queue = queue[1:]
+		for child := range g.children[ref] {
+			if _, ok := visited[child]; ok {
+				continue
+			}
+			visited[child] = struct{}{}
+			queue = append(queue, child)
+			dependents = append(dependents, child)
+		}
+	}
+
+	for i, ref := range changed {
+		if gone[i] {
+			g.detach(ref)
+		} else {
+			for child := range g.children[ref] {
+				g.unlink(ref, child)
+			}
+		}
+	}
+	for _, ref := range dependents {
+		g.detach(ref)
+	}
+	return dependents
+}
+
+// refsOf returns every ref belonging to cache that takes part in an edge
+func (g *depGraph[U, K, V]) refsOf(cache *LRUMap[U, K, V]) []depRef[U, K, V] {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	var refs []depRef[U, K, V]
+	for ref := range g.parents {
+		if ref.cache == cache {
+			refs = append(refs, ref)
+		}
+	}
+	for ref := range g.children {
+		if _, ok := g.parents[ref]; !ok && ref.cache == cache {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// drop detaches refs without touching their dependents
+func (g *depGraph[U, K, V]) drop(refs []depRef[U, K, V]) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, ref := range refs {
+		g.detach(ref)
+	}
+}
+
+// invalidate ejects every dependent of the changed refs. It must be called
+// without holding any cache lock.
+func (g *depGraph[U, K, V]) invalidate(changed []depRef[U, K, V], gone []bool) {
+	dependents := g.collect(changed, gone)
+	if len(dependents) == 0 {
+		return
+	}
+
+	byCache := make(map[*LRUMap[U, K, V]][]K)
+	for _, ref := range dependents {
+		byCache[ref.cache] = append(byCache[ref.cache], ref.key)
+	}
+	for cache, keys := range byCache {
+		cache.mutex.Lock()
+		for _, key := range keys {
+			cache.eject(key, EventDel)
+		}
+		cache.unlock()
+	}
+}
+
+// markStale records a changed or removed key whose dependents must be
+// invalidated once the write lock is released
+func (m *LRUMap[U, K, V]) markStale(key K, gone bool) {
+	if m.deps.empty() {
+		return
+	}
+	m.stale = append(m.stale, staleKey[K]{key: key, gone: gone})
+}
+
+// markEvicted records an evicted key whose edges must be dropped once the
+// write lock is released. Its dependents stay: they are not stale, only the
+// entry they were derived from no longer fits.
+func (m *LRUMap[U, K, V]) markEvicted(key K) {
+	if m.deps.empty() {
+		return
+	}
+	m.stale = append(m.stale, staleKey[K]{key: key, gone: true, evicted: true})
+}
+
+// unlock releases the write lock and then cascades invalidations recorded
+// while it was held
+func (m *LRUMap[U, K, V]) unlock() {
+	m.release().settle()
+}
+
+// pendingWork is what a cache has to do once its write lock is released
+type pendingWork[U, K Uints, V any] struct {
+	cache   *LRUMap[U, K, V]
+	owner   *CacheManager[U, K, V]
+	stale   []staleKey[K]
+	cleared bool
+}
+
+// release releases the write lock without settling, for callers that must
+// release several locks before any cascade may lock a cache again
+func (m *LRUMap[U, K, V]) release() pendingWork[U, K, V] {
+	work := pendingWork[U, K, V]{cache: m, owner: m.owner, stale: m.stale, cleared: m.cleared}
+	m.stale, m.cleared = nil, false
+	m.mutex.Unlock()
+	return work
+}
+
+// settle relieves memory pressure and cascades the recorded invalidations
+func (w pendingWork[U, K, V]) settle() {
+	m, stale, cleared, owner := w.cache, w.stale, w.cleared, w.owner
+	if owner != nil {
+		owner.relieve()
+	}
+
+	if cleared {
+		m.invalidateAll()
+		return
+	}
+	var refs, evicted []depRef[U, K, V]
+	var gone []bool
+	for _, s := range stale {
+		ref := depRef[U, K, V]{cache: m, key: s.key}
+		if s.evicted {
+			evicted = append(evicted, ref)
+			continue
+		}
+		refs = append(refs, ref)
+		gone = append(gone, s.gone)
+	}
+	// Cascades go first: a key that was changed and then evicted still
+	// invalidates the dependents of its change
+	if len(refs) > 0 {
+		m.deps.invalidate(refs, gone)
+	}
+	if len(evicted) > 0 {
+		m.deps.drop(evicted)
+	}
+}
+
+// invalidateAll ejects the dependents of every entry of m and drops the edges
+// touching m, once it is cleared or has left its manager
+func (m *LRUMap[U, K, V]) invalidateAll() {
+	refs := m.deps.refsOf(m)
+	if len(refs) == 0 {
+		return
+	}
+	gone := make([]bool, len(refs))
+	for i := range gone {
+		gone[i] = true
+	}
+	m.deps.invalidate(refs, gone)
+}
+
+// DependsOn declares that key is derived from parents in the same cache.
+// A Put or Eject of any parent ejects key and, transitively, its dependents.
+// Key must be stored: its edges are dropped once it leaves the cache.
+func (m *LRUMap[U, K, V]) DependsOn(key K, parents ...K) error {
+	return m.DependsOnIn(key, m, parents...)
+}
+
+// DependsOnIn declares that key is derived from parentKeys stored in another cache
+func (m *LRUMap[U, K, V]) DependsOnIn(key K, parent *LRUMap[U, K, V], parentKeys ...K) error {
+	if parent.deps != m.deps {
+		return ErrForeignCache
+	}
+	refs := make([]depRef[U, K, V], len(parentKeys))
+	for i, pk := range parentKeys {
+		refs[i] = depRef[U, K, V]{cache: parent, key: pk}
+	}
+
+	// The locks keep key stored and both caches attached until the edges are
+	// recorded, so its removal or a destroy cannot miss them
+	first, second := m, parent
+	if second.id < first.id {
+		first, second = second, first
+	}
+	first.mutex.RLock()
+	defer first.mutex.RUnlock()
+	if second != first {
+		second.mutex.RLock()
+		defer second.mutex.RUnlock()
+	}
+	if m.retired || parent.retired {
+		return ErrCacheDestroyed
+	}
+	if idx, ok := m.keyToIdx[key]; !ok || m.expired(m.getNodePtr(idx)) {
+		return ErrKeyNotFound
+	}
+	m.deps.link(depRef[U, K, V]{cache: m, key: key}, refs)
+	return nil
+}
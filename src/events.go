@@ -0,0 +1,153 @@
+package src
+
+import "slices"
+
+// EventKind identifies the change an Event describes
+type EventKind uint8
+
+const (
+	// EventSet stores Entry in Cache
+	EventSet EventKind = iota + 1
+	// EventDel removes Entry.Key from Cache
+	EventDel
+	// EventExpire removes Entry.Key from Cache because its TTL passed
+	EventExpire
+	// EventEvict removes Entry.Key from Cache to make room
+	EventEvict
+	// EventClear removes every entry from Cache
+	EventClear
+	// EventConfig sets Option to Setting on Cache
+	EventConfig
+	// EventCreate creates Cache with Capacity and Options, replacing any existing cache
+	EventCreate
+	// EventDestroy removes Cache from the manager
+	EventDestroy
+	// EventRename moves Cache to the title Target
+	EventRename
+)
+
+var eventNames = [...]string{
+	EventSet: "set", EventDel: "del", EventExpire: "expire", EventEvict: "evict", EventClear: "clear",
+	EventConfig: "config", EventCreate: "create", EventDestroy: "destroy", EventRename: "rename",
+}
+
+func (k EventKind) String() string {
+	if int(k) < len(eventNames) && eventNames[k] != "" {
+		return eventNames[k]
+	}
+	return "unknown"
+}
+
+// Entry is a copy of one cache entry
+type Entry[K Uints, V any] struct {
+	Key       K
+	Value     V
+	Tags      []string
+	ExpiresAt int64 // UnixNano, zero if the entry never expires
+	// Flags are kept with the value for the client that stored it, such as
+	// memcached's client flags; writes without flags reset them
+	Flags uint32
+}
+
+// Event describes one change to a cache or to the set of caches. Applying a
+// manager's events in order to another manager reproduces its contents.
+type Event[U, K Uints, V any] struct {
+	Kind  EventKind
+	Cache string
+	Entry[K, V]
+	Target   string
+	Capacity U
+	Options  CacheOptions
+	Option   string
+	Setting  string
+}
+
+type observer[U, K Uints, V any] struct {
+	fn func(Event[U, K, V])
+}
+
+// Observe calls fn for every change made to the manager's caches and returns a
+// function that stops the calls. fn runs synchronously while the changed cache
+// is locked, so events for one cache arrive in the order they happened; it must
+// not call back into the manager or modify Entry.Value.
+func (cm *CacheManager[U, K, V]) Observe(fn func(Event[U, K, V])) (cancel func()) {
+	obs := &observer[U, K, V]{fn: fn}
+	cm.observeMutex.Lock()
+	defer cm.observeMutex.Unlock()
+
+	list := []*observer[U, K, V]{obs}
+	if current := cm.observers.Load(); current != nil {
+		list = append(slices.Clone(*current), obs)
+	}
+	cm.observers.Store(&list)
+
+	return func() {
+		cm.observeMutex.Lock()
+		defer cm.observeMutex.Unlock()
+		current := cm.observers.Load()
+		if current == nil {
+			return
+		}
+		list := slices.DeleteFunc(slices.Clone(*current), func(o *observer[U, K, V]) bool { return o == obs })
+		if len(list) == 0 {
+			cm.observers.Store(nil)
+		} else {
+			cm.observers.Store(&list)
+		}
+	}
+}
+
+func (cm *CacheManager[U, K, V]) observed() bool {
+	return cm.observers.Load() != nil
+}
+
+func (cm *CacheManager[U, K, V]) emit(ev Event[U, K, V]) {
+	if list := cm.observers.Load(); list != nil {
+		for _, obs := range *list {
+			obs.fn(ev)
+		}
+	}
+}
+
+// emit reports a change to the owning manager while the write lock is held
+func (m *LRUMap[U, K, V]) emit(kind EventKind, key K) {
+	if m.owner == nil || !m.owner.observed() {
+		return
+	}
+	ev := Event[U, K, V]{Kind: kind, Cache: m.title}
+	ev.Key = key
+	m.owner.emit(ev)
+}
+
+// emitSet reports the entry stored at idx while the write lock is held
+func (m *LRUMap[U, K, V]) emitSet(idx U) {
+	if m.owner == nil || !m.owner.observed() {
+		return
+	}
+	m.owner.emit(Event[U, K, V]{Kind: EventSet, Cache: m.title, Entry: m.entryAt(idx)})
+}
+
+// emitContents reports a cache's creation followed by its live entries, oldest
+// first, for caches that join the manager already filled
+func (m *LRUMap[U, K, V]) emitContents() {
+	if m.owner == nil || !m.owner.observed() {
+		return
+	}
+	m.owner.emit(Event[U, K, V]{Kind: EventCreate, Cache: m.title, Capacity: m.capacity, Options: m.options})
+	for idx := m.tailIdx; idx != m.NoIdx; idx = m.nodes[idx].prevIdx {
+		if !m.expired(m.getNodePtr(idx)) {
+			m.emitSet(idx)
+		}
+	}
+}
+
+func (m *LRUMap[U, K, V]) entryAt(idx U) Entry[K, V] {
+	node := m.getNodePtr(idx)
+	return Entry[K, V]{
+		Key:       node.key,
+		Value:     node.value,
+		Tags:      slices.Clone(node.tags),
+		ExpiresAt: node.expiresAt,
+		Flags:     node.flags,
+	}
+}
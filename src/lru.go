@@ -1,7 +1,17 @@
 // Package src implements a fixed-size LRU (Least Recently Used) cache
 package src
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheIDs hands out the identifiers used to order locks across caches
+var cacheIDs atomic.Uint64
+
+// entryVersions hands out the versions that identify each stored value
+var entryVersions atomic.Uint64
 
 // InitLRUMap initializes a new LRU cache with given title and capacity
 func InitLRUMap[U, K Uints, V any](title string, capacity U) *LRUMap[U, K, V] {
@@ -10,10 +20,13 @@ func InitLRUMap[U, K Uints, V any](title string, capacity U) *LRUMap[U, K, V] {
 	}
 	m := &LRUMap[U, K, V]{
 		title:    title,
+		id:       cacheIDs.Add(1),
 		capacity: capacity,
 		nodes:    make([]Node[U, K, V], capacity),
 		keyToIdx: make(map[K]U, capacity),
+		tagIndex: make(map[string]map[K]struct{}),
 		freeList: make([]U, capacity),
+		deps:     newDepGraph[U, K, V](),
 		mutex:    sync.RWMutex{},
 		NoIdx:    ^U(0),
 		headIdx:  ^U(0),
@@ -109,75 +122,313 @@ func (m *LRUMap[U, K, V]) unlinkNode(node *Node[U, K, V]) {
 	}
 }
 
-// Public API methods
+func (m *LRUMap[U, K, V]) tagNode(node *Node[U, K, V], tags []string) {
+	node.tags = node.tags[:0]
+	for _, tag := range tags {
+		if tag == "" {
+			continue
+		}
+		keys, ok := m.tagIndex[tag]
+		if !ok {
+			keys = make(map[K]struct{})
+			m.tagIndex[tag] = keys
+		}
+		if _, dup := keys[node.key]; dup {
+			continue
+		}
+		keys[node.key] = struct{}{}
+		node.tags = append(node.tags, tag)
+	}
+}
 
-// Put adds or updates a key-value pair in the cache
-func (m *LRUMap[U, K, V]) Put(key K, value V) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+func (m *LRUMap[U, K, V]) untagNode(node *Node[U, K, V]) {
+	for _, tag := range node.tags {
+		if keys, ok := m.tagIndex[tag]; ok {
+			delete(keys, node.key)
+			if len(keys) == 0 {
+				delete(m.tagIndex, tag)
+			}
+		}
+	}
+	node.tags = nil
+}
 
-	if existingIdx, ok := m.keyToIdx[key]; ok {
-		m.nodes[existingIdx].value = value
-		m.setHead(existingIdx)
+// touch refreshes recency on access according to the eviction policy
+func (m *LRUMap[U, K, V]) touch(idx U) {
+	if m.options.policy() == PolicyLRU {
+		m.setHead(idx)
+	}
+}
+
+func (m *LRUMap[U, K, V]) expired(node *Node[U, K, V]) bool {
+	return node.expiresAt != 0 && node.expiresAt <= time.Now().UnixNano()
+}
+
+func (m *LRUMap[U, K, V]) setValue(node *Node[U, K, V], value V) {
+	size := sizeOf(value)
+	m.addWeight(int64(size) - int64(node.size))
+	node.value = value
+	node.size = size
+	node.version = entryVersions.Add(1)
+	node.expiresAt = 0
+	if m.options.DefaultTTL > 0 {
+		node.expiresAt = time.Now().Add(m.options.DefaultTTL).UnixNano()
+	}
+}
+
+// evictTail drops the least recently used entry and returns its slot
+func (m *LRUMap[U, K, V]) evictTail() (U, bool) {
+	tailIdx, ok := m.removeTail()
+	if !ok {
+		return m.NoIdx, false
+	}
+	m.forget(tailIdx)
+	return tailIdx, true
+}
+
+// evict drops the entry at idx, which may be anywhere in the list, to make room
+func (m *LRUMap[U, K, V]) evict(idx U) {
+	if idx == m.tailIdx {
+		m.evictTail()
 		return
 	}
+	node := m.getNodePtr(idx)
+	if idx == m.headIdx {
+		m.headIdx = node.nextIdx
+	}
+	m.unlinkNode(node)
+	node.prevIdx = m.NoIdx
+	node.nextIdx = m.NoIdx
+	m.forget(idx)
+}
+
+// forget drops the bookkeeping of an evicted entry once it left the list
+func (m *LRUMap[U, K, V]) forget(idx U) {
+	node := m.getNodePtr(idx)
+	m.untagNode(node)
+	delete(m.keyToIdx, node.key)
+	m.addWeight(-int64(node.size))
+	m.markEvicted(node.key)
+	m.emit(EventEvict, node.key)
+	m.touchWatches(node.key)
+}
+
+// enforceWeight evicts the oldest entries until the weight limit holds. It
+// never evicts keep: under FIFO an updated entry stays where it was, so it may
+// be the tail while the entries before it are evicted.
+func (m *LRUMap[U, K, V]) enforceWeight(keep U) {
+	limit := m.options.WeightLimit
+	for limit > 0 && m.weight > limit {
+		idx := m.tailIdx
+		if idx == keep && idx != m.NoIdx {
+			idx = m.nodes[keep].prevIdx
+		}
+		if idx == m.NoIdx {
+			return
+		}
+		m.evict(idx)
+		m.nodes[idx] = m.newNode(K(0), *new(V))
+		m.freeList = append(m.freeList, idx)
+	}
+}
+
+// put inserts or updates a key while the write lock is held and returns its slot
+func (m *LRUMap[U, K, V]) put(key K, value V, tags []string) U {
+	if existingIdx, ok := m.keyToIdx[key]; ok {
+		node := m.getNodePtr(existingIdx)
+		m.untagNode(node)
+		m.setValue(node, value)
+		node.flags = 0
+		m.tagNode(node, tags)
+		m.touch(existingIdx)
+		m.markStale(key, false)
+		m.enforceWeight(existingIdx)
+		m.wake(key)
+		m.touchWatches(key)
+		return existingIdx
+	}
 
 	idx, ok := m.getFreeIndex()
 	if !ok {
-		if tailIdx, ok := m.removeTail(); ok {
-			delete(m.keyToIdx, m.nodes[tailIdx].key)
-			idx = tailIdx
-		}
+		idx, _ = m.evictTail()
 	}
 
-	m.nodes[idx] = m.newNode(key, value)
+	m.nodes[idx] = m.newNode(key, *new(V))
+	node := m.getNodePtr(idx)
+	m.setValue(node, value)
 	m.keyToIdx[key] = idx
+	m.tagNode(node, tags)
 	m.setHead(idx)
+	m.markStale(key, false)
+	m.enforceWeight(idx)
+	m.wake(key)
+	m.touchWatches(key)
+	return idx
+}
+
+// restore inserts an entry copied from another cache, keeping its expiry
+// and flags
+func (m *LRUMap[U, K, V]) restore(entry Entry[K, V]) {
+	idx := m.put(entry.Key, entry.Value, entry.Tags)
+	node := m.getNodePtr(idx)
+	node.expiresAt, node.flags = entry.ExpiresAt, entry.Flags
+	m.emitSet(idx)
+}
+
+// lookup finds a live entry, lazily removing it if its TTL has passed
+func (m *LRUMap[U, K, V]) lookup(key K) (U, bool) {
+	idx, ok := m.keyToIdx[key]
+	if !ok {
+		return m.NoIdx, false
+	}
+	if m.expired(m.getNodePtr(idx)) {
+		m.eject(key, EventExpire)
+		return m.NoIdx, false
+	}
+	return idx, true
+}
+
+// eject removes a key while the write lock is held, reporting reason to observers
+func (m *LRUMap[U, K, V]) eject(key K, reason EventKind) bool {
+	idx, ok := m.keyToIdx[key]
+	if !ok {
+		return false
+	}
+	node := m.getNodePtr(idx)
+	if idx == m.headIdx {
+		m.headIdx = node.nextIdx
+	}
+	if idx == m.tailIdx {
+		m.tailIdx = node.prevIdx
+	}
+	m.unlinkNode(node)
+	m.untagNode(node)
+	m.removeNode(node)
+	m.addWeight(-int64(node.size))
+	node.size = 0
+	m.freeList = append(m.freeList, idx)
+	m.markStale(key, true)
+	m.emit(reason, key)
+	m.touchWatches(key)
+	return true
+}
+
+// Public API methods
+
+// Put adds or updates a key-value pair in the cache, dropping any tags it had
+func (m *LRUMap[U, K, V]) Put(key K, value V) {
+	m.mutex.Lock()
+	defer m.unlock()
+	m.markUsed()
+	m.emitSet(m.put(key, value, nil))
+}
+
+// PutTagged adds or updates a key-value pair and replaces its tags
+func (m *LRUMap[U, K, V]) PutTagged(key K, value V, tags ...string) {
+	m.mutex.Lock()
+	defer m.unlock()
+	m.markUsed()
+	m.emitSet(m.put(key, value, tags))
+}
+
+// Restore stores a copied entry as-is, keeping its tags, flags and absolute
+// expiry instead of applying the cache's default TTL
+func (m *LRUMap[U, K, V]) Restore(entry Entry[K, V]) {
+	m.mutex.Lock()
+	defer m.unlock()
+	m.markUsed()
+	m.restore(entry)
 }
 
 // Get retrieves a value from the cache by key
 func (m *LRUMap[U, K, V]) Get(key K) V {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	defer m.unlock()
+	value, _ := m.get(key)
+	return value
+}
 
-	if idx, ok := m.keyToIdx[key]; ok {
-		m.setHead(idx)
-		return m.getNodePtr(idx).value
+// Contains reports whether key holds a live entry, without marking it used
+func (m *LRUMap[U, K, V]) Contains(key K) bool {
+	m.mutex.Lock()
+	defer m.unlock()
+	_, ok := m.lookup(key)
+	return ok
+}
+
+// get reads a live entry and marks it recently used while the write lock is held
+func (m *LRUMap[U, K, V]) get(key K) (V, bool) {
+	m.markUsed()
+	if idx, ok := m.lookup(key); ok {
+		m.touch(idx)
+		return m.getNodePtr(idx).value, true
 	}
 	var zero V
-	return zero
+	return zero, false
 }
 
-// Eject removes a key-value pair from the cache
-func (m *LRUMap[U, K, V]) Eject(key K) {
+// Eject removes a key-value pair from the cache and reports whether it existed
+func (m *LRUMap[U, K, V]) Eject(key K) bool {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	defer m.unlock()
+	return m.eject(key, EventDel)
+}
 
-	if idx, ok := m.keyToIdx[key]; ok {
-		node := m.getNodePtr(idx)
-		if idx == m.headIdx {
-			m.headIdx = node.nextIdx
-		}
-		if idx == m.tailIdx {
-			m.tailIdx = node.prevIdx
+// InvalidateTag removes every entry carrying tag and returns how many were removed
+func (m *LRUMap[U, K, V]) InvalidateTag(tag string) int {
+	m.mutex.Lock()
+	defer m.unlock()
+	return m.invalidateTag(tag)
+}
+
+// invalidateTag removes the entries carrying tag while the write lock is held
+func (m *LRUMap[U, K, V]) invalidateTag(tag string) int {
+	keys := m.tagIndex[tag]
+	removed := 0
+	for key := range keys {
+		if m.eject(key, EventDel) {
+			removed++
 		}
-		m.unlinkNode(node)
-		m.removeNode(node)
-		m.freeList = append(m.freeList, idx)
 	}
+	delete(m.tagIndex, tag)
+	return removed
+}
+
+// Tags returns the tags attached to key, or nil if the key is absent
+func (m *LRUMap[U, K, V]) Tags(key K) []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if idx, ok := m.keyToIdx[key]; ok {
+		return append([]string(nil), m.nodes[idx].tags...)
+	}
+	return nil
 }
 
-// GetNode retrieves a node from the cache by key
+// GetNode retrieves a snapshot of a node from the cache by key
 func (m *LRUMap[U, K, V]) GetNode(key K) *Node[U, K, V] {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	if idx, ok := m.keyToIdx[key]; ok {
-		m.setHead(idx)
-		return m.getNodePtr(idx)
+	defer m.unlock()
+	m.markUsed()
+	if idx, ok := m.lookup(key); ok {
+		m.touch(idx)
+		node := *m.getNodePtr(idx)
+		return &node
 	}
 	return nil
 }
 
+// Title returns the name the cache is registered under
+func (m *LRUMap[U, K, V]) Title() string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.title
+}
+
+// Capacity returns the maximum number of entries the cache holds
+func (m *LRUMap[U, K, V]) Capacity() U {
+	return m.capacity
+}
+
 // Length returns the current number of items in the cache
 func (m *LRUMap[U, K, V]) Length() U {
 	m.mutex.RLock()
@@ -185,30 +436,49 @@ func (m *LRUMap[U, K, V]) Length() U {
 	return U(len(m.keyToIdx))
 }
 
+// Release drops a reference obtained from CacheManager.GetCache. Once a
+// destroyed cache loses its last reference its contents are cleared.
+func (m *LRUMap[U, K, V]) Release() {
+	if m.refs.Add(-1) == 0 {
+		m.Clear()
+	}
+}
+
 // Clear removes all items from the cache
 func (m *LRUMap[U, K, V]) Clear() {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	defer m.unlock()
+	m.clear()
+}
 
+// clear removes all items while the write lock is held
+func (m *LRUMap[U, K, V]) clear() {
 	for i := range m.nodes {
 		m.nodes[i] = m.newNode(K(0), *new(V))
 	}
+	m.freeList = m.freeList[:len(m.nodes)]
 	for i := range m.freeList {
 		m.freeList[i] = U(i)
 	}
 	for k := range m.keyToIdx {
 		delete(m.keyToIdx, k)
 	}
+	clear(m.tagIndex)
+	m.addWeight(-int64(m.weight))
 	m.headIdx = m.NoIdx
 	m.tailIdx = m.NoIdx
+	m.cleared = !m.deps.empty()
+	m.emit(EventClear, K(0))
+	m.wakeAll(ErrCacheCleared)
+	m.touchAllWatches()
 }
 
-// Iterator returns a slice of nodes in order (or reverse order)
+// Iterator returns snapshots of the nodes in order (or reverse order)
 func (m *LRUMap[U, K, V]) Iterator(rev bool) []*Node[U, K, V] {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
-	nodes := make([]*Node[U, K, V], 0, m.Length())
+	nodes := make([]*Node[U, K, V], 0, len(m.keyToIdx))
 	if len(m.keyToIdx) == 0 || m.headIdx == m.NoIdx {
 		return nodes
 	}
@@ -220,7 +490,9 @@ func (m *LRUMap[U, K, V]) Iterator(rev bool) []*Node[U, K, V] {
 		curr = m.headIdx
 	}
 	for curr != m.NoIdx {
-		nodes = append(nodes, m.getNodePtr(curr))
+		if node := *m.getNodePtr(curr); !m.expired(&node) {
+			nodes = append(nodes, &node)
+		}
 		if rev {
 			curr = m.nodes[curr].prevIdx
 		} else {
@@ -0,0 +1,210 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"unsafe"
+)
+
+var ErrMemoryLimit = errors.New("memory limit exceeded")
+
+// MemoryStrategy picks which cache gives up entries when the manager is over its memory limit
+type MemoryStrategy string
+
+const (
+	// MemoryEvictLRU evicts from the cache that was used least recently
+	MemoryEvictLRU MemoryStrategy = "lru"
+	// MemoryEvictLargest evicts from the cache with the largest footprint
+	MemoryEvictLargest MemoryStrategy = "largest"
+)
+
+// ParseMemoryStrategy validates a strategy name
+func ParseMemoryStrategy(name string) (MemoryStrategy, error) {
+	switch s := MemoryStrategy(name); s {
+	case MemoryEvictLRU, MemoryEvictLargest:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid memory strategy: %s", name)
+}
+
+// CacheMemory reports one cache's share of the manager's memory
+type CacheMemory struct {
+	Title string
+	Bytes uint64
+	Share float64
+}
+
+// MemoryStats is a snapshot of the manager's memory accounting
+type MemoryStats struct {
+	Used     uint64
+	Limit    uint64
+	Strategy MemoryStrategy
+	Caches   []CacheMemory
+}
+
+// nodeBytes is the fixed cost of one slot: its node plus its free list entry
+func nodeBytes[U, K Uints, V any]() uint64 {
+	var node Node[U, K, V]
+	var idx U
+	return uint64(unsafe.Sizeof(node) + unsafe.Sizeof(idx))
+}
+
+// addWeight adjusts the value bytes held by the cache while the write lock is held
+func (m *LRUMap[U, K, V]) addWeight(delta int64) {
+	m.weight = uint64(int64(m.weight) + delta)
+	if m.owner != nil {
+		m.owner.memory.used.Add(delta)
+	}
+}
+
+// footprint approximates the bytes held by the node array and values while a lock is held
+func (m *LRUMap[U, K, V]) footprint() uint64 {
+	return uint64(len(m.nodes))*nodeBytes[U, K, V]() + m.weight
+}
+
+// Footprint approximates the bytes held by the cache's node array and values
+func (m *LRUMap[U, K, V]) Footprint() uint64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.footprint()
+}
+
+// markUsed records an access for the manager's least-recently-used cache strategy
+func (m *LRUMap[U, K, V]) markUsed() {
+	if m.owner != nil {
+		m.lastUse.Store(m.owner.memory.clock.Add(1))
+	}
+}
+
+// evictOldest drops the cache's tail entry and reports whether one existed
+func (m *LRUMap[U, K, V]) evictOldest() bool {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	idx, ok := m.evictTail()
+	if !ok {
+		return false
+	}
+	m.nodes[idx] = m.newNode(K(0), *new(V))
+	m.freeList = append(m.freeList, idx)
+	return true
+}
+
+// attach starts accounting a cache's memory against the manager's budget
+func (cm *CacheManager[U, K, V]) attach(cache *LRUMap[U, K, V]) {
+	cache.mutex.Lock()
+	cache.owner = cm
+	cm.memory.used.Add(int64(cache.footprint()))
+	cache.lastUse.Store(cm.memory.clock.Add(1))
+	cache.mutex.Unlock()
+}
+
+// detach stops accounting a cache that has left the manager, releases the
+// callers waiting on it, fails the transactions watching it and drops its
+// dependency edges
+func (cm *CacheManager[U, K, V]) detach(cache *LRUMap[U, K, V]) {
+	cache.mutex.Lock()
+	cache.owner = nil
+	cm.memory.used.Add(-int64(cache.footprint()))
+	cache.retired = true
+	cache.wakeAll(ErrCacheDestroyed)
+	cache.touchAllWatches()
+	cache.mutex.Unlock()
+	cache.invalidateAll()
+}
+
+// admit checks that a new cache of the given capacity fits in the budget once
+// freed bytes are returned. It is called with the manager lock held.
+func (cm *CacheManager[U, K, V]) admit(capacity U, freed uint64) error {
+	limit := cm.memory.limit.Load()
+	if limit == 0 {
+		return nil
+	}
+	need := uint64(capacity) * nodeBytes[U, K, V]()
+	used := uint64(cm.memory.used.Load()) - freed
+	if used+need > limit {
+		return fmt.Errorf("%w: cache needs %d bytes, %d of %d in use", ErrMemoryLimit, need, used, limit)
+	}
+	return nil
+}
+
+// SetMemoryLimit caps the approximate bytes held by all caches; zero disables the cap.
+// Entries are evicted right away if the manager is already over the new limit.
+func (cm *CacheManager[U, K, V]) SetMemoryLimit(limit uint64, strategy MemoryStrategy) {
+	cm.memory.limit.Store(limit)
+	cm.memory.strategy.Store(strategy)
+	cm.reclaim()
+}
+
+func (cm *CacheManager[U, K, V]) overBudget() bool {
+	limit := cm.memory.limit.Load()
+	return limit > 0 && cm.memory.used.Load() > int64(limit)
+}
+
+// relieve is called after every cache write lock is released
+func (cm *CacheManager[U, K, V]) relieve() {
+	if cm.overBudget() {
+		cm.reclaim()
+	}
+}
+
+// reclaim evicts entries, one at a time from the cache chosen by the strategy,
+// until usage is back under the limit or no cache has anything left to evict
+func (cm *CacheManager[U, K, V]) reclaim() {
+	if !cm.memory.reclaiming.CompareAndSwap(false, true) {
+		return
+	}
+	defer cm.memory.reclaiming.Store(false)
+
+	strategy, _ := cm.memory.strategy.Load().(MemoryStrategy)
+	for cm.overBudget() {
+		caches := cm.acquireAll()
+		if strategy == MemoryEvictLargest {
+			sizes := make(map[*LRUMap[U, K, V]]uint64, len(caches))
+			for _, cache := range caches {
+				sizes[cache] = cache.Footprint()
+			}
+			slices.SortFunc(caches, func(a, b *LRUMap[U, K, V]) int {
+				return int(int64(sizes[b]) - int64(sizes[a]))
+			})
+		} else {
+			slices.SortFunc(caches, func(a, b *LRUMap[U, K, V]) int {
+				return int(int64(a.lastUse.Load()) - int64(b.lastUse.Load()))
+			})
+		}
+
+		evicted := false
+		for _, cache := range caches {
+			if !evicted && cache.evictOldest() {
+				evicted = true
+			}
+			cache.Release()
+		}
+		if !evicted {
+			return
+		}
+	}
+}
+
+// MemoryStats reports the manager's usage, limit and each cache's share
+func (cm *CacheManager[U, K, V]) MemoryStats() MemoryStats {
+	strategy, _ := cm.memory.strategy.Load().(MemoryStrategy)
+	stats := MemoryStats{
+		Used:     uint64(cm.memory.used.Load()),
+		Limit:    cm.memory.limit.Load(),
+		Strategy: strategy,
+	}
+	for _, cache := range cm.acquireAll() {
+		usage := CacheMemory{Title: cache.Title(), Bytes: cache.Footprint()}
+		if stats.Used > 0 {
+			usage.Share = float64(usage.Bytes) / float64(stats.Used)
+		}
+		stats.Caches = append(stats.Caches, usage)
+		cache.Release()
+	}
+	slices.SortFunc(stats.Caches, func(a, b CacheMemory) int {
+		return int(int64(b.Bytes) - int64(a.Bytes))
+	})
+	return stats
+}
@@ -1,46 +1,343 @@
 package src
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrCacheExists   = errors.New("cache already exists")
+	ErrCacheNotFound = errors.New("cache not found")
+	ErrKeyNotFound   = errors.New("key not found")
+	ErrSameCache     = errors.New("source and destination are the same cache")
+)
 
 func NewCacheManager[U, K Uints, V any]() *CacheManager[U, K, V] {
-	return &CacheManager[U, K, V]{
-		caches: make(map[K]*LRUMap[U, K, V]),
+	cm := &CacheManager[U, K, V]{
+		caches: make(map[string]*LRUMap[U, K, V]),
+		deps:   newDepGraph[U, K, V](),
 	}
+	cm.memory.strategy.Store(MemoryEvictLRU)
+	return cm
 }
 
-func (cm *CacheManager[U, K, V]) CreateCache(title string, key K, capacity U) {
+func (cm *CacheManager[U, K, V]) newCache(title string, capacity U, opts CacheOptions) *LRUMap[U, K, V] {
 	var cache *LRUMap[U, K, V] = InitLRUMap[U, K, V](title, capacity)
-	cm.caches[key] = cache
+	cache.options = opts
+	cache.deps = cm.deps
+	cache.refs.Store(1) // the manager's own reference
+	return cache
+}
+
+// CreateCache adds a new cache, failing with ErrCacheExists if the title is taken
+// or ErrMemoryLimit if the cache would not fit in the manager's memory budget
+func (cm *CacheManager[U, K, V]) CreateCache(title string, capacity U, opts CacheOptions) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if _, exists := cm.caches[title]; exists {
+		return ErrCacheExists
+	}
+	if err := cm.admit(capacity, 0); err != nil {
+		return err
+	}
+	cache := cm.newCache(title, capacity, opts)
+	cm.attach(cache)
+	cm.caches[title] = cache
+	cm.emit(Event[U, K, V]{Kind: EventCreate, Cache: title, Capacity: capacity, Options: opts})
+	return nil
+}
+
+// ReplaceCache adds a new cache, discarding any cache previously stored under title
+func (cm *CacheManager[U, K, V]) ReplaceCache(title string, capacity U, opts CacheOptions) error {
+	cm.mutex.Lock()
+	old := cm.caches[title]
+	var freed uint64
+	if old != nil {
+		freed = old.Footprint()
+	}
+	if err := cm.admit(capacity, freed); err != nil {
+		cm.mutex.Unlock()
+		return err
+	}
+	cache := cm.newCache(title, capacity, opts)
+	cm.attach(cache)
+	cm.caches[title] = cache
+	cm.emit(Event[U, K, V]{Kind: EventCreate, Cache: title, Capacity: capacity, Options: opts})
+	cm.mutex.Unlock()
+
+	if old != nil {
+		cm.detach(old)
+		old.Release()
+	}
+	return nil
+}
+
+// CreateIfAbsent returns the cache stored under title, creating it first if needed.
+// The returned cache holds a reference that must be released with Release.
+func (cm *CacheManager[U, K, V]) CreateIfAbsent(title string, capacity U, opts CacheOptions) (*LRUMap[U, K, V], bool, error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if cache, exists := cm.caches[title]; exists {
+		cache.refs.Add(1)
+		return cache, false, nil
+	}
+	if err := cm.admit(capacity, 0); err != nil {
+		return nil, false, err
+	}
+	cache := cm.newCache(title, capacity, opts)
+	cm.attach(cache)
+	cache.refs.Add(1)
+	cm.caches[title] = cache
+	cm.emit(Event[U, K, V]{Kind: EventCreate, Cache: title, Capacity: capacity, Options: opts})
+	return cache, true, nil
 }
 
-func (cm *CacheManager[U, K, V]) GetCache(name K) *LRUMap[U, K, V] {
-	if cache, exists := cm.caches[name]; exists {
+// GetCache returns the cache stored under title, or nil. The returned cache stays
+// usable even if it is destroyed concurrently; callers release it with Release.
+func (cm *CacheManager[U, K, V]) GetCache(title string) *LRUMap[U, K, V] {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	if cache, exists := cm.caches[title]; exists {
+		cache.refs.Add(1)
 		return cache
 	}
 	return nil
 }
 
-func (cm *CacheManager[U, K, V]) DestroyCache(name K) {
-	if cache, exists := cm.caches[name]; exists {
-		cache.Clear()
-		delete(cm.caches, name)
+// DestroyCache removes a cache, failing with ErrCacheNotFound if it does not exist.
+// Its contents are cleared once the last outstanding reference is released.
+func (cm *CacheManager[U, K, V]) DestroyCache(title string) error {
+	cm.mutex.Lock()
+	cache, exists := cm.caches[title]
+	delete(cm.caches, title)
+	if exists {
+		cm.emit(Event[U, K, V]{Kind: EventDestroy, Cache: title})
+	}
+	cm.mutex.Unlock()
+
+	if !exists {
+		return ErrCacheNotFound
+	}
+	cm.detach(cache)
+	cache.Release()
+	return nil
+}
+
+// DependsOn declares that key in cache is derived from parents in parentCache,
+// which may be the same cache
+func (cm *CacheManager[U, K, V]) DependsOn(cache string, key K, parentCache string, parents ...K) error {
+	child := cm.GetCache(cache)
+	if child == nil {
+		return fmt.Errorf("%w: %s", ErrCacheNotFound, cache)
+	}
+	defer child.Release()
+	parent := cm.GetCache(parentCache)
+	if parent == nil {
+		return fmt.Errorf("%w: %s", ErrCacheNotFound, parentCache)
+	}
+	defer parent.Release()
+	return child.DependsOnIn(key, parent, parents...)
+}
+
+// RenameCache moves a cache to a new title, failing if the new title is taken
+func (cm *CacheManager[U, K, V]) RenameCache(oldTitle, newTitle string) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	cache, exists := cm.caches[oldTitle]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrCacheNotFound, oldTitle)
+	}
+	if oldTitle == newTitle {
+		return nil
+	}
+	if _, taken := cm.caches[newTitle]; taken {
+		return fmt.Errorf("%w: %s", ErrCacheExists, newTitle)
+	}
+	delete(cm.caches, oldTitle)
+	cm.caches[newTitle] = cache
+
+	cache.mutex.Lock()
+	cache.title = newTitle
+	cm.emit(Event[U, K, V]{Kind: EventRename, Cache: oldTitle, Target: newTitle})
+	cache.mutex.Unlock()
+	return nil
+}
+
+// CopyCache deep-copies a cache under a new title, keeping its options and
+// recency order. A zero capacity keeps the source capacity; a smaller one keeps
+// only the most recently used entries.
+func (cm *CacheManager[U, K, V]) CopyCache(srcTitle, dstTitle string, capacity U) error {
+	source := cm.GetCache(srcTitle)
+	if source == nil {
+		return fmt.Errorf("%w: %s", ErrCacheNotFound, srcTitle)
+	}
+	defer source.Release()
+	if srcTitle == dstTitle {
+		return ErrSameCache
+	}
+	if capacity == 0 {
+		capacity = source.capacity
+	}
+
+	source.mutex.RLock()
+	copied := cm.newCache(dstTitle, capacity, source.options)
+	copied.mutex.Lock()
+	for idx := source.tailIdx; idx != source.NoIdx; idx = source.nodes[idx].prevIdx {
+		node := source.getNodePtr(idx)
+		if source.expired(node) {
+			continue
+		}
+		entry := source.entryAt(idx)
+		entry.Value = cloneValue(entry.Value)
+		copied.restore(entry)
+	}
+	copied.unlock()
+	source.mutex.RUnlock()
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	if _, taken := cm.caches[dstTitle]; taken {
+		return fmt.Errorf("%w: %s", ErrCacheExists, dstTitle)
+	}
+	if limit := cm.memory.limit.Load(); limit > 0 && uint64(cm.memory.used.Load())+copied.Footprint() > limit {
+		return fmt.Errorf("%w: copy needs %d bytes", ErrMemoryLimit, copied.Footprint())
+	}
+	cm.attach(copied)
+	cm.caches[dstTitle] = copied
+	copied.mutex.RLock()
+	copied.emitContents()
+	copied.mutex.RUnlock()
+	return nil
+}
+
+// MoveKey atomically moves key from one cache to another, keeping its tags and expiry.
+// keySize is the length of the key before hashing, checked against the target's
+// max_key_size. Both caches are locked in id order so concurrent moves cannot
+// deadlock, and the move fails with ErrReadOnly if either cache is read-only.
+func (cm *CacheManager[U, K, V]) MoveKey(srcTitle, dstTitle string, key K, keySize int) error {
+	source := cm.GetCache(srcTitle)
+	if source == nil {
+		return fmt.Errorf("%w: %s", ErrCacheNotFound, srcTitle)
+	}
+	defer source.Release()
+	target := cm.GetCache(dstTitle)
+	if target == nil {
+		return fmt.Errorf("%w: %s", ErrCacheNotFound, dstTitle)
+	}
+	defer target.Release()
+	if source == target {
+		return ErrSameCache
+	}
+
+	first, second := source, target
+	if second.id < first.id {
+		first, second = second, first
+	}
+	first.mutex.Lock()
+	second.mutex.Lock()
+	err := moveKey(source, target, key, keySize)
+
+	// Release both locks before settling, as a cascade may lock either cache
+	work := []pendingWork[U, K, V]{first.release(), second.release()}
+	for _, w := range work {
+		w.settle()
 	}
+	return err
+}
+
+// moveKey runs MoveKey while both write locks are held
+func moveKey[U, K Uints, V any](source, target *LRUMap[U, K, V], key K, keySize int) error {
+	for _, cache := range []*LRUMap[U, K, V]{source, target} {
+		if cache.options.ReadOnly {
+			return fmt.Errorf("%w: %s", ErrReadOnly, cache.title)
+		}
+	}
+	idx, ok := source.lookup(key)
+	if !ok {
+		return ErrKeyNotFound
+	}
+	entry, size := source.entryAt(idx), source.getNodePtr(idx).size
+	if err := target.checkWrite(keySize, size); err != nil {
+		return fmt.Errorf("%w: %s", err, target.title)
+	}
+	source.eject(key, EventDel)
+	target.restore(entry)
+	return nil
 }
 
 func (cm *CacheManager[U, K, V]) ClearAllCaches() {
-	for name := range cm.caches {
-		cm.DestroyCache(name)
+	cm.mutex.Lock()
+	caches := make([]*LRUMap[U, K, V], 0, len(cm.caches))
+	for title, cache := range cm.caches {
+		caches = append(caches, cache)
+		delete(cm.caches, title)
+		cm.emit(Event[U, K, V]{Kind: EventDestroy, Cache: title})
+	}
+	cm.mutex.Unlock()
+
+	for _, cache := range caches {
+		cm.detach(cache)
+		cache.Release()
 	}
 }
 
+// acquireAll returns a referenced snapshot of every cache
+func (cm *CacheManager[U, K, V]) acquireAll() []*LRUMap[U, K, V] {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	caches := make([]*LRUMap[U, K, V], 0, len(cm.caches))
+	for _, cache := range cm.caches {
+		cache.refs.Add(1)
+		caches = append(caches, cache)
+	}
+	return caches
+}
+
 func (cm *CacheManager[U, K, V]) ListCaches() []string {
-	var names []string = make([]string, 0, len(cm.caches))
-	for m := range cm.caches {
-		cache := cm.caches[m]
-		names = append(names, cache.title)
+	caches := cm.acquireAll()
+	var names []string = make([]string, 0, len(caches))
+	for _, cache := range caches {
+		names = append(names, cache.Describe())
 		for _, node := range cache.Iterator(false) {
 			names = append(names, fmt.Sprintf("Key: %d, Value: %v", node.key, node.value))
 		}
+		cache.Release()
 	}
 	return names
 }
+
+// CacheStats describes one cache for listings
+type CacheStats struct {
+	Title    string
+	Capacity uint64
+	Length   uint64
+	Bytes    uint64
+	Options  CacheOptions
+}
+
+// Stats describes every cache, sorted by title
+func (cm *CacheManager[U, K, V]) Stats() []CacheStats {
+	caches := cm.acquireAll()
+	stats := make([]CacheStats, 0, len(caches))
+	for _, cache := range caches {
+		cache.mutex.RLock()
+		stats = append(stats, CacheStats{
+			Title:    cache.title,
+			Capacity: uint64(cache.capacity),
+			Length:   uint64(len(cache.keyToIdx)),
+			Bytes:    cache.footprint(),
+			Options:  cache.options,
+		})
+		cache.mutex.RUnlock()
+		cache.Release()
+	}
+	slices.SortFunc(stats, func(a, b CacheStats) int { return strings.Compare(a.Title, b.Title) })
+	return stats
+}
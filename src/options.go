@@ -0,0 +1,241 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+var (
+	ErrReadOnly        = errors.New("cache is read-only")
+	ErrKeyTooLarge     = errors.New("key exceeds max_key_size")
+	ErrValueTooLarge   = errors.New("value exceeds max_value_size")
+	ErrUnknownOption   = errors.New("unknown option")
+	ErrOptionImmutable = errors.New("option cannot be changed at runtime")
+)
+
+// EvictionPolicy decides which entry is dropped when a cache is full
+type EvictionPolicy string
+
+const (
+	// PolicyLRU evicts the least recently used entry; reads and updates refresh recency
+	PolicyLRU EvictionPolicy = "lru"
+	// PolicyFIFO evicts the oldest inserted entry; reads and updates keep insertion order
+	PolicyFIFO EvictionPolicy = "fifo"
+)
+
+// CacheOptions configures a cache beyond its capacity. Zero values mean
+// "no limit" and, for Policy, PolicyLRU.
+type CacheOptions struct {
+	Policy       EvictionPolicy
+	DefaultTTL   time.Duration
+	MaxValueSize int
+	MaxKeySize   int
+	ReadOnly     bool
+	WeightLimit  uint64
+	Description  string
+}
+
+// optionNames lists every option in the order String and LIST report them
+var optionNames = []string{
+	"policy", "ttl", "max_value_size", "max_key_size", "readonly", "weight_limit", "description",
+}
+
+// Set parses value into the option called name
+func (o *CacheOptions) Set(name, value string) error {
+	var err error
+	switch strings.ToLower(name) {
+	case "policy":
+		switch p := EvictionPolicy(strings.ToLower(value)); p {
+		case PolicyLRU, PolicyFIFO:
+			o.Policy = p
+		default:
+			return fmt.Errorf("invalid policy: %s", value)
+		}
+	case "ttl":
+		var ttl time.Duration
+		if ttl, err = parseTTL(value); err == nil {
+			o.DefaultTTL = ttl
+		}
+	case "max_value_size":
+		o.MaxValueSize, err = strconv.Atoi(value)
+	case "max_key_size":
+		o.MaxKeySize, err = strconv.Atoi(value)
+	case "readonly":
+		o.ReadOnly, err = strconv.ParseBool(value)
+	case "weight_limit":
+		o.WeightLimit, err = strconv.ParseUint(value, 10, 64)
+	case "description":
+		o.Description = value
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownOption, name)
+	}
+	if err != nil || o.MaxValueSize < 0 || o.MaxKeySize < 0 {
+		return fmt.Errorf("invalid value for %s: %s", name, value)
+	}
+	return nil
+}
+
+// Get formats the option called name
+func (o CacheOptions) Get(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "policy":
+		return string(o.policy()), nil
+	case "ttl":
+		return o.DefaultTTL.String(), nil
+	case "max_value_size":
+		return strconv.Itoa(o.MaxValueSize), nil
+	case "max_key_size":
+		return strconv.Itoa(o.MaxKeySize), nil
+	case "readonly":
+		return strconv.FormatBool(o.ReadOnly), nil
+	case "weight_limit":
+		return strconv.FormatUint(o.WeightLimit, 10), nil
+	case "description":
+		return o.Description, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownOption, name)
+}
+
+// Values returns every option by name, rendered as Get does
+func (o CacheOptions) Values() map[string]string {
+	values := make(map[string]string, len(optionNames))
+	for _, name := range optionNames {
+		values[name], _ = o.Get(name)
+	}
+	return values
+}
+
+// String renders every option as space separated key=value pairs
+func (o CacheOptions) String() string {
+	parts := make([]string, len(optionNames))
+	for i, name := range optionNames {
+		value, _ := o.Get(name)
+		parts[i] = name + "=" + value
+	}
+	return strings.Join(parts, " ")
+}
+
+func (o CacheOptions) policy() EvictionPolicy {
+	if o.Policy == "" {
+		return PolicyLRU
+	}
+	return o.Policy
+}
+
+// parseTTL accepts Go durations ("1m30s") or a plain number of seconds
+func parseTTL(value string) (time.Duration, error) {
+	if secs, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err == nil && ttl < 0 {
+		err = fmt.Errorf("negative ttl")
+	}
+	return ttl, err
+}
+
+// sizeOf approximates the number of bytes held by a value
+func sizeOf[V any](v V) int {
+	switch x := any(v).(type) {
+	case nil:
+		return 0
+	case []byte:
+		return len(x)
+	case string:
+		return len(x)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		return rv.Len() * int(rv.Type().Elem().Size())
+	case reflect.String:
+		return rv.Len()
+	}
+	return int(unsafe.Sizeof(v))
+}
+
+// cloneValue deep-copies slice values so copies never share backing arrays
+func cloneValue[V any](v V) V {
+	if b, ok := any(v).([]byte); ok {
+		return any(append([]byte(nil), b...)).(V)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice || rv.IsNil() {
+		return v
+	}
+	cp := reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+	reflect.Copy(cp, rv)
+	return cp.Interface().(V)
+}
+
+// Options returns the cache's current options
+func (m *LRUMap[U, K, V]) Options() CacheOptions {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.options
+}
+
+// Option formats a single option; "capacity" is reported alongside the CacheOptions fields
+func (m *LRUMap[U, K, V]) Option(name string) (string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if strings.EqualFold(name, "capacity") {
+		return strconv.FormatUint(uint64(m.capacity), 10), nil
+	}
+	return m.options.Get(name)
+}
+
+// SetOption changes an option at runtime. Lowering weight_limit evicts
+// entries until the cache fits again.
+func (m *LRUMap[U, K, V]) SetOption(name, value string) error {
+	if strings.EqualFold(name, "capacity") {
+		return fmt.Errorf("%w: %s", ErrOptionImmutable, name)
+	}
+	m.mutex.Lock()
+	defer m.unlock()
+
+	opts := m.options
+	if err := opts.Set(name, value); err != nil {
+		return err
+	}
+	m.options = opts
+	if m.owner != nil && m.owner.observed() {
+		m.owner.emit(Event[U, K, V]{Kind: EventConfig, Cache: m.title, Option: strings.ToLower(name), Setting: value})
+	}
+	m.enforceWeight(m.NoIdx)
+	return nil
+}
+
+// CheckWrite reports whether a write of the given key and value sizes is allowed
+func (m *LRUMap[U, K, V]) CheckWrite(keySize, valueSize int) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.checkWrite(keySize, valueSize)
+}
+
+// checkWrite runs CheckWrite while the lock is held
+func (m *LRUMap[U, K, V]) checkWrite(keySize, valueSize int) error {
+	switch {
+	case m.options.ReadOnly:
+		return ErrReadOnly
+	case m.options.MaxKeySize > 0 && keySize > m.options.MaxKeySize:
+		return ErrKeyTooLarge
+	case m.options.MaxValueSize > 0 && valueSize > m.options.MaxValueSize:
+		return ErrValueTooLarge
+	case m.options.WeightLimit > 0 && uint64(valueSize) > m.options.WeightLimit:
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// Describe renders the cache's title, capacity and options for listings
+func (m *LRUMap[U, K, V]) Describe() string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return fmt.Sprintf("%s capacity=%d %s", m.title, m.capacity, m.options)
+}
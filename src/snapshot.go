@@ -0,0 +1,86 @@
+package src
+
+import (
+	"slices"
+	"strings"
+)
+
+// CacheSnapshot is a deep copy of one cache; Entries run from least to most recently used
+type CacheSnapshot[U, K Uints, V any] struct {
+	Title    string
+	Capacity U
+	Options  CacheOptions
+	Entries  []Entry[K, V]
+}
+
+// Snapshot deep-copies every cache. Each cache is copied under its own read
+// lock, so the result is consistent per cache but not across caches.
+func (cm *CacheManager[U, K, V]) Snapshot() []CacheSnapshot[U, K, V] {
+	caches := cm.acquireAll()
+	snapshots := make([]CacheSnapshot[U, K, V], 0, len(caches))
+	for _, cache := range caches {
+		snapshots = append(snapshots, cache.Snapshot())
+		cache.Release()
+	}
+	slices.SortFunc(snapshots, func(a, b CacheSnapshot[U, K, V]) int {
+		return strings.Compare(a.Title, b.Title)
+	})
+	return snapshots
+}
+
+// Snapshot deep-copies the cache under its read lock
+func (m *LRUMap[U, K, V]) Snapshot() CacheSnapshot[U, K, V] {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	snap := CacheSnapshot[U, K, V]{
+		Title:    m.title,
+		Capacity: m.capacity,
+		Options:  m.options,
+		Entries:  make([]Entry[K, V], 0, len(m.keyToIdx)),
+	}
+	for idx := m.tailIdx; idx != m.NoIdx; idx = m.nodes[idx].prevIdx {
+		if m.expired(m.getNodePtr(idx)) {
+			continue
+		}
+		entry := m.entryAt(idx)
+		entry.Value = cloneValue(entry.Value)
+		snap.Entries = append(snap.Entries, entry)
+	}
+	return snap
+}
+
+// LoadSnapshot replaces every cache with the snapshot's caches. The memory
+// budget is not checked up front; any excess is reclaimed afterwards.
+func (cm *CacheManager[U, K, V]) LoadSnapshot(snapshots []CacheSnapshot[U, K, V]) {
+	loaded := make([]*LRUMap[U, K, V], len(snapshots))
+	for i, snap := range snapshots {
+		cache := cm.newCache(snap.Title, snap.Capacity, snap.Options)
+		for _, entry := range snap.Entries {
+			cache.restore(entry)
+		}
+		loaded[i] = cache
+	}
+
+	cm.mutex.Lock()
+	old := make([]*LRUMap[U, K, V], 0, len(cm.caches))
+	for title, cache := range cm.caches {
+		old = append(old, cache)
+		delete(cm.caches, title)
+		cm.emit(Event[U, K, V]{Kind: EventDestroy, Cache: title})
+	}
+	for _, cache := range loaded {
+		cm.attach(cache)
+		cm.caches[cache.title] = cache
+		cache.mutex.RLock()
+		cache.emitContents()
+		cache.mutex.RUnlock()
+	}
+	cm.mutex.Unlock()
+
+	for _, cache := range old {
+		cm.detach(cache)
+		cache.Release()
+	}
+	cm.relieve()
+}
@@ -1,10 +1,14 @@
 package src
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"reflect"
 	"runtime"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestSrc(t *testing.T) {
@@ -212,6 +216,265 @@ func TestSrc(t *testing.T) {
 				t.Error("Tail's next should be NoIdx")
 			}
 		})
+
+		t.Run("Tags", func(t *testing.T) {
+			cache := InitLRUMap[uint8, uint64, []byte]("test", 3)
+			cache.PutTagged(1, []byte("one"), "user:1", "page")
+			cache.PutTagged(2, []byte("two"), "user:1")
+			cache.PutTagged(3, []byte("three"), "page")
+
+			if n := cache.InvalidateTag("user:1"); n != 2 {
+				t.Errorf("Expected 2 entries invalidated, got %d", n)
+			}
+			if cache.Get(1) != nil || cache.Get(2) != nil {
+				t.Error("Expected tagged entries to be removed")
+			}
+			if _, ok := cache.tagIndex["user:1"]; ok {
+				t.Error("Expected tag to be dropped from index")
+			}
+			if keys := cache.tagIndex["page"]; len(keys) != 1 {
+				t.Errorf("Expected 1 key left under 'page', got %d", len(keys))
+			}
+
+			// Plain Put replaces the tags of an existing entry
+			cache.Put(3, []byte("three"))
+			if len(cache.Tags(3)) != 0 || len(cache.tagIndex) != 0 {
+				t.Error("Expected Put to drop existing tags")
+			}
+		})
+
+		t.Run("TagsEviction", func(t *testing.T) {
+			cache := InitLRUMap[uint8, uint64, []byte]("test", 2)
+			cache.PutTagged(1, []byte("one"), "a")
+			cache.PutTagged(2, []byte("two"), "a")
+			cache.PutTagged(3, []byte("three"), "b")
+
+			if keys := cache.tagIndex["a"]; len(keys) != 1 {
+				t.Errorf("Expected evicted key to leave tag index, got %d keys", len(keys))
+			}
+			if n := cache.InvalidateTag("a"); n != 1 {
+				t.Errorf("Expected 1 entry invalidated, got %d", n)
+			}
+			if cache.Length() != 1 || cache.Get(3) == nil {
+				t.Error("Expected only key 3 to remain")
+			}
+			cache.Clear()
+			if len(cache.tagIndex) != 0 {
+				t.Error("Expected Clear to reset tag index")
+			}
+		})
+	})
+	t.Run("Options", func(t *testing.T) {
+		t.Run("TTL", func(t *testing.T) {
+			cache := InitLRUMap[uint8, uint64, []byte]("test", 4)
+			cache.options.DefaultTTL = time.Millisecond
+			cache.Put(1, []byte("one"))
+			time.Sleep(5 * time.Millisecond)
+			if cache.Get(1) != nil {
+				t.Error("Expected entry to expire")
+			}
+			if cache.Length() != 0 {
+				t.Error("Expected expired entry to be removed on access")
+			}
+		})
+
+		t.Run("FIFO", func(t *testing.T) {
+			cache := InitLRUMap[uint8, uint64, []byte]("test", 2)
+			cache.options.Policy = PolicyFIFO
+			cache.Put(1, []byte("one"))
+			cache.Put(2, []byte("two"))
+			cache.Get(1)
+			cache.Put(3, []byte("three"))
+			if cache.Get(1) != nil || cache.Get(2) == nil {
+				t.Error("Expected FIFO to evict the oldest insert regardless of reads")
+			}
+		})
+
+		t.Run("WeightLimit", func(t *testing.T) {
+			cache := InitLRUMap[uint8, uint64, []byte]("test", 8)
+			if err := cache.SetOption("weight_limit", "10"); err != nil {
+				t.Fatalf("SetOption() error = %v", err)
+			}
+			cache.Put(1, []byte("aaaa"))
+			cache.Put(2, []byte("bbbb"))
+			cache.Put(3, []byte("cccc"))
+			if cache.Get(1) != nil || cache.weight != 8 {
+				t.Errorf("Expected oldest entry evicted to respect weight limit, weight %d", cache.weight)
+			}
+			if err := cache.SetOption("weight_limit", "4"); err != nil {
+				t.Fatalf("SetOption() error = %v", err)
+			}
+			if cache.Length() != 1 || cache.Get(3) == nil {
+				t.Error("Expected lowering weight_limit to evict down to the newest entry")
+			}
+			cache.Eject(3)
+			if cache.weight != 0 {
+				t.Errorf("Expected weight 0 after eject, got %d", cache.weight)
+			}
+		})
+
+		t.Run("WeightLimitFIFO", func(t *testing.T) {
+			cache := InitLRUMap[uint8, uint64, []byte]("test", 8)
+			cache.SetOption("policy", "fifo")
+			cache.SetOption("weight_limit", "10")
+			cache.Put(1, []byte("aaaa"))
+			cache.Put(2, []byte("bbbb"))
+			cache.Put(3, []byte("cc"))
+			// 1 stays the tail when it grows, so the next oldest entry goes
+			cache.Put(1, []byte("aaaaaaa"))
+			if cache.Get(1) == nil || cache.Get(2) != nil || cache.Get(3) == nil || cache.weight != 9 {
+				t.Errorf("Expected the entry after the updated tail to be evicted, weight %d", cache.weight)
+			}
+			cache.Put(3, []byte("cccc"))
+			if cache.Get(1) != nil || cache.Get(3) == nil || cache.weight != 4 {
+				t.Errorf("Expected the updated tail to be evicted for a newer entry, weight %d", cache.weight)
+			}
+		})
+
+		t.Run("SetGet", func(t *testing.T) {
+			var opts CacheOptions
+			if err := opts.Set("ttl", "90"); err != nil || opts.DefaultTTL != 90*time.Second {
+				t.Errorf("Expected ttl in seconds, got %v (%v)", opts.DefaultTTL, err)
+			}
+			if err := opts.Set("policy", "random"); err == nil {
+				t.Error("Expected invalid policy to be rejected")
+			}
+			if err := opts.Set("max_value_size", "-1"); err == nil {
+				t.Error("Expected negative size to be rejected")
+			}
+			if v, _ := opts.Get("policy"); v != "lru" {
+				t.Errorf("Expected default policy lru, got %s", v)
+			}
+		})
+	})
+
+	t.Run("Dependencies", func(t *testing.T) {
+		t.Run("Transitive", func(t *testing.T) {
+			cache := InitLRUMap[uint8, uint64, []byte]("test", 8)
+			cache.Put(1, []byte("base"))
+			cache.Put(2, []byte("aggregate"))
+			cache.Put(3, []byte("page"))
+			cache.DependsOn(2, 1)
+			cache.DependsOn(3, 2)
+
+			cache.Put(1, []byte("new base"))
+			if cache.Get(2) != nil || cache.Get(3) != nil {
+				t.Error("Expected dependents to be ejected transitively")
+			}
+			if string(cache.Get(1)) != "new base" {
+				t.Error("Expected parent to keep its new value")
+			}
+			if !cache.deps.empty() {
+				t.Errorf("Expected no edges left, got %d", cache.deps.edges.Load())
+			}
+		})
+
+		t.Run("Cycle", func(t *testing.T) {
+			cache := InitLRUMap[uint8, uint64, []byte]("test", 8)
+			cache.Put(1, []byte("a"))
+			cache.Put(2, []byte("b"))
+			cache.DependsOn(1, 2)
+			cache.DependsOn(2, 1)
+
+			cache.Eject(1)
+			if cache.Get(2) != nil {
+				t.Error("Expected dependent in cycle to be ejected")
+			}
+			if !cache.deps.empty() {
+				t.Error("Expected cycle edges to be cleaned up")
+			}
+		})
+
+		t.Run("AcrossCaches", func(t *testing.T) {
+			cm := NewCacheManager[uint8, uint64, []byte]()
+			cm.CreateCache("base", 4, CacheOptions{})
+			cm.CreateCache("derived", 4, CacheOptions{})
+			base, derived := cm.GetCache("base"), cm.GetCache("derived")
+			base.Put(10, []byte("row"))
+			derived.Put(20, []byte("render"))
+			if err := cm.DependsOn("derived", 20, "base", 10); err != nil {
+				t.Fatalf("DependsOn() error = %v", err)
+			}
+
+			base.Put(10, []byte("row v2"))
+			if derived.Get(20) != nil {
+				t.Error("Expected cross-cache dependent to be ejected")
+			}
+
+			standalone := InitLRUMap[uint8, uint64, []byte]("other", 4)
+			if err := standalone.DependsOnIn(1, base, 10); err != ErrForeignCache {
+				t.Errorf("Expected ErrForeignCache, got %v", err)
+			}
+		})
+
+		t.Run("EvictionCleanup", func(t *testing.T) {
+			cache := InitLRUMap[uint8, uint64, []byte]("test", 2)
+			cache.Put(1, []byte("base"))
+			cache.Put(2, []byte("derived"))
+			cache.DependsOn(2, 1)
+			cache.Get(1)
+			cache.Put(3, []byte("other")) // evicts 2
+
+			if !cache.deps.empty() {
+				t.Error("Expected edges of evicted node to be removed")
+			}
+			cache.Put(1, []byte("base v2"))
+			if cache.Length() != 2 {
+				t.Errorf("Expected 2 entries, got %d", cache.Length())
+			}
+		})
+
+		t.Run("EvictedParent", func(t *testing.T) {
+			cache := InitLRUMap[uint8, uint64, []byte]("test", 2)
+			cache.Put(1, []byte("base"))
+			cache.Put(2, []byte("derived"))
+			cache.DependsOn(2, 1)
+			cache.Put(3, []byte("other")) // evicts 1
+
+			if cache.Get(2) == nil {
+				t.Error("Expected the dependent of an evicted entry to stay")
+			}
+			if !cache.deps.empty() {
+				t.Error("Expected edges of evicted node to be removed")
+			}
+		})
+
+		t.Run("UnstoredKey", func(t *testing.T) {
+			cache := InitLRUMap[uint8, uint64, []byte]("test", 2)
+			cache.Put(1, []byte("base"))
+			if err := cache.DependsOn(9, 1); err != ErrKeyNotFound {
+				t.Errorf("Expected ErrKeyNotFound, got %v", err)
+			}
+			if !cache.deps.empty() {
+				t.Error("Expected no edges for a key that is not stored")
+			}
+		})
+
+		t.Run("DestroyedCache", func(t *testing.T) {
+			cm := NewCacheManager[uint8, uint64, []byte]()
+			cm.CreateCache("base", 4, CacheOptions{})
+			cm.CreateCache("derived", 4, CacheOptions{})
+			base, derived := cm.GetCache("base"), cm.GetCache("derived")
+			defer derived.Release()
+			base.Put(10, []byte("row"))
+			derived.Put(20, []byte("render"))
+			derived.Put(21, []byte("summary"))
+			cm.DependsOn("derived", 20, "base", 10)
+			base.DependsOnIn(10, derived, 21)
+
+			// base is still referenced, so it is not cleared yet
+			cm.DestroyCache("base")
+			if !cm.deps.empty() {
+				t.Errorf("Expected the edges of a destroyed cache to be pruned, got %d", cm.deps.edges.Load())
+			}
+			if derived.Get(20) != nil || derived.Get(21) == nil {
+				t.Error("Expected only the dependents of the destroyed cache to be ejected")
+			}
+			if err := derived.DependsOnIn(21, base, 10); err != ErrCacheDestroyed {
+				t.Errorf("Expected ErrCacheDestroyed, got %v", err)
+			}
+			base.Release()
+		})
 	})
 	t.Run("LRUMap", func(t *testing.T) {
 		t.Run("TestLRUMapConcurrency", func(t *testing.T) {
@@ -249,8 +512,8 @@ func TestSrc(t *testing.T) {
 func TestCacheManagerUints(t *testing.T) {
 	t.Run("uint16", func(t *testing.T) {
 		cm := NewCacheManager[uint16, uint64, []byte]()
-		cm.CreateCache("test", 1, ^uint16(0))
-		cache := cm.GetCache(1)
+		cm.CreateCache("test", ^uint16(0), CacheOptions{})
+		cache := cm.GetCache("test")
 		if cm.caches == nil {
 			t.Error("Expected cache to be created")
 		}
@@ -262,8 +525,8 @@ func TestCacheManagerUints(t *testing.T) {
 
 	t.Run("uint32", func(t *testing.T) {
 		cm := NewCacheManager[uint32, uint64, []byte]()
-		cm.CreateCache("test", 1, 1000000) // Use a reasonable capacity instead of max uint32
-		cache := cm.GetCache(1)
+		cm.CreateCache("test", 1000000, CacheOptions{}) // Use a reasonable capacity instead of max uint32
+		cache := cm.GetCache("test")
 		if cm.caches == nil {
 			t.Error("Expected cache to be created")
 		}
@@ -273,6 +536,389 @@ func TestCacheManagerUints(t *testing.T) {
 		cache.Clear()
 	})
 }
+func TestCacheManagerHandles(t *testing.T) {
+	t.Run("DestroyWhileHeld", func(t *testing.T) {
+		cm := NewCacheManager[uint8, uint64, []byte]()
+		cm.CreateCache("test", 4, CacheOptions{})
+		cache := cm.GetCache("test")
+		cache.Put(1, []byte("one"))
+
+		if err := cm.DestroyCache("test"); err != nil {
+			t.Fatalf("DestroyCache() error = %v", err)
+		}
+		if cm.GetCache("test") != nil {
+			t.Error("Expected destroyed cache to be unreachable")
+		}
+		if string(cache.Get(1)) != "one" {
+			t.Error("Expected held handle to stay usable after destroy")
+		}
+		cache.Release()
+		if cache.Length() != 0 {
+			t.Error("Expected last release to clear the cache")
+		}
+		if err := cm.DestroyCache("test"); !errors.Is(err, ErrCacheNotFound) {
+			t.Errorf("Expected ErrCacheNotFound on second destroy, got %v", err)
+		}
+	})
+
+	t.Run("CreateIfAbsent", func(t *testing.T) {
+		cm := NewCacheManager[uint8, uint64, []byte]()
+		first, created, _ := cm.CreateIfAbsent("test", 4, CacheOptions{})
+		if !created {
+			t.Error("Expected first call to create the cache")
+		}
+		first.Put(1, []byte("one"))
+		second, created, _ := cm.CreateIfAbsent("test", 8, CacheOptions{})
+		if created || second != first {
+			t.Error("Expected second call to return the existing cache")
+		}
+		first.Release()
+		second.Release()
+		if string(first.Get(1)) != "one" {
+			t.Error("Expected manager reference to keep the cache alive")
+		}
+	})
+
+	t.Run("CreateCollision", func(t *testing.T) {
+		cm := NewCacheManager[uint8, uint64, []byte]()
+		if err := cm.CreateCache("users", 4, CacheOptions{}); err != nil {
+			t.Fatalf("CreateCache() error = %v", err)
+		}
+		cache := cm.GetCache("users")
+		cache.Put(1, []byte("warm"))
+		cache.Release()
+
+		if err := cm.CreateCache("users", 4, CacheOptions{}); !errors.Is(err, ErrCacheExists) {
+			t.Errorf("Expected ErrCacheExists, got %v", err)
+		}
+		cache = cm.GetCache("users")
+		if string(cache.Get(1)) != "warm" {
+			t.Error("Expected existing cache to survive a second CreateCache")
+		}
+		cache.Release()
+
+		cm.ReplaceCache("users", 4, CacheOptions{})
+		cache = cm.GetCache("users")
+		if cache.Length() != 0 {
+			t.Error("Expected ReplaceCache to install an empty cache")
+		}
+		cache.Release()
+	})
+
+	t.Run("RenameCache", func(t *testing.T) {
+		cm := NewCacheManager[uint8, uint64, []byte]()
+		cm.CreateCache("a", 4, CacheOptions{})
+		cm.CreateCache("b", 4, CacheOptions{})
+		if err := cm.RenameCache("a", "b"); !errors.Is(err, ErrCacheExists) {
+			t.Errorf("Expected ErrCacheExists, got %v", err)
+		}
+		if err := cm.RenameCache("a", "c"); err != nil {
+			t.Fatalf("RenameCache() error = %v", err)
+		}
+		cache := cm.GetCache("c")
+		if cache == nil || cache.Title() != "c" || cm.GetCache("a") != nil {
+			t.Error("Expected cache to be reachable only under its new title")
+		}
+	})
+
+	t.Run("CopyCache", func(t *testing.T) {
+		cm := NewCacheManager[uint8, uint64, []byte]()
+		cm.CreateCache("src", 4, CacheOptions{Description: "orig"})
+		source := cm.GetCache("src")
+		source.Put(1, []byte("one"))
+		source.PutTagged(2, []byte("two"), "t")
+		source.Put(3, []byte("three"))
+		source.Get(1) // recency: 1, 3, 2
+
+		if err := cm.CopyCache("src", "dst", 2); err != nil {
+			t.Fatalf("CopyCache() error = %v", err)
+		}
+		copied := cm.GetCache("dst")
+		nodes := copied.Iterator(false)
+		if len(nodes) != 2 || nodes[0].key != 1 || nodes[1].key != 3 {
+			t.Errorf("Expected most recent entries 1, 3 in order, got %d nodes", len(nodes))
+		}
+		if copied.Options().Description != "orig" || copied.Capacity() != 2 {
+			t.Error("Expected options to be copied with the new capacity")
+		}
+
+		cm.CopyCache("src", "full", 0)
+		full := cm.GetCache("full")
+		if full.Capacity() != 4 || len(full.Tags(2)) != 1 {
+			t.Error("Expected full copy to keep capacity and tags")
+		}
+		full.Get(1)[0] = 'X'
+		if string(source.Get(1)) != "one" {
+			t.Error("Expected copied values not to share memory with the source")
+		}
+		if err := cm.CopyCache("src", "dst", 0); !errors.Is(err, ErrCacheExists) {
+			t.Errorf("Expected ErrCacheExists, got %v", err)
+		}
+	})
+
+	t.Run("MoveKey", func(t *testing.T) {
+		cm := NewCacheManager[uint8, uint64, []byte]()
+		cm.CreateCache("a", 128, CacheOptions{})
+		cm.CreateCache("b", 128, CacheOptions{})
+		a, b := cm.GetCache("a"), cm.GetCache("b")
+		a.PutTagged(1, []byte("one"), "t")
+
+		if err := cm.MoveKey("a", "b", 1, 1); err != nil {
+			t.Fatalf("MoveKey() error = %v", err)
+		}
+		if a.Get(1) != nil || string(b.Get(1)) != "one" || len(b.Tags(1)) != 1 {
+			t.Error("Expected key and tags to move to the target cache")
+		}
+		if err := cm.MoveKey("a", "b", 1, 1); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound, got %v", err)
+		}
+
+		// Opposite-direction moves must not deadlock
+		for i := range uint64(32) {
+			a.Put(100+i, []byte("a"))
+			b.Put(200+i, []byte("b"))
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range uint64(32) {
+				cm.MoveKey("a", "b", 100+i, 3)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := range uint64(32) {
+				cm.MoveKey("b", "a", 200+i, 3)
+			}
+		}()
+		wg.Wait()
+		if a.Length()+b.Length() != 65 {
+			t.Errorf("Expected no entries lost, got %d", a.Length()+b.Length())
+		}
+	})
+
+	t.Run("MoveKeyCascade", func(t *testing.T) {
+		cm := NewCacheManager[uint8, uint64, []byte]()
+		cm.CreateCache("a", 4, CacheOptions{})
+		cm.CreateCache("b", 4, CacheOptions{})
+		a, b := cm.GetCache("a"), cm.GetCache("b")
+		defer a.Release()
+		defer b.Release()
+		b.Put(2, []byte("base"))
+		a.Put(1, []byte("derived"))
+		cm.DependsOn("a", 1, "b", 2)
+
+		// The dependent lives in the lower id cache, which the move also locks
+		done := make(chan error, 1)
+		go func() { done <- cm.MoveKey("b", "a", 2, 1) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("MoveKey() error = %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("MoveKey() deadlocked cascading into the other cache")
+		}
+		if a.Get(1) != nil || string(a.Get(2)) != "base" {
+			t.Error("Expected the dependent to be ejected and the key moved")
+		}
+	})
+
+	t.Run("MoveKeyChecks", func(t *testing.T) {
+		cm := NewCacheManager[uint8, uint64, []byte]()
+		cm.CreateCache("a", 4, CacheOptions{})
+		cm.CreateCache("b", 4, CacheOptions{MaxKeySize: 4, MaxValueSize: 4})
+		a := cm.GetCache("a")
+		defer a.Release()
+		a.Put(1, []byte("value"))
+		a.Put(2, []byte("v"))
+
+		if err := cm.MoveKey("a", "b", 1, 1); !errors.Is(err, ErrValueTooLarge) {
+			t.Errorf("Expected ErrValueTooLarge, got %v", err)
+		}
+		if err := cm.MoveKey("a", "b", 2, 5); !errors.Is(err, ErrKeyTooLarge) {
+			t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+		}
+		a.SetOption("readonly", "true")
+		if err := cm.MoveKey("a", "b", 2, 1); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Expected ErrReadOnly moving out of a read-only cache, got %v", err)
+		}
+		if a.Length() != 2 {
+			t.Errorf("Expected failed moves to keep the entries, got %d", a.Length())
+		}
+	})
+
+	t.Run("ClearResetsFreeList", func(t *testing.T) {
+		cache := InitLRUMap[uint8, uint64, []byte]("test", 2)
+		cache.Put(1, []byte("one"))
+		cache.Put(2, []byte("two"))
+		cache.Clear()
+		cache.Put(3, []byte("three"))
+		cache.Put(4, []byte("four"))
+		if cache.Length() != 2 {
+			t.Errorf("Expected full capacity after Clear, got length %d", cache.Length())
+		}
+	})
+}
+
+func TestCacheManagerMemory(t *testing.T) {
+	slot := nodeBytes[uint8, uint64, []byte]()
+
+	t.Run("Accounting", func(t *testing.T) {
+		cm := NewCacheManager[uint8, uint64, []byte]()
+		cm.CreateCache("a", 4, CacheOptions{})
+		cache := cm.GetCache("a")
+		cache.Put(1, []byte("12345"))
+		cache.Put(1, []byte("123"))
+		if got, want := cm.MemoryStats().Used, 4*slot+3; got != want {
+			t.Errorf("Expected %d bytes used, got %d", want, got)
+		}
+		cache.Release()
+		cm.DestroyCache("a")
+		if used := cm.MemoryStats().Used; used != 0 {
+			t.Errorf("Expected destroy to return all memory, got %d", used)
+		}
+	})
+
+	t.Run("Admission", func(t *testing.T) {
+		cm := NewCacheManager[uint8, uint64, []byte]()
+		cm.SetMemoryLimit(10*slot, MemoryEvictLRU)
+		if err := cm.CreateCache("a", 8, CacheOptions{}); err != nil {
+			t.Fatalf("CreateCache() error = %v", err)
+		}
+		if err := cm.CreateCache("b", 8, CacheOptions{}); !errors.Is(err, ErrMemoryLimit) {
+			t.Errorf("Expected ErrMemoryLimit, got %v", err)
+		}
+		if err := cm.ReplaceCache("a", 9, CacheOptions{}); err != nil {
+			t.Errorf("Expected replacement to reuse the old cache's budget, got %v", err)
+		}
+	})
+
+	t.Run("EvictLRUCache", func(t *testing.T) {
+		cm := NewCacheManager[uint8, uint64, []byte]()
+		cm.CreateCache("old", 8, CacheOptions{})
+		cm.CreateCache("new", 8, CacheOptions{})
+		old, recent := cm.GetCache("old"), cm.GetCache("new")
+		defer old.Release()
+		defer recent.Release()
+		old.Put(1, make([]byte, 100))
+		old.Put(2, make([]byte, 100))
+		recent.Put(1, make([]byte, 100))
+
+		cm.SetMemoryLimit(16*slot+250, MemoryEvictLRU)
+		recent.Put(2, make([]byte, 100))
+		if old.Length() != 0 || recent.Length() != 2 {
+			t.Errorf("Expected least recently used cache to be drained first, got old=%d new=%d",
+				old.Length(), recent.Length())
+		}
+	})
+
+	t.Run("EvictLargestCache", func(t *testing.T) {
+		cm := NewCacheManager[uint8, uint64, []byte]()
+		cm.CreateCache("big", 8, CacheOptions{})
+		cm.CreateCache("small", 8, CacheOptions{})
+		big, small := cm.GetCache("big"), cm.GetCache("small")
+		defer big.Release()
+		defer small.Release()
+		big.Put(1, make([]byte, 300))
+		big.Put(2, make([]byte, 300))
+		small.Put(1, make([]byte, 10))
+
+		cm.SetMemoryLimit(16*slot+400, MemoryEvictLargest)
+		if big.Length() != 1 || small.Length() != 1 {
+			t.Errorf("Expected the largest cache to give up an entry, got big=%d small=%d",
+				big.Length(), small.Length())
+		}
+		stats := cm.MemoryStats()
+		if len(stats.Caches) != 2 || stats.Caches[0].Title != "big" || stats.Used > stats.Limit {
+			t.Errorf("Unexpected memory stats: %+v", stats)
+		}
+	})
+}
+
+func TestCacheManagerEvents(t *testing.T) {
+	t.Run("Order", func(t *testing.T) {
+		cm := NewCacheManager[uint8, uint64, []byte]()
+		var got []string
+		cancel := cm.Observe(func(ev Event[uint8, uint64, []byte]) {
+			got = append(got, fmt.Sprintf("%s %s %d", ev.Kind, ev.Cache, ev.Key))
+		})
+		cm.CreateCache("a", 2, CacheOptions{})
+		cache := cm.GetCache("a")
+		cache.Put(1, []byte("one"))
+		cache.Put(2, []byte("two"))
+		cache.Put(3, []byte("three"))
+		cache.Eject(2)
+		cache.Release()
+		cm.RenameCache("a", "b")
+		cm.DestroyCache("b")
+		cancel()
+		cm.CreateCache("c", 2, CacheOptions{})
+
+		want := []string{
+			"create a 0", "set a 1", "set a 2", "evict a 1", "set a 3", "del a 2", "rename a 0", "destroy b 0",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected events %v, got %v", want, got)
+		}
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		primary := NewCacheManager[uint8, uint64, []byte]()
+		replica := NewCacheManager[uint8, uint64, []byte]()
+		primary.CreateCache("a", 4, CacheOptions{})
+		seeded := primary.GetCache("a")
+		seeded.PutTagged(1, []byte("one"), "odd")
+		seeded.Release()
+
+		replica.LoadSnapshot(primary.Snapshot())
+		defer primary.Observe(func(ev Event[uint8, uint64, []byte]) { applyEvent(replica, ev) })()
+
+		cache := primary.GetCache("a")
+		defer cache.Release()
+		for i := range uint64(6) {
+			cache.Put(i+2, []byte{byte(i)})
+		}
+		cache.SetOption("ttl", "1h")
+		primary.CopyCache("a", "b", 2)
+
+		if got, want := replica.Snapshot(), primary.Snapshot(); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected replica to match primary\nwant %+v\ngot  %+v", want, got)
+		}
+	})
+}
+
+// applyEvent is a minimal replica used to check that events reproduce a manager
+func applyEvent(cm *CacheManager[uint8, uint64, []byte], ev Event[uint8, uint64, []byte]) {
+	switch ev.Kind {
+	case EventCreate:
+		cm.ReplaceCache(ev.Cache, ev.Capacity, ev.Options)
+		return
+	case EventDestroy:
+		cm.DestroyCache(ev.Cache)
+		return
+	case EventRename:
+		cm.RenameCache(ev.Cache, ev.Target)
+		return
+	}
+	cache := cm.GetCache(ev.Cache)
+	if cache == nil {
+		return
+	}
+	defer cache.Release()
+	switch ev.Kind {
+	case EventSet:
+		cache.Restore(ev.Entry)
+	case EventDel, EventExpire, EventEvict:
+		cache.Eject(ev.Key)
+	case EventClear:
+		cache.Clear()
+	case EventConfig:
+		cache.SetOption(ev.Option, ev.Setting)
+	}
+}
+
 func BenchmarkLRUMap(b *testing.B) {
 	sizes := []uint8{4, 8, 16, 64, 256 - 1}
 	operations := []int{100, 1000, 10000}
@@ -453,3 +1099,84 @@ func BenchmarkLRUMapHitRatio(b *testing.B) {
 		}
 	}
 }
+
+func TestGetWait(t *testing.T) {
+	cm := NewCacheManager[uint8, uint64, []byte]()
+	cm.CreateCache("jobs", 4, CacheOptions{})
+	cache := cm.GetCache("jobs")
+	defer cache.Release()
+
+	// wait starts GetWait and waits until it is parked on the key
+	wait := func(ctx context.Context, key uint64) chan error {
+		done := make(chan error, 1)
+		go func() {
+			value, err := cache.GetWait(ctx, key)
+			if err == nil && string(value) != "ready" {
+				err = fmt.Errorf("unexpected value %q", value)
+			}
+			done <- err
+		}()
+		for {
+			cache.mutex.RLock()
+			parked := cache.waiters[key] != nil
+			cache.mutex.RUnlock()
+			if parked {
+				return done
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	result := func(done chan error) error {
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("GetWait was not released")
+			return nil
+		}
+	}
+
+	t.Run("Set", func(t *testing.T) {
+		first, second := wait(context.Background(), 1), wait(context.Background(), 1)
+		cache.Put(1, []byte("ready"))
+		if err := result(first); err != nil {
+			t.Errorf("Expected the first waiter to get the value, got %v", err)
+		}
+		if err := result(second); err != nil {
+			t.Errorf("Expected the second waiter to get the value, got %v", err)
+		}
+		if value, err := cache.GetWait(context.Background(), 1); err != nil || string(value) != "ready" {
+			t.Errorf("Expected a present key to return at once, got %q, %v", value, err)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if _, err := cache.GetWait(ctx, 2); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected a deadline error, got %v", err)
+		}
+		if len(cache.waiters) != 0 {
+			t.Errorf("Expected timed out waiters to be removed, got %d", len(cache.waiters))
+		}
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		done := wait(context.Background(), 3)
+		cache.Clear()
+		if err := result(done); !errors.Is(err, ErrCacheCleared) {
+			t.Errorf("Expected ErrCacheCleared, got %v", err)
+		}
+	})
+
+	t.Run("Destroy", func(t *testing.T) {
+		done := wait(context.Background(), 4)
+		cm.DestroyCache("jobs")
+		if err := result(done); !errors.Is(err, ErrCacheDestroyed) {
+			t.Errorf("Expected ErrCacheDestroyed, got %v", err)
+		}
+		if _, err := cache.GetWait(context.Background(), 4); !errors.Is(err, ErrCacheDestroyed) {
+			t.Errorf("Expected GetWait on a destroyed cache to fail at once, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,238 @@
+package src
+
+import (
+	"cmp"
+	"slices"
+)
+
+// Watch tracks one key for a transaction. It reports a change once the key
+// is stored or removed, or its cache is cleared, destroyed or replaced.
+type Watch[U, K Uints, V any] struct {
+	title   string
+	cache   *LRUMap[U, K, V] // nil if no cache was stored under title
+	key     K
+	changed bool // guarded by cache's lock
+}
+
+// Watch starts tracking key in the cache stored under title, which need not exist.
+// The watch must be closed with Close.
+func (cm *CacheManager[U, K, V]) Watch(title string, key K) *Watch[U, K, V] {
+	w := &Watch[U, K, V]{title: title, key: key}
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	if cache := cm.caches[title]; cache != nil {
+		cache.mutex.Lock()
+		if cache.watches == nil {
+			cache.watches = make(map[K][]*Watch[U, K, V])
+		}
+		cache.watches[key] = append(cache.watches[key], w)
+		cache.mutex.Unlock()
+		w.cache = cache
+	}
+	return w
+}
+
+// Title returns the title of the watched cache
+func (w *Watch[U, K, V]) Title() string {
+	return w.title
+}
+
+// Close stops tracking the key
+func (w *Watch[U, K, V]) Close() {
+	if w.cache == nil {
+		return
+	}
+	w.cache.mutex.Lock()
+	defer w.cache.mutex.Unlock()
+	list := slices.DeleteFunc(w.cache.watches[w.key], func(o *Watch[U, K, V]) bool { return o == w })
+	if len(list) == 0 {
+		delete(w.cache.watches, w.key)
+	} else {
+		w.cache.watches[w.key] = list
+	}
+}
+
+// touchWatches marks the watches on key as changed while the write lock is held
+func (m *LRUMap[U, K, V]) touchWatches(key K) {
+	for _, w := range m.watches[key] {
+		w.changed = true
+	}
+}
+
+// touchAllWatches marks every watch on the cache as changed while the write lock is held
+func (m *LRUMap[U, K, V]) touchAllWatches() {
+	for _, list := range m.watches {
+		for _, w := range list {
+			w.changed = true
+		}
+	}
+}
+
+// Tx gives access to caches locked together by CacheManager.Update. Its
+// methods name caches by title and fail with ErrCacheNotFound for titles that
+// were not locked, and its writes fail with ErrReadOnly on read-only caches.
+type Tx[U, K Uints, V any] struct {
+	caches map[string]*LRUMap[U, K, V]
+}
+
+// Update locks the caches stored under titles and calls fn with them. Locks
+// are taken in cache id order, so concurrent updates cannot deadlock, and
+// other callers observe fn's changes all at once. Titles that name no cache
+// are skipped.
+func (cm *CacheManager[U, K, V]) Update(titles []string, fn func(tx *Tx[U, K, V]) error) error {
+	tx := &Tx[U, K, V]{caches: make(map[string]*LRUMap[U, K, V], len(titles))}
+	var locked []*LRUMap[U, K, V]
+	for _, title := range titles {
+		if _, seen := tx.caches[title]; seen {
+			continue
+		}
+		if cache := cm.GetCache(title); cache != nil {
+			tx.caches[title] = cache
+			locked = append(locked, cache)
+		}
+	}
+	slices.SortFunc(locked, func(a, b *LRUMap[U, K, V]) int { return cmp.Compare(a.id, b.id) })
+	for _, cache := range locked {
+		cache.mutex.Lock()
+	}
+
+	err := fn(tx)
+
+	// Release every lock before settling, as a cascade may lock any cache
+	work := make([]pendingWork[U, K, V], len(locked))
+	for i, cache := range locked {
+		work[i] = cache.release()
+	}
+	for i, cache := range locked {
+		work[i].settle()
+		cache.Release()
+	}
+	return err
+}
+
+func (tx *Tx[U, K, V]) cache(title string) (*LRUMap[U, K, V], error) {
+	if cache := tx.caches[title]; cache != nil {
+		return cache, nil
+	}
+	return nil, ErrCacheNotFound
+}
+
+// writable returns a locked cache that accepts changes: a read-only cache
+// fails every write of a transaction with ErrReadOnly
+func (tx *Tx[U, K, V]) writable(title string) (*LRUMap[U, K, V], error) {
+	cache, err := tx.cache(title)
+	if err == nil && cache.options.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	return cache, err
+}
+
+// Changed reports whether the watched key changed since the watch started.
+// The watched cache's title must be among the locked titles.
+func (tx *Tx[U, K, V]) Changed(w *Watch[U, K, V]) bool {
+	if tx.caches[w.title] != w.cache {
+		return true
+	}
+	return w.cache != nil && w.changed
+}
+
+// Get retrieves a value and reports whether the key was present
+func (tx *Tx[U, K, V]) Get(title string, key K) (V, bool, error) {
+	cache, err := tx.cache(title)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	value, ok := cache.get(key)
+	return value, ok, nil
+}
+
+// Lookup returns a copy of a live entry together with its version, which
+// changes every time a value is stored under the key
+func (tx *Tx[U, K, V]) Lookup(title string, key K) (Entry[K, V], uint64, bool, error) {
+	cache, err := tx.cache(title)
+	if err != nil {
+		return Entry[K, V]{}, 0, false, err
+	}
+	cache.markUsed()
+	idx, ok := cache.lookup(key)
+	if !ok {
+		return Entry[K, V]{}, 0, false, nil
+	}
+	cache.touch(idx)
+	node := cache.getNodePtr(idx)
+	return cache.entryAt(idx), node.version, true, nil
+}
+
+// Restore stores a copied entry as-is, keeping its tags, flags and absolute
+// expiry
+func (tx *Tx[U, K, V]) Restore(title string, entry Entry[K, V]) error {
+	cache, err := tx.writable(title)
+	if err != nil {
+		return err
+	}
+	cache.markUsed()
+	cache.restore(entry)
+	return nil
+}
+
+// Put adds or updates a key-value pair and replaces its tags
+func (tx *Tx[U, K, V]) Put(title string, key K, value V, tags ...string) error {
+	cache, err := tx.writable(title)
+	if err != nil {
+		return err
+	}
+	cache.markUsed()
+	cache.emitSet(cache.put(key, value, tags))
+	return nil
+}
+
+// PutFlagged runs Put and keeps flags with the value, see Entry.Flags
+func (tx *Tx[U, K, V]) PutFlagged(title string, key K, value V, flags uint32, tags ...string) error {
+	cache, err := tx.writable(title)
+	if err != nil {
+		return err
+	}
+	cache.markUsed()
+	idx := cache.put(key, value, tags)
+	cache.getNodePtr(idx).flags = flags
+	cache.emitSet(idx)
+	return nil
+}
+
+// CheckWrite runs LRUMap.CheckWrite on a locked cache
+func (tx *Tx[U, K, V]) CheckWrite(title string, keySize, valueSize int) error {
+	cache, err := tx.cache(title)
+	if err != nil {
+		return err
+	}
+	return cache.checkWrite(keySize, valueSize)
+}
+
+// Eject removes a key and reports whether it existed
+func (tx *Tx[U, K, V]) Eject(title string, key K) (bool, error) {
+	cache, err := tx.writable(title)
+	if err != nil {
+		return false, err
+	}
+	return cache.eject(key, EventDel), nil
+}
+
+// InvalidateTag removes every entry carrying tag and returns how many were removed
+func (tx *Tx[U, K, V]) InvalidateTag(title, tag string) (int, error) {
+	cache, err := tx.writable(title)
+	if err != nil {
+		return 0, err
+	}
+	return cache.invalidateTag(tag), nil
+}
+
+// Clear removes all items from a cache
+func (tx *Tx[U, K, V]) Clear(title string) error {
+	cache, err := tx.writable(title)
+	if err != nil {
+		return err
+	}
+	cache.clear()
+	return nil
+}
@@ -1,23 +1,44 @@
 package src
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 type Uints interface {
 	~uint8 | ~uint16 | ~uint32 | ~uint64
 }
 
 type Node[U, K Uints, V any] struct {
-	value   V
-	key     K
-	prevIdx U
-	nextIdx U
+	value     V
+	tags      []string
+	flags     uint32 // opaque to the cache, see Entry.Flags
+	expiresAt int64
+	size      int
+	version   uint64
+	key       K
+	prevIdx   U
+	nextIdx   U
 }
 
 type LRUMap[U, K Uints, V any] struct {
 	nodes    []Node[U, K, V]
 	freeList []U
 	title    string
+	id       uint64
 	keyToIdx map[K]U
+	tagIndex map[string]map[K]struct{}
+	options  CacheOptions
+	weight   uint64
+	deps     *depGraph[U, K, V]
+	owner    *CacheManager[U, K, V]
+	lastUse  atomic.Uint64
+	stale    []staleKey[K]
+	cleared  bool
+	retired  bool // left its manager; GetWait fails instead of waiting
+	waiters  map[K]*waiter
+	watches  map[K][]*Watch[U, K, V]
+	refs     atomic.Int32
 	mutex    sync.RWMutex
 	headIdx  U
 	tailIdx  U
@@ -26,5 +47,39 @@ type LRUMap[U, K Uints, V any] struct {
 }
 
 type CacheManager[U, K Uints, V any] struct {
-	caches map[K]*LRUMap[U, K, V]
+	caches map[string]*LRUMap[U, K, V]
+	deps   *depGraph[U, K, V]
+	memory memoryBudget
+	mutex  sync.RWMutex
+
+	observers    atomic.Pointer[[]*observer[U, K, V]]
+	observeMutex sync.Mutex
+}
+
+type memoryBudget struct {
+	used       atomic.Int64
+	limit      atomic.Uint64
+	strategy   atomic.Value // MemoryStrategy
+	clock      atomic.Uint64
+	reclaiming atomic.Bool
+}
+
+type depRef[U, K Uints, V any] struct {
+	cache *LRUMap[U, K, V]
+	key   K
+}
+
+type depSet[U, K Uints, V any] map[depRef[U, K, V]]struct{}
+
+type depGraph[U, K Uints, V any] struct {
+	parents  map[depRef[U, K, V]]depSet[U, K, V]
+	children map[depRef[U, K, V]]depSet[U, K, V]
+	edges    atomic.Int64
+	mutex    sync.Mutex
+}
+
+type staleKey[K Uints] struct {
+	key     K
+	gone    bool
+	evicted bool // only its edges are dropped, its dependents stay
 }
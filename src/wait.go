@@ -0,0 +1,80 @@
+package src
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrCacheCleared   = errors.New("cache was cleared")
+	ErrCacheDestroyed = errors.New("cache was destroyed")
+)
+
+// waiter is shared by every GetWait call parked on one key. done is closed
+// when the key is stored, or with err set when the cache is cleared or destroyed.
+type waiter struct {
+	done  chan struct{}
+	err   error
+	count int
+}
+
+// GetWait returns the value stored under key, waiting until another caller
+// stores it if it is absent. It fails with ctx's error once ctx is done, with
+// ErrCacheCleared if the cache is cleared and with ErrCacheDestroyed if the
+// cache leaves its manager. The cache is not locked while waiting.
+func (m *LRUMap[U, K, V]) GetWait(ctx context.Context, key K) (V, error) {
+	var zero V
+	for {
+		m.mutex.Lock()
+		if value, ok := m.get(key); ok {
+			m.unlock()
+			return value, nil
+		}
+		if m.retired {
+			m.unlock()
+			return zero, ErrCacheDestroyed
+		}
+		w := m.waiters[key]
+		if w == nil {
+			if m.waiters == nil {
+				m.waiters = make(map[K]*waiter)
+			}
+			w = &waiter{done: make(chan struct{})}
+			m.waiters[key] = w
+		}
+		w.count++
+		m.unlock()
+
+		select {
+		case <-w.done:
+			if w.err != nil {
+				return zero, w.err
+			}
+			// The key was stored; look it up again as it may already be gone
+		case <-ctx.Done():
+			m.mutex.Lock()
+			if w.count--; w.count == 0 && m.waiters[key] == w {
+				delete(m.waiters, key)
+			}
+			m.mutex.Unlock()
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// wake releases the callers waiting for key while the write lock is held
+func (m *LRUMap[U, K, V]) wake(key K) {
+	if w, ok := m.waiters[key]; ok {
+		delete(m.waiters, key)
+		close(w.done)
+	}
+}
+
+// wakeAll fails every waiting caller with err while the write lock is held
+func (m *LRUMap[U, K, V]) wakeAll(err error) {
+	for key, w := range m.waiters {
+		delete(m.waiters, key)
+		w.err = err
+		close(w.done)
+	}
+}